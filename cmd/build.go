@@ -0,0 +1,99 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/platform"
+)
+
+var keepOverlay bool // keep the overlay directory after build
+
+// buildCmd represents the build command
+var buildCmd = &cobra.Command{
+	Use:   "build [flags] -- [go build flags] [packages]",
+	Short: "Build an instrumented binary without changing the source files",
+	Long: `This command will write the patched files to a temporary overlay
+directory and run "go build -overlay" with the given arguments. The source
+files, go.mod and go.sum are not changed.
+	`,
+	PreRun: PreRunBuild,
+	Run:    RunBuild,
+}
+
+func init() {
+	rootCmd.AddCommand(buildCmd)
+
+	// provider choices
+	buildCmd.Flags().StringVarP(&provider, "provider", "p", "prometheus",
+		"metrics provider to use, supports \"gometrics\" & \"prometheus\"")
+	buildCmd.Flags().StringVarP(&metricsPrefix, "metrics-prefix", "m",
+		"metrics_gen", "generated metrics names prefix, default to \"metrics_gen\"")
+	buildCmd.Flags().BoolVarP(&keepOverlay, "keep", "k", false,
+		"keep the overlay directory after build")
+}
+
+func PreRunBuild(cmd *cobra.Command, args []string) {
+	// run root pre-run
+	rootCmd.PreRun(cmd, args)
+
+	if dryRun {
+		log.Fatal("dry run is not supported by build")
+	}
+}
+
+func RunBuild(cmd *cobra.Command, args []string) {
+	log.Debugf("dirs: %v. rdirs: %v", searchDirs,
+		recursiveSearchDirs)
+
+	tmpDir, err := os.MkdirTemp("", "metrics-gen-")
+	if err != nil {
+		log.Fatalf("error creating overlay dir: %v", err)
+	}
+
+	// the overlay dir is removed before exiting on errors too
+	err = buildOverlay(tmpDir, args)
+
+	if keepOverlay {
+		log.Infof("overlay dir kept at %s", tmpDir)
+	} else if err := os.RemoveAll(tmpDir); err != nil {
+		log.Warnf("error removing overlay dir %s: %v", tmpDir, err)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// buildOverlay writes the patched files to the overlay directory and runs go
+// build with it
+func buildOverlay(tmpDir string, args []string) error {
+	p, err := patchFiles(platform.MetricsProviderConfig{
+		OverlayDir:    tmpDir,
+		MetricsPrefix: metricsPrefix,
+		Provider:      provider,
+	}, nil, false)
+	if err != nil {
+		return err
+	}
+	if err := p.PostPatch(info); err != nil {
+		return fmt.Errorf("error post patch: %v", err)
+	}
+
+	goArgs := append([]string{"build"}, platform.OverlayGoFlags(tmpDir)...)
+	goArgs = append(goArgs, args...)
+	log.Infof("go %v", goArgs)
+	goBuild := exec.Command("go", goArgs...)
+	goBuild.Stdout = os.Stdout
+	goBuild.Stderr = os.Stderr
+	if err := goBuild.Run(); err != nil {
+		return fmt.Errorf("go build failed: %v", err)
+	}
+	return nil
+}
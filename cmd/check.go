@@ -0,0 +1,79 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"os"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/platform"
+)
+
+// checkCmd represents the check command
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check that the generated code is up to date",
+	Long: `This command will generate the code in memory and compare it with the
+files on disk. It prints a diff for every file whose generated code is missing
+or out of date and exits with a non-zero status, which makes it suitable for CI.
+	`,
+	PreRun: PreRunCheck,
+	Run:    RunCheck,
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+
+	// provider choices, must be the same as the ones used to generate the code
+	checkCmd.Flags().StringVarP(&provider, "provider", "p", "prometheus",
+		"metrics provider to use, supports \"gometrics\" & \"prometheus\"")
+	checkCmd.Flags().StringVarP(&metricsPrefix, "metrics-prefix", "m",
+		"metrics_gen", "generated metrics names prefix, default to \"metrics_gen\"")
+}
+
+func PreRunCheck(cmd *cobra.Command, args []string) {
+	// run root pre-run
+	rootCmd.PreRun(cmd, args)
+}
+
+func RunCheck(cmd *cobra.Command, args []string) {
+	log.Debugf("dirs: %v. rdirs: %v", searchDirs,
+		recursiveSearchDirs)
+
+	// the code is always generated again, a file edited by hand keeps the uuid
+	// of its directives. Orphaned generated markers make the patching fail.
+	if _, err := patchFiles(platform.MetricsProviderConfig{
+		Inplace:       true,
+		MetricsPrefix: metricsPrefix,
+		Provider:      provider,
+		DryRun:        true,
+	}, nil, true); err != nil {
+		log.Fatal(err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("error getting current directory: %v", err)
+	}
+	diffs := modifiedFilesDiff(cwd)
+	if len(diffs) == 0 {
+		log.Infof("generated code is up to date")
+		return
+	}
+
+	files := []string{}
+	for file := range diffs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	for _, file := range files {
+		log.Errorf("generated code in %s is out of date", file)
+		if _, err := os.Stdout.WriteString(diffs[file]); err != nil {
+			log.Fatalf("error writing diff: %v", err)
+		}
+	}
+	log.Fatalf("%d files need to be generated again", len(files))
+}
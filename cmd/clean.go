@@ -0,0 +1,62 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+)
+
+// cleanCmd represents the clean command
+var cleanCmd = &cobra.Command{
+	Use:   "clean",
+	Short: "Remove generated code from files",
+	Long: `This command will remove all the code blocks generated by metrics-gen
+and the imports only needed by them. Trace directives are kept so the files
+are restored to what they were before generation.
+	`,
+	PreRun: PreRunClean,
+	Run:    RunClean,
+}
+
+func init() {
+	rootCmd.AddCommand(cleanCmd)
+}
+
+func PreRunClean(cmd *cobra.Command, args []string) {
+	// run root pre-run
+	rootCmd.PreRun(cmd, args)
+}
+
+func RunClean(cmd *cobra.Command, args []string) {
+	log.Debugf("dirs: %v. rdirs: %v", searchDirs,
+		recursiveSearchDirs)
+
+	info = parse.NewCollectInfo()
+	if err := addAllDirs(nil); err != nil {
+		log.Fatal(err)
+	}
+
+	// the generated code is cut out of the files on disk, printing them again
+	// would change the formatting of the code around it
+	for _, filename := range info.Files() {
+		if !info.HasGenerated(filename) {
+			continue
+		}
+		data, err := info.CleanSource(filename)
+		if err != nil {
+			log.Fatalf("error removing generated code: %v", err)
+		}
+		log.Infof("removing generated code from %s", filename)
+		if dryRun {
+			continue
+		}
+		if err := os.WriteFile(filename, data, 0o644); err != nil {
+			log.Fatalf("error writing %s: %v", filename, err)
+		}
+	}
+}
@@ -5,13 +5,13 @@ package cmd
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
 	"regexp"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
-	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
 	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/platform"
-	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/platform/common"
 )
 
 var (
@@ -19,6 +19,7 @@ var (
 	inplace       bool
 	provider      string
 	metricsPrefix string // metrics names prefix, default to "metrics_gen"
+	overlayDir    string // directory for "go build -overlay" files
 )
 
 // generateCmd represents the generate command
@@ -33,8 +34,8 @@ that captures the metrics for your code.
 }
 
 func needIgnore(filename string) bool {
-	if inplace {
-		// if inplace, we need not ignore any file
+	if inplace || overlayDir != "" {
+		// if inplace or overlay, we need not ignore any file
 		return false
 	}
 	regex := regexp.MustCompile(fmt.Sprintf(`.*_%s\.go`, suffix))
@@ -45,29 +46,6 @@ func needIgnore(filename string) bool {
 	return match
 }
 
-func addAllDirs() {
-	if info == nil {
-		log.Fatal("info is nil")
-	}
-	for _, dir := range searchDirs {
-		err := info.AddTraceDir(dir, false, needIgnore)
-		if err != nil {
-			log.Fatalf("error adding dir %s: %v", dir, err)
-		}
-	}
-	for _, dir := range recursiveSearchDirs {
-		err := info.AddTraceDir(dir, true, needIgnore)
-		if err != nil {
-			log.Fatalf("error adding dir %s: %v", dir, err)
-		}
-	}
-
-	// fail if no definition directive found anywhere in the files
-	if !info.HasDefinitionDirective() {
-		log.Fatal("no definition directive found")
-	}
-}
-
 func init() {
 	rootCmd.AddCommand(generateCmd)
 
@@ -86,6 +64,10 @@ func init() {
 			"generated files will be named <filename>_tracegen.go")) // suffix option
 	generateCmd.Flags().BoolVarP(&inplace, "inplace", "i",
 		false, "patch files in place") // inplace flag
+	generateCmd.Flags().StringVarP(&overlayDir, "overlay", "o", "",
+		("directory to write patched files to. The original files are not " +
+			"changed, build with \"go build -overlay <dir>/overlay.json " +
+			"-modfile <dir>/go.mod\"")) // overlay option
 	// provider choices
 	generateCmd.Flags().StringVarP(&provider, "provider", "p", "prometheus",
 		"metrics provider to use, supports \"gometrics\" & \"prometheus\"")
@@ -98,13 +80,23 @@ func PreRunGenerate(cmd *cobra.Command, args []string) {
 	rootCmd.PreRun(cmd, args)
 
 	// fail if suffix is not specified
-	if suffix == "" && !inplace {
+	if suffix == "" && !inplace && overlayDir == "" {
 		log.Fatal("suffix must be specified")
 	}
 
-	// sufix and inplace are mutually exclusive
-	if suffix != "" && inplace {
-		log.Fatal("suffix and inplace are mutually exclusive")
+	// sufix, inplace and overlay are mutually exclusive
+	if (suffix != "" && inplace) || (overlayDir != "" && (suffix != "" || inplace)) {
+		log.Fatal("suffix, inplace and overlay are mutually exclusive")
+	}
+
+	if overlayDir != "" {
+		var err error
+		if overlayDir, err = filepath.Abs(overlayDir); err != nil {
+			log.Fatalf("invalid overlay dir: %v", err)
+		}
+		if err := os.MkdirAll(overlayDir, 0o755); err != nil {
+			log.Fatalf("error creating overlay dir: %v", err)
+		}
 	}
 }
 
@@ -112,29 +104,17 @@ func RunGenerate(cmd *cobra.Command, args []string) {
 	log.Debugf("dirs: %v. rdirs: %v", searchDirs,
 		recursiveSearchDirs)
 
-	info = parse.NewCollectInfo()
-	addAllDirs()
-
-	// select provider
-	var p platform.MetricsProvider
 	cfg := platform.MetricsProviderConfig{
 		Inplace:       inplace,
 		Suffix:        suffix,
+		OverlayDir:    overlayDir,
 		MetricsPrefix: metricsPrefix,
 		Provider:      provider,
 		DryRun:        dryRun,
 	}
-
-	if p = common.MetricsProviderFactory(cfg); p == nil {
-		log.Fatalf("invalid provider %s", provider)
-	}
-
-	if err := p.PrePatch(info); err != nil {
-		log.Fatalf("error pre patch: %v", err)
-	}
-
-	if err := p.Patch(info); err != nil {
-		log.Fatalf("error patching: %v", err)
+	p, err := patchFiles(cfg, needIgnore, false)
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	if err := p.PostPatch(info); err != nil {
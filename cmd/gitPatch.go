@@ -4,14 +4,34 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/platform"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/utils"
+)
+
+var (
+	patchFormat string // "diff" or "mbox"
+	patchOutput string // output file, default to stdout
 )
 
 // gitPatchCmd represents the gitPatch command
 var gitPatchCmd = &cobra.Command{
-	Use:    "git-patch",
-	Short:  "Patch code as git patch",
-	Long:   `This command will generate a git patch that contains the patched code`,
+	Use:   "git-patch",
+	Short: "Patch code as git patch",
+	Long: `This command will generate a git patch that contains the patched code.
+The files are patched in memory and the working tree is not touched. The
+patch can be a unified diff for "git apply" or a mbox for "git am".
+	`,
 	PreRun: PreRunGitPatch,
 	Run:    RunGitPatch,
 }
@@ -28,13 +48,144 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// gitPatchCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	gitPatchCmd.Flags().StringVarP(&patchFormat, "format", "f", "diff",
+		"patch format, supports \"diff\" for git apply & \"mbox\" for git am")
+	gitPatchCmd.Flags().StringVarP(&patchOutput, "output", "o", "",
+		"file to write the patch to, default to stdout")
+	// provider choices
+	gitPatchCmd.Flags().StringVarP(&provider, "provider", "p", "prometheus",
+		"metrics provider to use, supports \"gometrics\" & \"prometheus\"")
+	gitPatchCmd.Flags().StringVarP(&metricsPrefix, "metrics-prefix", "m",
+		"metrics_gen", "generated metrics names prefix, default to \"metrics_gen\"")
 }
 
 func PreRunGitPatch(cmd *cobra.Command, args []string) {
 	// run root pre-run
 	rootCmd.PreRun(cmd, args)
+
+	if patchFormat != "diff" && patchFormat != "mbox" {
+		log.Fatalf("invalid patch format %s", patchFormat)
+	}
+}
+
+// gitTopLevel returns the root of the git working tree, or the current
+// directory if it is not in a git working tree
+func gitTopLevel() string {
+	out, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+	if err == nil {
+		return strings.TrimSpace(string(out))
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		log.Fatalf("error getting current directory: %v", err)
+	}
+	return cwd
+}
+
+// gitConfig returns a git config value or the default value
+func gitConfig(name string, defaultValue string) string {
+	out, err := exec.Command("git", "config", name).Output()
+	if err != nil || strings.TrimSpace(string(out)) == "" {
+		return defaultValue
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// modifiedFilesDiff returns the diff of every modified file against the file
+// on disk, keyed by the file path relative to root
+func modifiedFilesDiff(root string) map[string]string {
+	res := make(map[string]string)
+	for _, filename := range info.Files() {
+		if !info.IsModified(filename) {
+			continue
+		}
+		newData := renderFile(filename)
+		oldData, err := os.ReadFile(filename)
+		if err != nil {
+			log.Fatalf("error reading %s: %v", filename, err)
+		}
+
+		absPath, err := filepath.Abs(filename)
+		if err != nil {
+			log.Fatalf("error getting absolute path of %s: %v", filename, err)
+		}
+		relPath, err := filepath.Rel(root, absPath)
+		if err != nil {
+			log.Fatalf("error getting relative path of %s: %v", filename, err)
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		if diff := utils.UnifiedDiff(relPath, oldData, newData); diff != "" {
+			res[relPath] = diff
+		}
+	}
+	return res
+}
+
+// mboxHeader returns the mail header and the commit message of the patch
+func mboxHeader(files []string) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From 0000000000000000000000000000000000000000 Mon Sep 17 00:00:00 2001\n")
+	fmt.Fprintf(&buf, "From: %s <%s>\n", gitConfig("user.name", "metrics-gen"),
+		gitConfig("user.email", "metrics-gen@localhost"))
+	fmt.Fprintf(&buf, "Date: %s\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Subject: [PATCH] Add %s metrics code generated by metrics-gen\n\n",
+		provider)
+	fmt.Fprintf(&buf, "Generate the %s metrics code for the +trace directives in:\n\n",
+		provider)
+	for _, file := range files {
+		fmt.Fprintf(&buf, "  %s\n", file)
+	}
+	fmt.Fprintf(&buf, "---\n\n")
+	return buf.String()
 }
 
 func RunGitPatch(cmd *cobra.Command, args []string) {
-	panic("not implemented")
+	log.Debugf("dirs: %v. rdirs: %v", searchDirs,
+		recursiveSearchDirs)
+
+	if _, err := patchFiles(platform.MetricsProviderConfig{
+		Inplace:       true,
+		MetricsPrefix: metricsPrefix,
+		Provider:      provider,
+		DryRun:        true,
+	}, nil, false); err != nil {
+		log.Fatal(err)
+	}
+
+	diffs := modifiedFilesDiff(gitTopLevel())
+	if len(diffs) == 0 {
+		log.Infof("no change to patch")
+		return
+	}
+	files := []string{}
+	for file := range diffs {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	var buf bytes.Buffer
+	if patchFormat == "mbox" {
+		buf.WriteString(mboxHeader(files))
+	}
+	for _, file := range files {
+		buf.WriteString(diffs[file])
+	}
+	if patchFormat == "mbox" {
+		buf.WriteString("-- \nmetrics-gen\n\n")
+	}
+	log.Warnf("go.mod is not updated by the patch, " +
+		"run \"go mod tidy\" after applying it")
+
+	if patchOutput == "" {
+		if _, err := os.Stdout.Write(buf.Bytes()); err != nil {
+			log.Fatalf("error writing patch: %v", err)
+		}
+		return
+	}
+	log.Infof("writing patch to %s", patchOutput)
+	if err := os.WriteFile(patchOutput, buf.Bytes(), 0o644); err != nil {
+		log.Fatalf("error writing patch: %v", err)
+	}
 }
@@ -0,0 +1,127 @@
+/*
+Copyright © 2023 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/platform"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/platform/common"
+)
+
+var lintFormat string // "text" or "json"
+
+// lintCmd represents the lint command
+var lintCmd = &cobra.Command{
+	Use:   "lint",
+	Short: "Check the trace directives",
+	Long: `This command will check every trace directive against the directives and
+parameters supported by the provider. Unknown directives, misplaced directives,
+missing or invalid parameters are reported as errors, unknown and deprecated
+parameters as warnings. Generated identifiers declared twice in a package and
+metrics of a module sharing a name with another kind or other labels are
+reported as errors too. The diagnostics are printed as "file:line:col" lines
+or as JSON, and the command exits with a non-zero status if there are errors.
+	`,
+	PreRun: PreRunLint,
+	Run:    RunLint,
+}
+
+func init() {
+	rootCmd.AddCommand(lintCmd)
+
+	lintCmd.Flags().StringVarP(&lintFormat, "format", "f", "text",
+		"output format, supports \"text\" & \"json\"")
+	// provider choices
+	lintCmd.Flags().StringVarP(&provider, "provider", "p", "prometheus",
+		"metrics provider to use, supports \"gometrics\" & \"prometheus\"")
+}
+
+func PreRunLint(cmd *cobra.Command, args []string) {
+	// run root pre-run
+	rootCmd.PreRun(cmd, args)
+
+	if lintFormat != "text" && lintFormat != "json" {
+		log.Fatalf("invalid output format %s", lintFormat)
+	}
+}
+
+func RunLint(cmd *cobra.Command, args []string) {
+	log.Debugf("dirs: %v. rdirs: %v", searchDirs,
+		recursiveSearchDirs)
+
+	info = parse.NewCollectInfo()
+	if err := addAllDirs(nil); err != nil {
+		log.Fatal(err)
+	}
+
+	var p platform.MetricsProvider
+	if p = common.MetricsProviderFactory(platform.MetricsProviderConfig{
+		Provider: provider,
+		DryRun:   true,
+	}); p == nil {
+		log.Fatalf("invalid provider %s", provider)
+	}
+
+	diags := []platform.Diagnostic{}
+	files := []string{}
+	for _, filename := range info.Files() {
+		// directives are checked without the generated code, files are not written
+		if info.HasGenerated(filename) {
+			if err := info.RemoveGenerated(filename); err != nil {
+				diags = append(diags, platform.Diagnostic{
+					Filename: filename,
+					Severity: platform.SeverityError,
+					Message:  strings.TrimPrefix(err.Error(), filename+": "),
+				})
+				continue
+			}
+		}
+		files = append(files, filename)
+	}
+	diags = append(diags, platform.LintDirectives(info, p.Schema(), provider,
+		files)...)
+	if namer, ok := p.(platform.Namer); ok {
+		diags = append(diags, platform.LintGeneratedNames(info, namer)...)
+	}
+	if !info.HasDefinitionDirective() {
+		diags = append(diags, platform.Diagnostic{
+			Severity: platform.SeverityError,
+			Message:  "no definition directive found",
+		})
+	}
+	for _, goMod := range info.GoModPaths() {
+		if info.HasDefinitionDirective() &&
+			info.ModuleDefinitionDirective(goMod) == nil {
+			diags = append(diags, platform.Diagnostic{
+				Filename: goMod,
+				Severity: platform.SeverityError,
+				Message:  "no definition directive found in the module",
+			})
+		}
+	}
+
+	if lintFormat == "json" {
+		data, err := json.MarshalIndent(diags, "", "  ")
+		if err != nil {
+			log.Fatalf("error encoding diagnostics: %v", err)
+		}
+		fmt.Fprintln(os.Stdout, string(data))
+	} else {
+		for _, diag := range diags {
+			fmt.Fprintln(os.Stdout, diag.String())
+		}
+	}
+
+	if platform.HasLintErrors(diags) {
+		log.Fatalf("%d problems found", len(diags))
+	}
+	log.Infof("%d problems found", len(diags))
+}
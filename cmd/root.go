@@ -4,11 +4,17 @@ Copyright © 2023 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 
+	"github.com/dave/dst/decorator"
 	"github.com/spf13/cobra"
 	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/platform"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/platform/common"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -63,6 +69,132 @@ func init() {
 		false, "dry run") // dry run flag
 }
 
+func addAllDirs(needIgnore func(filename string) bool) error {
+	if info == nil {
+		return fmt.Errorf("info is nil")
+	}
+	for _, dir := range searchDirs {
+		err := info.AddTraceDir(dir, false, needIgnore)
+		if err != nil {
+			return fmt.Errorf("error adding dir %s: %v", dir, err)
+		}
+	}
+	for _, dir := range recursiveSearchDirs {
+		// accept go style package patterns such as ./...
+		dir = strings.TrimSuffix(dir, "/...")
+		if dir == "..." {
+			dir = "."
+		}
+		err := info.AddTraceDir(dir, true, needIgnore)
+		if err != nil {
+			return fmt.Errorf("error adding dir %s: %v", dir, err)
+		}
+	}
+	return nil
+}
+
+// patchFiles collects the directives and runs the pre-patch and patch steps
+// of the provider. The files are only patched in memory, the caller runs the
+// post-patch step of the returned provider to store them. With regenerate,
+// the code of files that look up to date is generated again too.
+func patchFiles(cfg platform.MetricsProviderConfig,
+	needIgnore func(filename string) bool, regenerate bool,
+) (platform.MetricsProvider, error) {
+	info = parse.NewCollectInfo()
+	if err := addAllDirs(needIgnore); err != nil {
+		return nil, err
+	}
+
+	// fail if no definition directive found anywhere in the files
+	if !info.HasDefinitionDirective() {
+		return nil, fmt.Errorf("no definition directive found")
+	}
+	for _, goMod := range info.GoModPaths() {
+		if info.ModuleDefinitionDirective(goMod) == nil {
+			return nil, fmt.Errorf("no definition directive found in module %s",
+				goMod)
+		}
+	}
+
+	// regenerate only the code generated from changed directives, the
+	// definition directive of each module is part of the uuids of its files
+	info.SetGeneratorKey(fmt.Sprintf("%s/%s", cfg.Provider, cfg.MetricsPrefix))
+	if err := info.PrepareRegenerate(regenerate); err != nil {
+		return nil, fmt.Errorf("error checking generated code: %v", err)
+	}
+
+	// select provider
+	var p platform.MetricsProvider
+	if p = common.MetricsProviderFactory(cfg); p == nil {
+		return nil, fmt.Errorf("invalid provider %s", cfg.Provider)
+	}
+
+	// report directive mistakes with their position before patching
+	files := []string{}
+	for _, filename := range info.Files() {
+		if !info.IsUpToDate(filename) {
+			files = append(files, filename)
+		}
+	}
+	diags := platform.LintDirectives(info, p.Schema(), cfg.Provider, files)
+	if namer, ok := p.(platform.Namer); ok {
+		diags = append(diags, platform.LintGeneratedNames(info, namer)...)
+	}
+	logDiagnostics(diags)
+	if platform.HasLintErrors(diags) {
+		return nil, fmt.Errorf("invalid directives found, run \"metrics-gen " +
+			"lint\" for details")
+	}
+
+	if err := p.PrePatch(info); err != nil {
+		return nil, fmt.Errorf("error pre patch: %v", err)
+	}
+
+	if err := p.Patch(info); err != nil {
+		return nil, fmt.Errorf("error patching: %v", err)
+	}
+	return p, nil
+}
+
+// logDiagnostics logs directive diagnostics at their severity
+func logDiagnostics(diags []platform.Diagnostic) {
+	for _, diag := range diags {
+		if diag.Severity == platform.SeverityError {
+			log.Error(diag.String())
+		} else {
+			log.Warn(diag.String())
+		}
+	}
+}
+
+// renderFile returns the current content of a file in memory
+func renderFile(filename string) []byte {
+	var buf bytes.Buffer
+	if err := decorator.Fprint(&buf, info.FileDst(filename)); err != nil {
+		log.Fatalf("error printing %s: %v", filename, err)
+	}
+	return buf.Bytes()
+}
+
+// storeFiles writes all the modified files back to their original location
+func storeFiles() {
+	for _, filename := range info.Files() {
+		if !info.IsModified(filename) {
+			continue
+		}
+
+		data := renderFile(filename)
+		log.Infof("writing to %s", filename)
+		if dryRun {
+			continue
+		}
+
+		if err := os.WriteFile(filename, data, 0o644); err != nil {
+			log.Fatalf("error writing %s: %v", filename, err)
+		}
+	}
+}
+
 func RunRoot(cmd *cobra.Command, args []string) {
 	// just print help and exit
 	cmd.Help()
@@ -1,17 +1,20 @@
 module github.com/wilsonwang371/metrics-gen/metrics-gen
 
-go 1.20
+go 1.25.0
 
-require github.com/spf13/cobra v1.8.0
+require (
+	github.com/google/uuid v1.4.0
+	github.com/spf13/cobra v1.8.0
+	golang.org/x/tools v0.44.0
+)
 
 require (
-	github.com/google/uuid v1.4.0 // indirect
 	github.com/hashicorp/go-immutable-radix v1.0.0 // indirect
 	github.com/hashicorp/go-metrics v0.5.1 // indirect
 	github.com/hashicorp/golang-lru v0.5.0 // indirect
-	golang.org/x/mod v0.6.0-dev.0.20220419223038-86c51ed26bb4 // indirect
-	golang.org/x/sys v0.0.0-20220722155257-8c9f86f7a55f // indirect
-	golang.org/x/tools v0.1.12 // indirect
+	golang.org/x/mod v0.35.0 // indirect
+	golang.org/x/sync v0.20.0 // indirect
+	golang.org/x/sys v0.43.0 // indirect
 )
 
 require (
@@ -0,0 +1,879 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/utils"
+)
+
+// metrics-gen binary built for the tests
+var binPath string
+
+// modules required by the generated code of each provider
+var providerModules = map[string][]string{
+	"prometheus": {
+		"github.com/prometheus/client_golang@v1.18.0",
+		"github.com/wilsonwang371/globalvar@v0.0.0-20231130040525-90d0a98245b7",
+	},
+	"gometrics": {
+		"github.com/hashicorp/go-metrics@v0.7.0",
+	},
+}
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "metrics-gen-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	binPath = filepath.Join(dir, "metrics-gen")
+	if out, err := exec.Command("go", "build", "-o", binPath, ".").
+		CombinedOutput(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to build metrics-gen: %v\n%s", err, out)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// copyDir copies the regular files of a directory tree
+func copyDir(t *testing.T, src string, dst string) {
+	t.Helper()
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0o755)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, rel), data, 0o644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTree returns the content of the go files of a directory tree by their
+// relative path
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	res := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || filepath.Ext(path) != ".go" {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		res[rel] = string(data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// run runs a command in dir and returns its output
+func run(dir string, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// isOffline checks if a go command failed to download modules
+func isOffline(out string) bool {
+	for _, msg := range []string{
+		"dial tcp", "lookup disabled", "no such host", "GOPROXY=off",
+		"failed to go get", "missing go.sum entry", "unrecognized import path",
+		"403 Forbidden",
+	} {
+		if strings.Contains(out, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// skipIfOffline skips the test if a go command failed to download modules
+func skipIfOffline(t *testing.T, out string) {
+	t.Helper()
+	if isOffline(out) {
+		t.Skipf("modules can not be downloaded:\n%s", out)
+	}
+}
+
+// requireModules adds the modules needed by the generated code of a provider
+// to the go.mod of dir so that the versions do not depend on the proxy
+func requireModules(t *testing.T, dir string, provider string) {
+	t.Helper()
+	for _, mod := range providerModules[provider] {
+		if out, err := run(dir, "go", "mod", "edit", "-require="+mod); err != nil {
+			t.Fatalf("go mod edit: %v\n%s", err, out)
+		}
+	}
+}
+
+// generate runs metrics-gen generate in place on dir and builds the result
+func generate(t *testing.T, dir string, provider string) {
+	t.Helper()
+	requireModules(t, dir, provider)
+	out, err := run(dir, binPath, "generate", "-i", "-r", ".", "-p", provider)
+	if err != nil {
+		skipIfOffline(t, out)
+		t.Fatalf("generate: %v\n%s", err, out)
+	}
+	if out, err := run(dir, "go", "build", "-o", os.DevNull, "./..."); err != nil {
+		skipIfOffline(t, out)
+		t.Fatalf("go build: %v\n%s", err, out)
+	}
+}
+
+// writeModule writes the go files of a main package to a new module
+func writeModule(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	files["go.mod"] = "module example.com/test\n\ngo 1.20\n"
+	for name, data := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// the region example of the README, twice with the same name
+const regionSource = `package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// +trace:define
+var x = 1
+
+type Request struct{ body string }
+
+func decode(req *Request) (string, error) {
+	if req.body == "" {
+		return "", errors.New("empty body")
+	}
+	return req.body, nil
+}
+
+func process(body string) error {
+	fmt.Println(body)
+	return nil
+}
+
+func handle(req *Request) error {
+	// +trace:region-begin name=decode
+	body, err := decode(req)
+	if err != nil {
+		return err
+	}
+	// +trace:region-end name=decode
+	return process(body)
+}
+
+func handleAgain(req *Request) error {
+	// +trace:region-begin name=decode
+	body, err := decode(req)
+	if err != nil {
+		return err
+	}
+	// +trace:region-end name=decode
+	return process(body)
+}
+
+func main() {
+	handle(&Request{body: "a"})
+	handleAgain(&Request{})
+}
+`
+
+// lock-wait directives with the same name in two methods
+const lockWaitSource = `package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// +trace:define
+var x = 1
+
+type Cache struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func (c *Cache) Get(k string) string {
+	// +trace:lock-wait name=cache_mu
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.m[k]
+}
+
+func (c *Cache) Set(k, v string) {
+	// +trace:lock-wait name=cache_mu
+	c.mu.Lock()
+	c.m[k] = v
+	c.mu.Unlock()
+}
+
+func main() {
+	c := &Cache{m: map[string]string{}}
+	c.Set("a", "b")
+	fmt.Println(c.Get("a"))
+}
+`
+
+// go-spawn directives with the same name in two files
+const goSpawnSource = `package main
+
+import "sync"
+
+// +trace:define
+var x = 1
+
+func work(wg *sync.WaitGroup) {
+	defer wg.Done()
+}
+
+func a(wg *sync.WaitGroup) {
+	wg.Add(1)
+	// +trace:go-spawn name=workers
+	go work(wg)
+}
+
+func main() {
+	var wg sync.WaitGroup
+	a(&wg)
+	b(&wg)
+	wg.Wait()
+}
+`
+
+const goSpawnOtherSource = `package main
+
+import "sync"
+
+func b(wg *sync.WaitGroup) {
+	wg.Add(1)
+	// +trace:go-spawn name=workers
+	go func() {
+		defer wg.Done()
+	}()
+}
+`
+
+// func-in-flight directives with the same name in two files
+const inFlightSource = `package main
+
+// +trace:define
+var x = 1
+
+// +trace:func-in-flight name=busy
+func a() {}
+
+// +trace:func-in-flight name=busy
+func b() {}
+
+func main() {
+	a()
+	b()
+	c()
+}
+`
+
+const inFlightOtherSource = `package main
+
+// +trace:func-in-flight name=busy
+func c() {}
+`
+
+// cooldown and slow call checks with labels reading variables named like the
+// generated ones
+const cooldownSource = `package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// +trace:define
+var x = 1
+
+var now = "now"
+
+// +trace:func-exec-time cooldown=10ms labels=at:now slow-threshold=1ms
+func f() {
+	last := 3
+	fmt.Println(last)
+	time.Sleep(2 * time.Millisecond)
+}
+
+func main() {
+	f()
+}
+`
+
+// a slow call check next to labels evaluated when the function is entered
+const slowSource = `package main
+
+import "time"
+
+// +trace:define
+var x = 1
+
+// +trace:func-exec-time slow-threshold=1ms labels=n:n
+func work(n int) {
+	n++
+	time.Sleep(2 * time.Millisecond)
+}
+
+func main() {
+	work(1)
+}
+`
+
+// the slow call check runs in the deferred function measuring the call and
+// reads the duration it measured
+func TestSlowCallDefer(t *testing.T) {
+	for _, provider := range []string{"gometrics", "prometheus"} {
+		t.Run(provider, func(t *testing.T) {
+			dir := writeModule(t, map[string]string{"main.go": slowSource})
+			want := readTree(t, dir)
+			generate(t, dir, provider)
+			data, err := os.ReadFile(filepath.Join(dir, "main.go"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			generated := string(data)
+			start := strings.Index(generated, "func work(n int) {")
+			end := strings.Index(generated[start:], "\n}\n")
+			if start == -1 || end == -1 {
+				t.Fatalf("function work not found:\n%s", generated)
+			}
+			body := generated[start : start+end]
+			for text, count := range map[string]int{
+				"defer ":                      1,
+				"}(time.Now()":                1,
+				"time.Since(t)":               1,
+				"fmt.Sprint(n)":               1,
+				"if d > 1*time.Millisecond {": 1,
+			} {
+				if got := strings.Count(body, text); got != count {
+					t.Errorf("%q found %d times, want %d:\n%s", text, got,
+						count, body)
+				}
+			}
+			// the label values are passed with the start time
+			if !strings.Contains(body, "}(time.Now(), []") {
+				t.Errorf("labels not evaluated when work is entered:\n%s", body)
+			}
+			clean(t, dir)
+			compareTrees(t, want, readTree(t, dir))
+		})
+	}
+}
+
+// layouts that printing the file again would change: one-line bodies, empty
+// lines before directives and code around the rewritten go statements and
+// results
+const layoutSource = `package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// +trace:define
+var x = 1
+
+type Box[T any] struct{ v T }
+
+// +trace:func-exec-time
+func (b *Box[T]) Get() T { return b.v }
+
+// +trace:func-exec-time
+func labeled(n int) {
+}
+
+// +trace:func-exec-time
+func empty() {}
+
+// doc before
+// +trace:func-error-count
+// doc after
+func fails(n int) (int, error) {
+	if n > 0 {
+		return 0, errors.New("bad")
+	}
+	return n, nil
+}
+
+// +trace:func-error-count
+func failsBlank() (n int, _ error) {
+	return 1, nil
+}
+
+// results named like generated ones are kept by clean
+func userNamed() (metrics_gen_n int, _ error) {
+	return 1, nil
+}
+
+// +trace:func-in-flight
+// +trace:func-panic-count
+func busy() {
+	time.Sleep(time.Millisecond)
+}
+
+type Cache struct {
+	mu sync.Mutex
+	m  map[string]string
+}
+
+func (c *Cache) Get(k string) string {
+	// +trace:lock-wait name=cache_mu
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.m[k]
+}
+
+func (c *Cache) Set(k, v string) {
+	x := 1
+
+	// +trace:lock-wait name=cache_mu
+	c.mu.Lock()
+	c.m[k] = v
+	c.mu.Unlock()
+	_ = x
+}
+
+func work(wg *sync.WaitGroup, n int, rest ...int) {
+	defer wg.Done()
+}
+
+func spawn(wg *sync.WaitGroup) {
+	wg.Add(3)
+	// +trace:go-spawn name=workers
+	go work(wg, 1, []int{2}...)
+	n := 3
+
+	// +trace:go-spawn name=workers
+	go work(wg, n)
+	// +trace:go-spawn name=others
+	go func() { wg.Done() }()
+}
+
+func handle(s string) error {
+	// +trace:region-begin name=decode
+	body, err := decode(s)
+	if err != nil {
+		return err
+	}
+	// +trace:region-end name=decode
+
+	fmt.Println(body)
+	switch body {
+	case "a":
+		// +trace:inner-exec-time name=case_a
+		fmt.Println("a")
+	default:
+		// +trace:inner-exec-time name=dflt
+		fmt.Println("b")
+	}
+	return nil
+}
+
+func decode(s string) (string, error) {
+	if s == "" {
+		return "", errors.New("empty")
+	}
+	return s, nil
+}
+
+func main() {
+	var wg sync.WaitGroup
+	spawn(&wg)
+	wg.Wait()
+	c := &Cache{m: map[string]string{}}
+	c.Set("a", "b")
+	fmt.Println(c.Get("a"), (&Box[int]{}).Get())
+	fails(1)
+	labeled(1)
+	empty()
+	failsBlank()
+	busy()
+	handle("x")
+}
+`
+
+// clean runs metrics-gen clean on dir
+func clean(t *testing.T, dir string) {
+	t.Helper()
+	if out, err := run(dir, binPath, "clean", "-r", "."); err != nil {
+		t.Fatalf("clean: %v\n%s", err, out)
+	}
+}
+
+// compareTrees fails if the go files of two trees are not identical
+func compareTrees(t *testing.T, want map[string]string, got map[string]string) {
+	t.Helper()
+	for name, data := range want {
+		if got[name] != data {
+			t.Errorf("%s changed after generate and clean:\n%s", name,
+				utils.UnifiedDiff(name, []byte(data), []byte(got[name])))
+		}
+	}
+	for name := range got {
+		if _, ok := want[name]; !ok {
+			t.Errorf("unexpected file %s", name)
+		}
+	}
+}
+
+func TestGenerateBuilds(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{"readme region", map[string]string{"main.go": regionSource}},
+		{"shared lock-wait", map[string]string{"main.go": lockWaitSource}},
+		{"cooldown labels", map[string]string{"main.go": cooldownSource}},
+		{"shared go-spawn", map[string]string{
+			"main.go":  goSpawnSource,
+			"other.go": goSpawnOtherSource,
+		}},
+		{"shared func-in-flight", map[string]string{
+			"main.go":  inFlightSource,
+			"other.go": inFlightOtherSource,
+		}},
+		{"layout", map[string]string{"main.go": layoutSource}},
+	}
+	for _, tt := range tests {
+		for _, provider := range []string{"prometheus", "gometrics"} {
+			t.Run(tt.name+"/"+provider, func(t *testing.T) {
+				files := make(map[string]string)
+				for name, src := range tt.files {
+					files[name] = src
+				}
+				dir := writeModule(t, files)
+				want := readTree(t, dir)
+				generate(t, dir, provider)
+				clean(t, dir)
+				compareTrees(t, want, readTree(t, dir))
+			})
+		}
+	}
+}
+
+// the examples are cleaned, then generating and cleaning them again must give
+// the same files byte for byte. The examples use directives only supported by
+// prometheus.
+func TestExamplesRoundTrip(t *testing.T) {
+	tests := []struct {
+		example  string
+		provider string
+	}{
+		{"basic", "prometheus"},
+		{"empty-def", "prometheus"},
+		{"readme-test", "prometheus"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.example+"/"+tt.provider, func(t *testing.T) {
+			dir := t.TempDir()
+			copyDir(t, filepath.Join("examples", tt.example), dir)
+			clean(t, dir)
+			want := readTree(t, dir)
+			generate(t, dir, tt.provider)
+			clean(t, dir)
+			compareTrees(t, want, readTree(t, dir))
+		})
+	}
+}
+
+// check generates the code again even if the uuids of a file are up to date
+func TestCheckHandEdited(t *testing.T) {
+	dir := writeModule(t, map[string]string{"main.go": layoutSource})
+	generate(t, dir, "gometrics")
+	if out, err := run(dir, binPath, "check", "-r", ".", "-p", "gometrics"); err != nil {
+		t.Fatalf("check after generate: %v\n%s", err, out)
+	}
+
+	filename := filepath.Join(dir, "main.go")
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edited := strings.Replace(string(data), "defer gometrics.", "defer  gometrics.", 1)
+	if edited == string(data) {
+		t.Fatal("no generated code to edit")
+	}
+	if err := os.WriteFile(filename, []byte(edited), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := run(dir, binPath, "check", "-r", ".", "-p", "gometrics")
+	if err == nil {
+		t.Fatalf("check passed with generated code edited by hand:\n%s", out)
+	}
+	if !strings.Contains(out, "-\tdefer  gometrics.") {
+		t.Errorf("check did not print the diff of the edited code:\n%s", out)
+	}
+}
+
+// a module nested in another one with its own definition directive
+const nestedSource = `package main
+
+import "time"
+
+// +trace:define slow-logger=slog
+var x = 1
+
+// +trace:func-exec-time slow-threshold=1s
+func work() {
+	time.Sleep(time.Millisecond)
+}
+
+func main() {
+	work()
+}
+`
+
+// every module has its own definition directive and gets the packages of the
+// generated code in its go.mod
+func TestNestedModules(t *testing.T) {
+	dir := writeModule(t, map[string]string{
+		"main.go":        layoutSource,
+		"nested/go.mod":  "module example.com/nested\n\ngo 1.21\n",
+		"nested/main.go": nestedSource,
+	})
+	want := readTree(t, dir)
+	generate(t, dir, "gometrics")
+	data, err := os.ReadFile(filepath.Join(dir, "nested", "go.mod"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "github.com/hashicorp/go-metrics") {
+		t.Errorf("go-metrics not added to the nested go.mod:\n%s", data)
+	}
+	if out, err := run(filepath.Join(dir, "nested"), "go", "build", "-o",
+		os.DevNull, "./..."); err != nil {
+		t.Fatalf("go build nested: %v\n%s", err, out)
+	}
+	generated, err := os.ReadFile(filepath.Join(dir, "nested", "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(generated), "slog.Warn(") {
+		t.Errorf("nested module does not use its own slow-logger:\n%s", generated)
+	}
+	clean(t, dir)
+	compareTrees(t, want, readTree(t, dir))
+}
+
+// the overlay directory of build is removed when the patching fails
+func TestBuildCleansOverlayOnError(t *testing.T) {
+	dir := writeModule(t, map[string]string{"main.go": "package main\n\nfunc main() {}\n"})
+	tmpDir := t.TempDir()
+	cmd := exec.Command(binPath, "build", "-r", ".", "-p", "gometrics")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "TMPDIR="+tmpDir)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("build passed without a definition directive:\n%s", out)
+	}
+	if !strings.Contains(string(out), "no definition directive found") {
+		t.Errorf("unexpected build error:\n%s", out)
+	}
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("overlay dir %s left after the failed build", entry.Name())
+	}
+}
+
+// directives whose generated names collide in a package
+const collidingSource = `package main
+
+import "errors"
+
+// +trace:define
+var x = 1
+
+// +trace:func-panic-count name=boom
+func f() {}
+
+// +trace:func-panic-count name=boom
+func g() {}
+
+// +trace:func-in-flight name=calls
+func h() {}
+
+// +trace:func-error-count name=calls
+func fails() error {
+	return errors.New("failed")
+}
+
+func main() {
+	f()
+	g()
+	h()
+	_ = fails()
+}
+`
+
+// lint reports the generated identifiers declared twice and the metrics
+// sharing a name with another kind. Only prometheus declares the counters of
+// the panic-count directives with the name of the metric.
+func TestLintGeneratedNames(t *testing.T) {
+	dir := writeModule(t, map[string]string{"main.go": collidingSource})
+	idents := `main.go:11:1: error: generated identifier "boom" is already ` +
+		`declared for the directive at`
+	metrics := `main.go:17:1: error: metric "calls" is a counter`
+	for _, provider := range []string{"gometrics", "prometheus"} {
+		out, err := run(dir, binPath, "lint", "-r", ".", "-p", provider)
+		if err == nil {
+			t.Fatalf("%s: lint passed with colliding names:\n%s", provider, out)
+		}
+		if !strings.Contains(out, metrics) {
+			t.Errorf("%s: %q not reported:\n%s", provider, metrics, out)
+		}
+		if got := strings.Contains(out, idents); got != (provider == "prometheus") {
+			t.Errorf("%s: identifier collision reported %v:\n%s", provider, got, out)
+		}
+	}
+
+	// the in-flight gauges with the same name are shared
+	dir = writeModule(t, map[string]string{
+		"main.go":  inFlightSource,
+		"other.go": inFlightOtherSource,
+	})
+	for _, provider := range []string{"gometrics", "prometheus"} {
+		if out, err := run(dir, binPath, "lint", "-r", ".", "-p", provider); err != nil {
+			t.Errorf("%s: lint failed with shared in-flight gauges: %v\n%s",
+				provider, err, out)
+		}
+	}
+}
+
+// a file that does not parse is reported with its position
+func TestBrokenFile(t *testing.T) {
+	for name, src := range map[string]string{
+		"comment only": "// TODO\n",
+		"syntax error": "package main\n\nfunc f( {\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := writeModule(t, map[string]string{
+				"main.go": "package main\n\n// +trace:define\nvar x = 1\n\n" +
+					"func main() {}\n",
+				"todo.go": src,
+			})
+			for _, args := range [][]string{{"lint"}, {"generate", "-i"}} {
+				cmd := args[0]
+				out, err := run(dir, binPath, append(args, "-r", ".", "-p",
+					"gometrics")...)
+				if err == nil {
+					t.Fatalf("%s passed with a broken file:\n%s", cmd, out)
+				}
+				if strings.Contains(out, "panic:") ||
+					!strings.Contains(out, filepath.Join(dir, "todo.go")+":") {
+					t.Errorf("%s did not report the position of the error:\n%s",
+						cmd, out)
+				}
+			}
+		})
+	}
+}
+
+// two channels sharing the gauges of a chan-depth name
+const chanDepthSource = `package main
+
+// +trace:define
+var x = 1
+
+// +trace:chan-depth name=queue
+var a = make(chan int, 2)
+
+// +trace:chan-depth name=queue
+var b = make(chan int, 8)
+
+func main() {
+	a <- 1
+	b <- 1
+}
+`
+
+// the gauges of chan-depth are registered once the registry is published, in
+// the block between the directive and the channel like the other directives
+func TestChanDepthRegister(t *testing.T) {
+	dir := writeModule(t, map[string]string{"main.go": chanDepthSource})
+	want := readTree(t, dir)
+	requireModules(t, dir, "prometheus")
+	// the files are patched before the modules are downloaded
+	out, err := run(dir, binPath, "generate", "-i", "-r", ".", "-p", "prometheus")
+	if err != nil && !strings.Contains(out, "failed to go get") {
+		t.Fatalf("generate: %v\n%s", err, out)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "main.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := string(data)
+	for _, want := range []string{
+		"// +trace:chan-depth name=queue\n// +trace:begin-generated",
+		"// +trace:end-generated uuid=",
+		"if err := reg.(*prometheus.Registry).Register(c); err != nil {\n" +
+			"\t\t\t\tif _, ok := err.(prometheus.AlreadyRegisteredError); !ok {",
+		"\tif reg, err := globalvar.Get(\"metrics_gen\"); err == nil {\n\t\tregister(reg)\n",
+		"globalvar.Set(\"metrics_gen_pending\", append(registers, register))",
+		"for _, register := range pending.([]func(interface{})) {\n\t\t\tregister(reg)",
+	} {
+		if !strings.Contains(src, want) {
+			t.Errorf("%q not generated:\n%s", want, src)
+		}
+	}
+	if strings.Contains(src, "MustRegister") || strings.Contains(src, "time.Sleep") {
+		t.Errorf("chan-depth gauges registered by polling:\n%s", src)
+	}
+	if n := strings.Count(src, "go func"); n != 1 {
+		t.Errorf("got %d goroutines, want only the one of the http server:\n%s",
+			n, src)
+	}
+	if out, err := run(dir, "go", "build", "-o", os.DevNull, "./..."); err != nil {
+		if !isOffline(out) {
+			t.Fatalf("go build: %v\n%s", err, out)
+		}
+		t.Log("modules can not be downloaded, the generated code is not built")
+	}
+	clean(t, dir)
+	compareTrees(t, want, readTree(t, dir))
+}
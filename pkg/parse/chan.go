@@ -0,0 +1,63 @@
+package parse
+
+import (
+	"fmt"
+	"go/token"
+	"go/types"
+
+	"github.com/dave/dst"
+	log "github.com/sirupsen/logrus"
+)
+
+// ChanVarName returns the name of the package level channel variable declared
+// by the declaration of a chan-depth directive
+func (t *CollectInfo) ChanVarName(d Directive) (string, error) {
+	genDecl, ok := d.declaration.(*dst.GenDecl)
+	if !ok || genDecl.Tok != token.VAR || d.stmt != nil {
+		return "", fmt.Errorf("chan-depth must be placed before a package " +
+			"level var declaration")
+	}
+	names := []*dst.Ident{}
+	for _, spec := range genDecl.Specs {
+		names = append(names, spec.(*dst.ValueSpec).Names...)
+	}
+	if len(names) != 1 || names[0].Name == "_" {
+		return "", fmt.Errorf("chan-depth must be placed before the " +
+			"declaration of a single named variable")
+	}
+	if typ := t.TypeOf(d.filename, names[0]); typ != nil {
+		if _, ok := typ.Underlying().(*types.Chan); !ok {
+			return "", fmt.Errorf("variable %s is not a channel", names[0].Name)
+		}
+	}
+	return names[0].Name, nil
+}
+
+// SetChanDepthTracing adds the declarations that report the length and the
+// capacity of the channel of a chan-depth directive. They are inserted between
+// the directive and the declaration of the channel.
+func (t *CollectInfo) SetChanDepthTracing(d Directive,
+	globalDecl []dst.Decl,
+	pkgsIn map[string]*PackageInfo,
+	pkgPatchTable []*dst.Ident,
+) error {
+	// deep copy pkgs
+	pkgs := make(map[string]*PackageInfo)
+	for k, v := range pkgsIn {
+		pkgs[k] = &PackageInfo{
+			Name: v.Name,
+			Path: v.Path,
+		}
+	}
+
+	if _, err := t.ChanVarName(d); err != nil {
+		return err
+	}
+	log.Debugf("add chan-depth tracing in %s", d.filename)
+
+	// add import
+	if err := t.addPkgImports(d.filename, pkgs, pkgPatchTable); err != nil {
+		return err
+	}
+	return t.insertDeclsAfterDirective(d, globalDecl)
+}
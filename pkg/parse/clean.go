@@ -0,0 +1,281 @@
+package parse
+
+import (
+	"fmt"
+	"go/token"
+	"strings"
+
+	"github.com/dave/dst"
+	log "github.com/sirupsen/logrus"
+)
+
+// HasGenerated checks if a file contains any generated code block
+func (t *CollectInfo) HasGenerated(filename string) bool {
+	for _, directive := range t.fileDirectives[filename] {
+		if directive.traceType == GenBegine || directive.traceType == GenEnd {
+			return true
+		}
+	}
+	return false
+}
+
+// RemoveGenerated removes all generated code blocks from a file, restores the
+// comments that were moved around during generation and drops the imports that
+// were only needed by the generated code. The trace directives are kept.
+func (t *CollectInfo) RemoveGenerated(filename string) error {
+	file, ok := t.filesDst[filename]
+	if !ok {
+		return fmt.Errorf("file %s not found", filename)
+	}
+
+	removed, oneLine, err := removeGenerated(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	if removed == 0 {
+		return nil
+	}
+	for _, block := range oneLine {
+		t.oneLineBlocks[block] = true
+	}
+	log.Debugf("removed %d generated nodes from %s", removed, filename)
+
+	// directives have to be read again since generated markers are gone
+	allDirectives, err := t.readFileDirectives(filename)
+	if err != nil {
+		return err
+	}
+	t.fileDirectives[filename] = t.withPackageDirectives(filename, file,
+		allDirectives)
+	t.modifiedFiles[filename] = true
+	return nil
+}
+
+// removeGenerated removes the generated code and imports from a dst.File,
+// restores the renamed results and returns the number of removed nodes and the
+// blocks that were written on a single line before generation
+func removeGenerated(file *dst.File) (int, []*dst.BlockStmt, error) {
+	// the markers of the renamed results are removed with the generated code
+	restored := restoreResultNames(file)
+
+	decls, removed, _, err := stripGeneratedDecls(file.Decls)
+	if err != nil {
+		return 0, nil, err
+	}
+	file.Decls = decls
+	removed += restored
+	// the wrapped calls are restored with the operands kept by generated code
+	removed += restoreSpawns(file)
+
+	// strip generated statements inside every block of the file
+	oneLine := []*dst.BlockStmt{}
+	dst.Inspect(file, func(n dst.Node) bool {
+		if err != nil {
+			return false
+		}
+		var cnt int
+		var joined bool
+		switch node := n.(type) {
+		case *dst.BlockStmt:
+			node.List, cnt, joined, err = stripGeneratedStmts(node.List)
+			if joined {
+				oneLine = append(oneLine, node)
+			}
+		case *dst.CaseClause:
+			node.Body, cnt, _, err = stripGeneratedStmts(node.Body)
+		case *dst.CommClause:
+			node.Body, cnt, _, err = stripGeneratedStmts(node.Body)
+		}
+		removed += cnt
+		return err == nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if removed != 0 {
+		removeUnusedImports(file)
+	}
+	return removed, oneLine, nil
+}
+
+// stripGenerated decides which nodes of a list are generated. A generated
+// block starts at a begin marker in the start decorations of a node and ends
+// at an end marker either in the end decorations of a generated node or in the
+// start decorations of a following node. Original comments and the empty line
+// before them that were moved onto generated nodes are moved back to the next
+// original node. oneLine reports a block that was on a single line.
+func stripGenerated(decs []*dst.NodeDecs) (keep []bool, oneLine bool, err error) {
+	keep = make([]bool, len(decs))
+	inside := false
+	carried := []string{}
+	before := dst.None
+	for idx, dec := range decs {
+		startInside := inside
+		outside := []string{}
+		for _, decor := range dec.Start.All() {
+			traceType, _ := ParseStringDirectiveType(decor)
+			switch {
+			case traceType == GenBegine:
+				if inside {
+					return nil, false, fmt.Errorf("nested begin-generated marker")
+				}
+				inside = true
+				if params, _ := ParseDirectiveParams(decor); params["oneline"] == "true" {
+					oneLine = true
+				}
+			case traceType == GenEnd:
+				if !inside {
+					return nil, false, fmt.Errorf("end-generated marker without begin-generated")
+				}
+				inside = false
+			case !inside:
+				outside = append(outside, decor)
+			}
+		}
+
+		if !inside {
+			// original node
+			dec.Start.Replace(append(carried, outside...)...)
+			if before == dst.EmptyLine {
+				dec.Before = before
+			}
+			carried = []string{}
+			before = dst.None
+			keep[idx] = true
+			continue
+		}
+
+		// generated node, older versions of the generator added a leading empty
+		// line instead of taking the one of the original node
+		if !startInside && len(outside) != 0 && outside[0] == "\n" {
+			outside = outside[1:]
+		}
+		if !startInside && len(carried) == 0 {
+			before = dec.Before
+		}
+		carried = append(carried, outside...)
+		for _, decor := range dec.End.All() {
+			if traceType, _ := ParseStringDirectiveType(decor); traceType == GenEnd {
+				inside = false
+			}
+		}
+	}
+	if inside {
+		return nil, false, fmt.Errorf("begin-generated marker without end-generated")
+	}
+	return keep, oneLine, nil
+}
+
+func stripGeneratedDecls(decls []dst.Decl) ([]dst.Decl, int, bool, error) {
+	decs := make([]*dst.NodeDecs, len(decls))
+	for idx, decl := range decls {
+		decs[idx] = decl.Decorations()
+	}
+	keep, oneLine, err := stripGenerated(decs)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	res := []dst.Decl{}
+	for idx, decl := range decls {
+		if keep[idx] {
+			res = append(res, decl)
+		}
+	}
+	return res, len(decls) - len(res), oneLine, nil
+}
+
+func stripGeneratedStmts(stmts []dst.Stmt) ([]dst.Stmt, int, bool, error) {
+	decs := make([]*dst.NodeDecs, len(stmts))
+	for idx, stmt := range stmts {
+		decs[idx] = stmt.Decorations()
+	}
+	keep, oneLine, err := stripGenerated(decs)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	res := []dst.Stmt{}
+	for idx, stmt := range stmts {
+		if keep[idx] {
+			res = append(res, stmt)
+		}
+	}
+	return res, len(stmts) - len(res), oneLine, nil
+}
+
+// importName returns the name used to refer to an import in the file. It
+// returns an empty string if the name can not be known without loading the
+// package.
+func importName(spec *dst.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	path := strings.Trim(spec.Path.Value, `"`)
+	if !strings.Contains(path, "/") && !strings.Contains(path, ".") {
+		// standard library packages are named after their path
+		return path
+	}
+	return ""
+}
+
+// usedNames returns all the identifiers used in a file outside import specs
+func usedNames(file *dst.File) map[string]bool {
+	res := make(map[string]bool)
+	dst.Inspect(file, func(n dst.Node) bool {
+		switch node := n.(type) {
+		case *dst.ImportSpec:
+			return false
+		case *dst.Ident:
+			// generated code may use qualified names in a single identifier
+			name := strings.TrimPrefix(node.Name, "(*")
+			name = strings.SplitN(name, ".", 2)[0]
+			res[name] = true
+		}
+		return true
+	})
+	return res
+}
+
+// removeUnusedImports removes the imports that are not referenced anymore
+func removeUnusedImports(file *dst.File) {
+	used := usedNames(file)
+	unused := func(spec *dst.ImportSpec) bool {
+		name := importName(spec)
+		if name == "" || name == "_" || name == "." {
+			return false
+		}
+		return !used[name]
+	}
+
+	imports := []*dst.ImportSpec{}
+	for _, spec := range file.Imports {
+		if unused(spec) {
+			log.Debugf("remove unused import %s", spec.Path.Value)
+			continue
+		}
+		imports = append(imports, spec)
+	}
+	file.Imports = imports
+
+	decls := []dst.Decl{}
+	for _, decl := range file.Decls {
+		genDecl, ok := decl.(*dst.GenDecl)
+		if !ok || genDecl.Tok != token.IMPORT {
+			decls = append(decls, decl)
+			continue
+		}
+		specs := []dst.Spec{}
+		for _, spec := range genDecl.Specs {
+			if importSpec, ok := spec.(*dst.ImportSpec); ok && unused(importSpec) {
+				continue
+			}
+			specs = append(specs, spec)
+		}
+		if len(specs) == 0 {
+			continue
+		}
+		genDecl.Specs = specs
+		decls = append(decls, decl)
+	}
+	file.Decls = decls
+}
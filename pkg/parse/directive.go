@@ -2,9 +2,13 @@ package parse
 
 import (
 	"fmt"
+	"go/parser"
+	"go/token"
 	"regexp"
+	"strings"
 
 	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
 	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/utils"
 )
 
@@ -16,15 +20,76 @@ const (
 	FuncExecTime
 	InnerExecTime
 	InnerCounter
+	InnerGauge
+	FuncErrorCount
+	FuncInFlight
+	FuncPanicCount
+	RegionBegin
+	RegionEnd
+	PackageExecTime
+	GoSpawn
+	ChanDepth
+	LockWait
+	InnerObserve
 	Empty
 	GenBegine
 	GenEnd
 	Invalid
 )
 
+// String returns the directive name of a trace type as written after
+// "+trace:"
+func (t TraceType) String() string {
+	switch t {
+	case Define:
+		return "define"
+	case Set:
+		return "set"
+	case FuncExecTime:
+		return "func-exec-time"
+	case InnerExecTime:
+		return "inner-exec-time"
+	case InnerCounter:
+		return "inner-counter"
+	case InnerGauge:
+		return "inner-gauge"
+	case FuncErrorCount:
+		return "func-error-count"
+	case FuncInFlight:
+		return "func-in-flight"
+	case FuncPanicCount:
+		return "func-panic-count"
+	case RegionBegin:
+		return "region-begin"
+	case RegionEnd:
+		return "region-end"
+	case PackageExecTime:
+		return "package-exec-time"
+	case GoSpawn:
+		return "go-spawn"
+	case ChanDepth:
+		return "chan-depth"
+	case LockWait:
+		return "lock-wait"
+	case InnerObserve:
+		return "inner-observe"
+	case Empty:
+		return ""
+	case GenBegine:
+		return "begin-generated"
+	case GenEnd:
+		return "end-generated"
+	default:
+		return "invalid"
+	}
+}
+
 type Directive struct {
 	filename    string
 	declaration dst.Decl
+	stmt        dst.Stmt   // statement the directive is attached to, nil for declarations
+	after       bool       // the directive follows its statement instead of preceding it
+	origin      *Directive // package directive a synthesized directive comes from
 	text        string
 	traceType   TraceType
 	params      map[string]string // map of parameter name to value
@@ -38,6 +103,32 @@ func (d *Directive) Declaration() dst.Decl {
 	return d.declaration
 }
 
+// Stmt returns the statement a directive inside a function body is attached
+// to, or nil if the directive is attached to the declaration
+func (d *Directive) Stmt() dst.Stmt {
+	return d.stmt
+}
+
+// After checks if the directive is written after its statement, which is only
+// the case for a region-end at the end of a block
+func (d *Directive) After() bool {
+	return d.after
+}
+
+// Origin returns the package-exec-time directive a func-exec-time directive was
+// synthesized from, or nil for a directive written in the source
+func (d *Directive) Origin() *Directive {
+	return d.origin
+}
+
+func (d *Directive) Filename() string {
+	return d.filename
+}
+
+func (d *Directive) Text() string {
+	return d.text
+}
+
 func (d *Directive) Param(name string) (string, bool) {
 	res, ok := d.params[name]
 	return res, ok
@@ -62,6 +153,28 @@ func ParseStringDirectiveType(comment string) (TraceType, error) {
 			return InnerExecTime, nil
 		case "inner-counter":
 			return InnerCounter, nil
+		case "inner-gauge":
+			return InnerGauge, nil
+		case "func-error-count":
+			return FuncErrorCount, nil
+		case "func-in-flight":
+			return FuncInFlight, nil
+		case "func-panic-count":
+			return FuncPanicCount, nil
+		case "region-begin":
+			return RegionBegin, nil
+		case "region-end":
+			return RegionEnd, nil
+		case "package-exec-time":
+			return PackageExecTime, nil
+		case "go-spawn":
+			return GoSpawn, nil
+		case "chan-depth":
+			return ChanDepth, nil
+		case "lock-wait":
+			return LockWait, nil
+		case "inner-observe":
+			return InnerObserve, nil
 		case "":
 			return Empty, nil
 		case "begin-generated":
@@ -76,7 +189,111 @@ func ParseStringDirectiveType(comment string) (TraceType, error) {
 	}
 }
 
-// ParseDirectiveType parses arguments from a trace directive comment
+// ParseExpr parses a Go expression written in a directive parameter
+func ParseExpr(text string) (dst.Expr, error) {
+	expr, err := parser.ParseExpr(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", text, err)
+	}
+	node, err := decorator.NewDecorator(token.NewFileSet()).DecorateNode(expr)
+	if err != nil {
+		return nil, err
+	}
+	return node.(dst.Expr), nil
+}
+
+// Label is a metric label whose value is a Go expression
+type Label struct {
+	Name  string
+	Value dst.Expr
+}
+
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// splitList splits a comma separated list, commas inside brackets and string
+// literals do not separate items
+func splitList(text string) []string {
+	res := []string{}
+	depth := 0
+	var quote rune
+	start := 0
+	escaped := false
+	for idx, c := range text {
+		switch {
+		case quote != 0:
+			if escaped {
+				escaped = false
+			} else if c == '\\' && quote != '`' {
+				escaped = true
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '(' || c == '[' || c == '{':
+			depth++
+		case c == ')' || c == ']' || c == '}':
+			depth--
+		case c == ',' && depth == 0:
+			res = append(res, text[start:idx])
+			start = idx + 1
+		}
+	}
+	return append(res, text[start:])
+}
+
+// ParseLabels parses a comma separated list of labels. A label is written as
+// "name:expr", or as the name of a variable whose value is used.
+func ParseLabels(text string) ([]Label, error) {
+	res := []Label{}
+	names := make(map[string]bool)
+	for _, item := range splitList(text) {
+		item = strings.TrimSpace(item)
+		name, exprText := item, item
+		if idx := strings.Index(item, ":"); idx != -1 &&
+			labelNameRegexp.MatchString(strings.TrimSpace(item[:idx])) {
+			name = strings.TrimSpace(item[:idx])
+			exprText = item[idx+1:]
+		} else if !labelNameRegexp.MatchString(item) {
+			return nil, fmt.Errorf("label %q needs a name, use name:expr", item)
+		}
+		if strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("label name %q is reserved", name)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate label %q", name)
+		}
+		names[name] = true
+		expr, err := ParseExpr(exprText)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, Label{Name: name, Value: expr})
+	}
+	return res, nil
+}
+
+// Labels returns the labels of a directive, or nil if it has none. New value
+// expressions are returned by every call.
+func (d *Directive) Labels() ([]Label, error) {
+	text, ok := d.params["labels"]
+	if !ok {
+		return nil, nil
+	}
+	return ParseLabels(text)
+}
+
+// ParseDirectiveName returns the directive name of a trace directive comment
+func ParseDirectiveName(comment string) string {
+	r := regexp.MustCompile(` ?\+ ?trace\:([a-zA-Z_\-0-9]*) ?(.*)`)
+	sub := r.FindStringSubmatch(comment)
+	if len(sub) >= 2 {
+		return sub[1]
+	}
+	return ""
+}
+
+// ParseDirectiveParams parses arguments from a trace directive comment
 func ParseDirectiveParams(comment string) (map[string]string, error) {
 	r := regexp.MustCompile(` ?\+ ?trace\:([a-zA-Z_\-0-9]*) ?(.*)`)
 	sub := r.FindStringSubmatch(comment)
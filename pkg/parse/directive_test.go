@@ -0,0 +1,79 @@
+package parse
+
+import (
+	"bytes"
+	"go/token"
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// exprString prints an expression of a label
+func exprString(t *testing.T, expr dst.Expr) string {
+	t.Helper()
+	file := &dst.File{
+		Name: dst.NewIdent("p"),
+		Decls: []dst.Decl{&dst.GenDecl{
+			Tok: token.VAR,
+			Specs: []dst.Spec{&dst.ValueSpec{
+				Names:  []*dst.Ident{dst.NewIdent("_")},
+				Values: []dst.Expr{expr},
+			}},
+		}},
+	}
+	var buf bytes.Buffer
+	if err := decorator.Fprint(&buf, file); err != nil {
+		t.Fatal(err)
+	}
+	_, res, _ := strings.Cut(buf.String(), "var _ = ")
+	return strings.TrimSpace(res)
+}
+
+func TestParseLabels(t *testing.T) {
+	// name=expr of every label
+	tests := map[string]string{
+		"method":                          "method=method",
+		"code:resp.Code":                  "code=resp.Code",
+		" method , code: resp.Code ":      "method=method code=resp.Code",
+		`key:fmt.Sprint(a, b),kind:"a,b"`: `key=fmt.Sprint(a, b) kind="a,b"`,
+		"part:s[1:2]":                     "part=s[1:2]",
+		`m:map[string]int{"a": 1}["a"]`:   `m=map[string]int{"a": 1}["a"]`,
+	}
+	for text, want := range tests {
+		labels, err := ParseLabels(text)
+		if err != nil {
+			t.Errorf("%q: %v", text, err)
+			continue
+		}
+		got := []string{}
+		for _, label := range labels {
+			got = append(got, label.Name+"="+exprString(t, label.Value))
+		}
+		if strings.Join(got, " ") != want {
+			t.Errorf("%q: got %s, want %s", text, strings.Join(got, " "), want)
+		}
+	}
+}
+
+func TestParseLabelsErrors(t *testing.T) {
+	tests := map[string]string{
+		"m[k]":       `label "m[k]" needs a name, use name:expr`,
+		"s[1:2]":     `label "s[1:2]" needs a name, use name:expr`,
+		"a, f()":     `label "f()" needs a name, use name:expr`,
+		"__name__:x": `label name "__name__" is reserved`,
+		"a,b:x,a:y":  `duplicate label "a"`,
+	}
+	for text, want := range tests {
+		if _, err := ParseLabels(text); err == nil || err.Error() != want {
+			t.Errorf("%q: got error %v, want %q", text, err, want)
+		}
+	}
+
+	// the message of the go parser is kept after the invalid expression
+	_, err := ParseLabels("a:f(")
+	if err == nil || !strings.HasPrefix(err.Error(), `invalid expression "f(": `) {
+		t.Errorf("got error %v for an invalid expression", err)
+	}
+}
@@ -0,0 +1,400 @@
+package parse
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"go/types"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/tools/go/packages"
+
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/utils"
+)
+
+// fileInfo keeps the syntax tree of a file and the package information if it
+// was loaded with go/packages
+type fileInfo struct {
+	pkg       *packages.Package // nil if the file was parsed on its own
+	astFile   *ast.File
+	decorator *decorator.Decorator
+}
+
+// only the root packages are parsed and type checked, without NeedDeps the
+// types of their imports come from export data
+const loadMode = packages.NeedName | packages.NeedFiles | packages.NeedSyntax |
+	packages.NeedTypes | packages.NeedTypesInfo | packages.NeedModule |
+	packages.NeedImports
+
+// syntaxErrors are the files of the loaded packages that could not be parsed.
+// They are reported with their positions instead of parsing the files again.
+type syntaxErrors []packages.Error
+
+func (e syntaxErrors) Error() string {
+	msgs := []string{}
+	for _, pkgErr := range e {
+		msgs = append(msgs, pkgErr.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// moduleRoots returns the directories to load packages from. The directory
+// itself is always a root, nested modules are added when searching
+// recursively because "./..." does not cross module boundaries.
+func moduleRoots(dir string, recursive bool) ([]string, error) {
+	roots := []string{dir}
+	if !recursive {
+		return roots, nil
+	}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == dir {
+			return nil
+		}
+		// directories ignored by the go command
+		name := d.Name()
+		if name == "vendor" || name == "testdata" ||
+			strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+			return filepath.SkipDir
+		}
+		if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+			roots = append(roots, path)
+		}
+		return nil
+	})
+	return roots, err
+}
+
+// loadPackages loads the packages in a directory with go/packages and returns
+// the non-test go files that match the current build constraints
+func (t *CollectInfo) loadPackages(dir string, recursive bool) ([]string, error) {
+	pattern := "."
+	if recursive {
+		pattern = "./..."
+	}
+	cfg := &packages.Config{
+		Mode:  loadMode,
+		Dir:   dir,
+		Fset:  t.fileSet,
+		Tests: false,
+	}
+	pkgs, err := packages.Load(cfg, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	var syntaxErrs syntaxErrors
+	for _, pkg := range pkgs {
+		for _, pkgErr := range pkg.Errors {
+			if pkgErr.Kind == packages.ParseError {
+				syntaxErrs = append(syntaxErrs, pkgErr)
+				continue
+			}
+			// type errors do not prevent patching the files
+			log.Debugf("package %s: %v", pkg.PkgPath, pkgErr)
+		}
+		if len(syntaxErrs) != 0 {
+			continue
+		}
+		goFiles := make(map[string]bool)
+		for _, filename := range pkg.GoFiles {
+			goFiles[filename] = true
+		}
+		for _, astFile := range pkg.Syntax {
+			tf := t.fileSet.File(astFile.Pos())
+			if tf == nil {
+				// no position without a package clause
+				return nil, syntaxErrors(pkg.Errors)
+			}
+			filename := tf.Name()
+			// skip the files generated by cgo
+			if !goFiles[filename] {
+				continue
+			}
+			// keep file names relative to the working directory if possible
+			if rel, err := filepath.Rel(cwd, filename); err == nil &&
+				!strings.HasPrefix(rel, "..") {
+				filename = rel
+			}
+			dec := decorator.NewDecorator(t.fileSet)
+			file, err := dec.DecorateFile(astFile)
+			if err != nil {
+				return nil, err
+			}
+			t.filesDst[filename] = file
+			t.filesPkg[filename] = &fileInfo{
+				pkg:       pkg,
+				astFile:   astFile,
+				decorator: dec,
+			}
+			if pkg.Module != nil && pkg.Module.GoMod != "" {
+				t.fileGoMod[filename] = pkg.Module.GoMod
+			}
+			files = append(files, filename)
+		}
+	}
+	if len(syntaxErrs) != 0 {
+		return nil, syntaxErrs
+	}
+	return files, nil
+}
+
+// addFileDirectives reads the directives of a parsed file
+func (t *CollectInfo) addFileDirectives(filename string) error {
+	allDirectives, err := t.readFileDirectives(filename)
+	if err != nil {
+		return err
+	}
+	t.fileDirectives[filename] = allDirectives
+
+	for _, directive := range allDirectives {
+		// misplaced definitions inside functions are reported by the linter
+		if directive.traceType == Define && directive.stmt == nil {
+			// every module has its own definition
+			goMod := t.fileGoMod[filename]
+			if defFile, ok := t.defFiles[goMod]; ok && defFile != filename {
+				return fmt.Errorf("multiple define files in module %s: %s and %s",
+					goMod, defFile, filename)
+			}
+			t.defFiles[goMod] = filename
+		}
+	}
+	return nil
+}
+
+// findGoMod returns the go.mod of the module that contains a directory, or an
+// empty string if there is none
+func findGoMod(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		goMod := filepath.Join(dir, "go.mod")
+		if _, err := os.Stat(goMod); err == nil {
+			return goMod
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// GoModPaths returns the go.mod files of the modules with directives
+func (t *CollectInfo) GoModPaths() []string {
+	res := []string{}
+	for filename, directives := range t.fileDirectives {
+		if goMod := t.fileGoMod[filename]; goMod != "" && len(directives) != 0 {
+			res = append(res, goMod)
+		}
+	}
+	res = utils.DeduplicateStrings(res)
+	sort.Strings(res)
+	return res
+}
+
+// astNode returns the ast node of a dst node in a file loaded with go/packages
+func (t *CollectInfo) astNode(filename string, node dst.Node) (ast.Node,
+	*packages.Package,
+) {
+	fi, ok := t.filesPkg[filename]
+	if !ok || fi.pkg == nil {
+		return nil, nil
+	}
+	n, ok := fi.decorator.Ast.Nodes[node]
+	if !ok {
+		return nil, nil
+	}
+	return n, fi.pkg
+}
+
+// onOneLine checks if a block is written on a single line in its file, or was
+// before code was generated in it
+func (t *CollectInfo) onOneLine(filename string, block *dst.BlockStmt) bool {
+	if t.oneLineBlocks[block] {
+		return true
+	}
+	fi, ok := t.filesPkg[filename]
+	if !ok {
+		return false
+	}
+	n, ok := fi.decorator.Ast.Nodes[block]
+	if !ok {
+		return false
+	}
+	return t.fileSet.Position(n.Pos()).Line == t.fileSet.Position(n.End()).Line
+}
+
+// PackagePath returns the import path of the package of a file, or an empty
+// string if the file was not loaded with go/packages
+func (t *CollectInfo) PackagePath(filename string) string {
+	if fi, ok := t.filesPkg[filename]; ok && fi.pkg != nil {
+		return fi.pkg.PkgPath
+	}
+	return ""
+}
+
+// PackageName returns the name of the package of a file
+func (t *CollectInfo) PackageName(filename string) string {
+	if fi, ok := t.filesPkg[filename]; ok && fi.pkg != nil && fi.pkg.Name != "" {
+		return fi.pkg.Name
+	}
+	if file, ok := t.filesDst[filename]; ok {
+		return file.Name.Name
+	}
+	return ""
+}
+
+// TypeOf returns the type of an expression from the type checker, or nil if
+// the type is unknown
+func (t *CollectInfo) TypeOf(filename string, expr dst.Expr) types.Type {
+	n, pkg := t.astNode(filename, expr)
+	if n == nil || pkg.TypesInfo == nil {
+		return nil
+	}
+	if e, ok := n.(ast.Expr); ok {
+		return pkg.TypesInfo.TypeOf(e)
+	}
+	return nil
+}
+
+// ReceiverTypeName returns the name of the receiver type of a method without
+// pointer and type parameters, or an empty string for functions
+func (t *CollectInfo) ReceiverTypeName(filename string, funcDecl *dst.FuncDecl) string {
+	if funcDecl.Recv == nil || len(funcDecl.Recv.List) == 0 {
+		return ""
+	}
+
+	// use the type checker if possible
+	if n, pkg := t.astNode(filename, funcDecl.Name); n != nil && pkg.TypesInfo != nil {
+		if fn, ok := pkg.TypesInfo.Defs[n.(*ast.Ident)].(*types.Func); ok {
+			if recv := fn.Type().(*types.Signature).Recv(); recv != nil {
+				recvType := recv.Type()
+				if ptr, ok := recvType.(*types.Pointer); ok {
+					recvType = ptr.Elem()
+				}
+				if named, ok := recvType.(*types.Named); ok {
+					return named.Obj().Name()
+				}
+			}
+		}
+	}
+
+	// fall back to the syntax
+	return recvTypeName(funcDecl)
+}
+
+// recvTypeName returns the name of the receiver type of a method as written in
+// the source, or an empty string for functions
+func recvTypeName(funcDecl *dst.FuncDecl) string {
+	if funcDecl.Recv == nil || len(funcDecl.Recv.List) == 0 {
+		return ""
+	}
+	expr := funcDecl.Recv.List[0].Type
+	for {
+		switch e := expr.(type) {
+		case *dst.StarExpr:
+			expr = e.X
+		case *dst.IndexExpr:
+			expr = e.X
+		case *dst.IndexListExpr:
+			expr = e.X
+		case *dst.ParenExpr:
+			expr = e.X
+		case *dst.Ident:
+			return e.Name
+		default:
+			return ""
+		}
+	}
+}
+
+// importSpecName returns the name of an import in a file. The type checker is
+// used for imports without a name, the last element of the path otherwise.
+func (t *CollectInfo) importSpecName(filename string, spec *dst.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	if n, pkg := t.astNode(filename, spec); n != nil && pkg.TypesInfo != nil {
+		if pkgName, ok := pkg.TypesInfo.Implicits[n].(*types.PkgName); ok {
+			return pkgName.Imported().Name()
+		}
+	}
+	return filepath.Base(strings.Trim(spec.Path.Value, `"`))
+}
+
+// DirectivePosition returns the position of a directive comment in its file.
+// Only the file name is set if the position is unknown.
+func (t *CollectInfo) DirectivePosition(d *Directive) token.Position {
+	if d.origin != nil {
+		// synthesized directives are reported at their package directive
+		return t.DirectivePosition(d.origin)
+	}
+	unknown := token.Position{Filename: d.filename}
+	fi, ok := t.filesPkg[d.filename]
+	if !ok {
+		return unknown
+	}
+	var node dst.Node = d.declaration
+	if d.stmt != nil {
+		node = d.stmt
+	} else if d.declaration == nil {
+		// package directives are written before the package clause
+		node = t.filesDst[d.filename]
+	}
+	n, ok := fi.decorator.Ast.Nodes[node]
+	if !ok {
+		return unknown
+	}
+
+	// the directive is the last matching comment before the node, or the first
+	// one after it
+	pos := token.NoPos
+	for _, group := range fi.astFile.Comments {
+		if d.after {
+			if group.Pos() < n.End() {
+				continue
+			}
+		} else if group.Pos() >= n.Pos() {
+			break
+		}
+		for _, comment := range group.List {
+			if comment.Text != d.text {
+				continue
+			}
+			if d.after {
+				pos = comment.Pos()
+				break
+			}
+			if comment.Pos() < n.Pos() {
+				pos = comment.Pos()
+			}
+		}
+		if d.after && pos.IsValid() {
+			break
+		}
+	}
+	if !pos.IsValid() {
+		return unknown
+	}
+	res := t.fileSet.Position(pos)
+	res.Filename = d.filename
+	return res
+}
@@ -0,0 +1,215 @@
+package parse
+
+import (
+	"fmt"
+
+	"github.com/dave/dst"
+	log "github.com/sirupsen/logrus"
+)
+
+// Lock is a lock-wait directive with the statements that release the mutex
+// locked by its statement
+type Lock struct {
+	Directive *Directive
+	Mutex     dst.Expr
+	Unlocks   []dst.Stmt // unlock statements that follow the lock
+	Deferred  bool       // the unlock is deferred in the block of the lock
+}
+
+// Holds checks if the time the mutex is held can be measured
+func (l *Lock) Holds() bool {
+	return l.Deferred || len(l.Unlocks) != 0
+}
+
+// unlockMethods maps the lock methods of sync.Mutex and sync.RWMutex to the
+// methods that release them
+var unlockMethods = map[string]string{
+	"Lock":  "Unlock",
+	"RLock": "RUnlock",
+}
+
+// LockCall returns the mutex and the method of a statement that calls Lock or
+// RLock, or a nil mutex if the statement is not such a call
+func LockCall(stmt dst.Stmt) (dst.Expr, string) {
+	exprStmt, ok := stmt.(*dst.ExprStmt)
+	if !ok {
+		return nil, ""
+	}
+	mutex, method := methodCall(exprStmt.X)
+	if _, ok := unlockMethods[method]; !ok {
+		return nil, ""
+	}
+	return mutex, method
+}
+
+// methodCall returns the receiver and the name of a method call without
+// arguments
+func methodCall(expr dst.Expr) (dst.Expr, string) {
+	call, ok := expr.(*dst.CallExpr)
+	if !ok || len(call.Args) != 0 {
+		return nil, ""
+	}
+	sel, ok := call.Fun.(*dst.SelectorExpr)
+	if !ok {
+		return nil, ""
+	}
+	return sel.X, sel.Sel.Name
+}
+
+// sameExpr checks if two expressions are written the same way, only the
+// expressions that can select a mutex are compared
+func sameExpr(a, b dst.Expr) bool {
+	switch x := a.(type) {
+	case *dst.Ident:
+		y, ok := b.(*dst.Ident)
+		return ok && x.Name == y.Name && x.Path == y.Path
+	case *dst.SelectorExpr:
+		y, ok := b.(*dst.SelectorExpr)
+		return ok && sameExpr(x.X, y.X) && sameExpr(x.Sel, y.Sel)
+	case *dst.StarExpr:
+		y, ok := b.(*dst.StarExpr)
+		return ok && sameExpr(x.X, y.X)
+	case *dst.ParenExpr:
+		y, ok := b.(*dst.ParenExpr)
+		return ok && sameExpr(x.X, y.X)
+	case *dst.UnaryExpr:
+		y, ok := b.(*dst.UnaryExpr)
+		return ok && x.Op == y.Op && sameExpr(x.X, y.X)
+	case *dst.BasicLit:
+		y, ok := b.(*dst.BasicLit)
+		return ok && x.Kind == y.Kind && x.Value == y.Value
+	case *dst.IndexExpr:
+		y, ok := b.(*dst.IndexExpr)
+		return ok && sameExpr(x.X, y.X) && sameExpr(x.Index, y.Index)
+	}
+	return false
+}
+
+// MatchUnlocks returns the lock of a lock-wait directive. The unlock calls of
+// the same mutex that follow the lock in its block are matched, including the
+// ones in nested blocks, until the mutex is locked again. A deferred unlock in
+// the block of the lock releases the mutex when the function returns.
+func (t *CollectInfo) MatchUnlocks(d Directive) (*Lock, error) {
+	mutex, method := LockCall(d.stmt)
+	if mutex == nil {
+		return nil, fmt.Errorf("lock-wait must be placed before a Lock or " +
+			"RLock call")
+	}
+	body := d.declaration.(*dst.FuncDecl).Body
+	list, idx := findStmt(body, d.stmt)
+	if list == nil {
+		return nil, fmt.Errorf("statement of the directive not found")
+	}
+
+	res := &Lock{Directive: &d, Mutex: mutex}
+	done := false
+	for _, stmt := range (*list)[idx+1:] {
+		if deferStmt, ok := stmt.(*dst.DeferStmt); ok {
+			if m, name := methodCall(deferStmt.Call); m != nil &&
+				name == unlockMethods[method] && sameExpr(m, mutex) {
+				res.Deferred = true
+				break
+			}
+		}
+		dst.Inspect(stmt, func(n dst.Node) bool {
+			if done {
+				return false
+			}
+			switch node := n.(type) {
+			case *dst.FuncLit, *dst.DeferStmt, *dst.GoStmt:
+				// runs at another time
+				return false
+			case *dst.ExprStmt:
+				m, name := methodCall(node.X)
+				if m == nil || !sameExpr(m, mutex) {
+					return true
+				}
+				if _, ok := unlockMethods[name]; ok {
+					done = true
+				} else if name == unlockMethods[method] {
+					if l, _ := findStmt(body, node); l != nil {
+						res.Unlocks = append(res.Unlocks, node)
+					}
+				}
+				return false
+			}
+			return true
+		})
+		if done {
+			break
+		}
+	}
+	return res, nil
+}
+
+// SetLockWaitTracing instruments the lock of a lock-wait directive.
+// beforeStmts are inserted before the lock and afterStmts after it. The
+// statements returned by holdStmts are inserted before every matched unlock, or
+// deferred after the lock if the unlock is deferred. holdStmts returns new
+// statements and their patch table on every call.
+func (t *CollectInfo) SetLockWaitTracing(l *Lock,
+	globalDecl []dst.Decl,
+	beforeStmts []dst.Stmt,
+	afterStmts []dst.Stmt,
+	holdStmts func() ([]dst.Stmt, []*dst.Ident),
+	pkgsIn map[string]*PackageInfo,
+	pkgPatchTable []*dst.Ident,
+) error {
+	// deep copy pkgs
+	pkgs := make(map[string]*PackageInfo)
+	for k, v := range pkgsIn {
+		pkgs[k] = &PackageInfo{
+			Name: v.Name,
+			Path: v.Path,
+		}
+	}
+
+	d := l.Directive
+	body := d.declaration.(*dst.FuncDecl).Body
+	fileUUID := t.FileUUID(d.filename)
+	patchTable := append([]*dst.Ident{}, pkgPatchTable...)
+	for _, unlock := range l.Unlocks {
+		list, idx := findStmt(body, unlock)
+		if list == nil {
+			return fmt.Errorf("unlock statement not found")
+		}
+		stmts, stmtsPatchTable := holdStmts()
+		patchTable = append(patchTable, stmtsPatchTable...)
+		stmts = append([]dst.Stmt{&dst.EmptyStmt{}}, stmts...)
+		markGenerated(stmts, BeginUUID(fileUUID), EndUUID(fileUUID))
+		*list = append((*list)[:idx], append(stmts, (*list)[idx:]...)...)
+	}
+
+	if l.Deferred {
+		// defer func() { ... }()
+		stmts, stmtsPatchTable := holdStmts()
+		patchTable = append(patchTable, stmtsPatchTable...)
+		afterStmts = append(afterStmts, &dst.DeferStmt{
+			Call: &dst.CallExpr{
+				Fun: &dst.FuncLit{
+					Type: &dst.FuncType{},
+					Body: &dst.BlockStmt{List: stmts},
+				},
+			},
+		})
+	}
+	log.Debugf("add lock-wait tracing in %s", d.filename)
+
+	list, idx := findStmt(body, d.stmt)
+	if list == nil {
+		return fmt.Errorf("statement of the directive not found")
+	}
+	if len(afterStmts) != 0 {
+		markGenerated(afterStmts, BeginUUID(fileUUID), EndUUID(fileUUID))
+		*list = append((*list)[:idx+1], append(afterStmts, (*list)[idx+1:]...)...)
+	}
+	if err := t.insertBeforeDirective(*d, list, idx, beforeStmts); err != nil {
+		return err
+	}
+
+	// all the idents are renamed at once if an import name is taken
+	if err := t.addPkgImports(d.filename, pkgs, patchTable); err != nil {
+		return err
+	}
+	return t.insertInnerDecls(d.filename, globalDecl)
+}
@@ -0,0 +1,217 @@
+package parse
+
+import (
+	"fmt"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst"
+	log "github.com/sirupsen/logrus"
+)
+
+// parameters of a package-exec-time directive that select the functions, the
+// other parameters are passed to the synthesized func-exec-time directives
+var packageFilterParams = map[string]bool{
+	"include":       true,
+	"exclude":       true,
+	"exported-only": true,
+}
+
+// readPackageDirectives returns the package-exec-time directives written in the
+// comments before the package clause of a file
+func readPackageDirectives(filename string, file *dst.File) []*Directive {
+	res := []*Directive{}
+	for _, decor := range file.Decs.Start.All() {
+		if d := newDirective(filename, nil, nil, decor); d != nil &&
+			d.traceType == PackageExecTime {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// packageDirectives returns the package-exec-time directives of all the files
+// in the same package as a file, own are the directives of the file itself
+func (t *CollectInfo) packageDirectives(filename string,
+	own []*Directive,
+) []*Directive {
+	res := []*Directive{}
+	for _, other := range t.Files() {
+		directives := t.fileDirectives[other]
+		if other == filename {
+			directives = own
+		} else if filepath.Dir(other) != filepath.Dir(filename) ||
+			t.packageKey(other) != t.packageKey(filename) {
+			continue
+		}
+		for _, directive := range directives {
+			if directive.traceType == PackageExecTime && directive.origin == nil &&
+				directive.declaration == nil {
+				res = append(res, directive)
+			}
+		}
+	}
+	return res
+}
+
+// matchFunc checks if a function is selected by the include, exclude and
+// exported-only parameters of a package directive
+func (t *CollectInfo) matchFunc(d *Directive, filename string,
+	funcDecl *dst.FuncDecl,
+) bool {
+	name := funcDecl.Name.Name
+	for _, key := range []string{"include", "exclude"} {
+		v, ok := d.Param(key)
+		if !ok {
+			continue
+		}
+		re, err := regexp.Compile(v)
+		if err != nil {
+			// invalid expressions are reported by the linter
+			return false
+		}
+		if re.MatchString(name) != (key == "include") {
+			return false
+		}
+	}
+	if v, ok := d.Param("exported-only"); ok && v == "true" {
+		if !token.IsExported(name) {
+			return false
+		}
+		if recv := t.ReceiverTypeName(filename, funcDecl); funcDecl.Recv != nil &&
+			!token.IsExported(recv) {
+			return false
+		}
+	}
+	return true
+}
+
+// isGeneratedDecl returns the declarations of a list that are generated code
+func isGeneratedDecl(decls []dst.Decl) map[dst.Decl]bool {
+	// the decorations are copied since stripGenerated moves comments around
+	decs := make([]*dst.NodeDecs, len(decls))
+	for idx, decl := range decls {
+		decs[idx] = &dst.NodeDecs{
+			Start: append(dst.Decorations{}, decl.Decorations().Start...),
+			End:   append(dst.Decorations{}, decl.Decorations().End...),
+		}
+	}
+	res := make(map[dst.Decl]bool)
+	keep, _, err := stripGenerated(decs)
+	if err != nil {
+		return res
+	}
+	for idx, decl := range decls {
+		res[decl] = !keep[idx]
+	}
+	return res
+}
+
+// packageFuncDirectives synthesizes a func-exec-time directive for every
+// function of a file selected by a package-exec-time directive of its package.
+// Functions with their own func-exec-time directive are left alone, and the
+// first matching package directive is used if several select a function.
+func (t *CollectInfo) packageFuncDirectives(filename string, file *dst.File,
+	own []*Directive,
+) []*Directive {
+	res := []*Directive{}
+	pkgDirectives := t.packageDirectives(filename, own)
+	if len(pkgDirectives) == 0 {
+		return res
+	}
+
+	explicit := make(map[dst.Decl]bool)
+	for _, directive := range own {
+		if directive.traceType == FuncExecTime && directive.stmt == nil {
+			explicit[directive.declaration] = true
+		}
+	}
+	generated := isGeneratedDecl(file.Decls)
+	for _, decl := range file.Decls {
+		funcDecl, ok := decl.(*dst.FuncDecl)
+		if !ok || funcDecl.Body == nil || explicit[decl] || generated[decl] {
+			continue
+		}
+		for _, pkgDirective := range pkgDirectives {
+			if !t.matchFunc(pkgDirective, filename, funcDecl) {
+				continue
+			}
+			log.Debugf("function %s traced by %s", funcDecl.Name.Name,
+				pkgDirective.text)
+			res = append(res, &Directive{
+				filename:    filename,
+				declaration: funcDecl,
+				origin:      pkgDirective,
+				text:        funcDirectiveText(pkgDirective.params),
+				traceType:   FuncExecTime,
+				params:      funcDirectiveParams(pkgDirective.params),
+			})
+			break
+		}
+	}
+	return res
+}
+
+// funcDirectiveParams returns the parameters of a package directive that are
+// passed to the func-exec-time directives. The functions can not share a
+// metric name so a name is dropped.
+func funcDirectiveParams(params map[string]string) map[string]string {
+	res := make(map[string]string)
+	for k, v := range params {
+		if !packageFilterParams[k] && k != "name" {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// funcDirectiveText returns the text of a func-exec-time directive with the
+// parameters of a package directive, in a stable order
+func funcDirectiveText(params map[string]string) string {
+	params = funcDirectiveParams(params)
+	keys := []string{}
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	text := "// +trace:func-exec-time"
+	for _, k := range keys {
+		v := params[k]
+		if v == "" || strings.ContainsAny(v, " \t\"") {
+			v = strconv.Quote(v)
+		}
+		text += fmt.Sprintf(" %s=%s", k, v)
+	}
+	return text
+}
+
+// withPackageDirectives returns the directives of a file followed by the ones
+// synthesized from the package directives
+func (t *CollectInfo) withPackageDirectives(filename string, file *dst.File,
+	own []*Directive,
+) []*Directive {
+	return append(own, t.packageFuncDirectives(filename, file, own)...)
+}
+
+// expandPackageDirectives synthesizes the func-exec-time directives of the
+// package directives in all the files. It has to be called again once files
+// are added since a package directive applies to all the files of its package.
+func (t *CollectInfo) expandPackageDirectives() {
+	for _, filename := range t.Files() {
+		own := []*Directive{}
+		for _, directive := range t.fileDirectives[filename] {
+			if directive.origin == nil {
+				own = append(own, directive)
+			}
+		}
+		t.fileDirectives[filename] = own
+	}
+	for _, filename := range t.Files() {
+		t.fileDirectives[filename] = t.withPackageDirectives(filename,
+			t.filesDst[filename], t.fileDirectives[filename])
+	}
+}
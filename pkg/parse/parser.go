@@ -4,9 +4,10 @@ import (
 	"fmt"
 	"go/parser"
 	"go/token"
-	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/dave/dst"
@@ -23,52 +24,60 @@ type CollectInfo struct {
 	filesDst       map[string]*dst.File    // map of file name to dst.File
 	fileDirectives map[string][]*Directive // map of file name to slice of directives
 	modifiedFiles  map[string]bool         // map of file name to bool
+	filesPkg       map[string]*fileInfo    // map of file name to package info
+	fileGoMod      map[string]string       // map of file name to go.mod path
+	defFiles       map[string]string       // map of go.mod path to the file with the definition directive
 
-	defFileName string // file that contains the definition of the metric global variable
+	genKey   string          // key of the generator, part of generated uuids
+	upToDate map[string]bool // map of file name to bool
 
-	goModPath string
-	genUUID   string
+	oneLineBlocks  map[*dst.BlockStmt]bool // blocks on a single line before generation
+	renamedResults map[*dst.BlockStmt]bool // bodies of functions with renamed results
 }
 
+// namespace of the generated uuids
+var genNamespace = uuid.NewSHA1(uuid.NameSpaceURL,
+	[]byte("github.com/wilsonwang371/metrics-gen"))
+
 // NewCollectInfo creates a new CollectInfo struct
 func NewCollectInfo() *CollectInfo {
-	tmpUUID := uuid.New().String()
 	return &CollectInfo{
 		fileSet:        token.NewFileSet(),
 		filesDst:       make(map[string]*dst.File),
 		fileDirectives: make(map[string][]*Directive),
 		modifiedFiles:  make(map[string]bool),
-		defFileName:    "",
-		goModPath:      "",
-		genUUID:        tmpUUID,
+		filesPkg:       make(map[string]*fileInfo),
+		fileGoMod:      make(map[string]string),
+		defFiles:       make(map[string]string),
+		genKey:         "",
+		upToDate:       make(map[string]bool),
+		oneLineBlocks:  make(map[*dst.BlockStmt]bool),
+		renamedResults: make(map[*dst.BlockStmt]bool),
 	}
 }
 
 // AddTraceFile adds a file to the CollectInfo struct
 func (t *CollectInfo) AddTraceFile(filename string) error {
-	file, err := decorator.ParseFile(t.fileSet, filename, nil,
+	astFile, err := parser.ParseFile(t.fileSet, filename, nil,
 		parser.ParseComments)
 	if err != nil {
 		return err
 	}
-	t.filesDst[filename] = file // add to map
-
-	allDirectives, err := t.readFileDirectives(filename)
+	dec := decorator.NewDecorator(t.fileSet)
+	file, err := dec.DecorateFile(astFile)
 	if err != nil {
 		return err
 	}
-	t.fileDirectives[filename] = allDirectives
-
-	for _, directive := range allDirectives {
-		if directive.traceType == Define {
-			if t.defFileName != "" {
-				return fmt.Errorf("multiple define files")
-			}
-			t.defFileName = filename
-		}
+	t.filesDst[filename] = file // add to map
+	// keep the syntax tree for positions, there is no package information
+	t.filesPkg[filename] = &fileInfo{
+		astFile:   astFile,
+		decorator: dec,
 	}
-
-	return nil
+	if goMod := findGoMod(filepath.Dir(filename)); goMod != "" {
+		t.fileGoMod[filename] = goMod
+	}
+	return t.addFileDirectives(filename)
 }
 
 // AddTraceFiles adds multiple files to the CollectInfo struct
@@ -78,12 +87,59 @@ func (t *CollectInfo) AddTraceFiles(filenames []string) error {
 			return err
 		}
 	}
+	t.expandPackageDirectives()
 	return nil
 }
 
-// AddTraceDir adds all .go files in a directory to the CollectInfo struct
+// AddTraceDir adds all .go files of the packages in a directory to the
+// CollectInfo struct. Packages are loaded with go/packages so build constraints,
+// test files, vendor directories and nested modules are handled like the go
+// command does.
 func (t *CollectInfo) AddTraceDir(dir string, recursive bool,
 	needIgnore func(filename string) bool,
+) error {
+	roots, err := moduleRoots(dir, recursive)
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		files, err := t.loadPackages(root, recursive)
+		if _, ok := err.(syntaxErrors); ok {
+			return err
+		}
+		if err != nil {
+			log.Warnf("failed to load packages in %s, parsing files without "+
+				"type information: %v", root, err)
+		}
+		if err != nil || len(files) == 0 {
+			// not in a module or the go command failed, parse the files directly
+			if err := t.addTraceDirFiles(root, recursive, needIgnore); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, filename := range utils.DeduplicateStrings(files) {
+			if needIgnore != nil && needIgnore(filename) {
+				delete(t.filesDst, filename)
+				delete(t.filesPkg, filename)
+				delete(t.fileGoMod, filename)
+				continue
+			}
+			log.Debugf("add traced file %s", filename)
+			if err := t.addFileDirectives(filename); err != nil {
+				return err
+			}
+		}
+	}
+	t.expandPackageDirectives()
+	return nil
+}
+
+// addTraceDirFiles adds all .go files in a directory to the CollectInfo struct
+// without loading the packages
+func (t *CollectInfo) addTraceDirFiles(dir string, recursive bool,
+	needIgnore func(filename string) bool,
 ) error {
 	// search all .go files
 	files := []string{}
@@ -91,20 +147,18 @@ func (t *CollectInfo) AddTraceDir(dir string, recursive bool,
 		err := filepath.Walk(dir, func(path string, info os.FileInfo,
 			err error,
 		) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() && path != dir {
+				// nested modules are loaded separately
+				if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+					return filepath.SkipDir
+				}
+			}
 			if filepath.Ext(path) == ".go" {
 				// add go files to list
 				files = append(files, path)
-			} else if filepath.Ext(path) == ".mod" {
-				// make sure it is go.mod file
-				name := filepath.Base(path)
-				if name != "go.mod" {
-					return nil
-				}
-				// save go.mod location
-				if t.goModPath != "" {
-					return fmt.Errorf("multiple go.mod files")
-				}
-				t.goModPath = path
 			}
 			return nil
 		})
@@ -117,14 +171,6 @@ func (t *CollectInfo) AddTraceDir(dir string, recursive bool,
 		if err != nil {
 			return err
 		}
-		// check if go.mod exists
-		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
-			// save go.mod location
-			if t.goModPath != "" {
-				return fmt.Errorf("multiple go.mod files")
-			}
-			t.goModPath = filepath.Join(dir, "go.mod")
-		}
 	}
 
 	filteredFiles := []string{}
@@ -132,6 +178,10 @@ func (t *CollectInfo) AddTraceDir(dir string, recursive bool,
 		if needIgnore != nil && needIgnore(filename) {
 			continue
 		}
+		if _, ok := t.filesPkg[filename]; ok {
+			// already loaded with go/packages
+			continue
+		}
 		log.Debugf("add traced file %s", filename)
 		filteredFiles = append(filteredFiles, filename)
 
@@ -141,8 +191,7 @@ func (t *CollectInfo) AddTraceDir(dir string, recursive bool,
 	// reduce same file names in the list
 	filteredFiles = utils.DeduplicateStrings(filteredFiles)
 
-	t.AddTraceFiles(filteredFiles)
-	return nil
+	return t.AddTraceFiles(filteredFiles)
 }
 
 type PackageInfo struct {
@@ -178,14 +227,7 @@ func (t *CollectInfo) hasPkgImport(
 				for _, spec := range genDecl.Specs {
 					if importSpec, ok := spec.(*dst.ImportSpec); ok {
 						// check if the import is already there
-						tmpName := ""
-						if importSpec.Name != nil {
-							tmpName = importSpec.Name.Name
-						}
-						if tmpName == "" {
-							tmp := strings.Trim(importSpec.Path.Value, `"`)
-							tmpName = filepath.Base(tmp)
-						}
+						tmpName := t.importSpecName(filename, importSpec)
 						tmpName2 := importName
 						if tmpName2 == "" {
 							tmpName2 = filepath.Base(pkgUrl)
@@ -272,6 +314,63 @@ func (t *CollectInfo) AddPkgImport(filename string, name string,
 	return nil
 }
 
+// addPkgImports adds the imports of pkgs to a file in a stable order. If an
+// import name is taken, a name derived from the package path is used and the
+// idents in pkgPatchTable are renamed.
+func (t *CollectInfo) addPkgImports(filename string,
+	pkgs map[string]*PackageInfo,
+	pkgPatchTable []*dst.Ident,
+) error {
+	names := []string{}
+	for name := range pkgs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pkgsUpdated := false
+	for _, name := range names {
+		pkg := pkgs[name]
+		// loop until AddPkgImport succeeds
+		for {
+			if err := t.AddPkgImport(filename, pkg.Name, pkg.Path); err != nil {
+				if err.Error() == "change import name" {
+					pkg.Name = fmt.Sprintf("%s_%s", pkg.Name,
+						utils.StableHash(4, pkg.Path))
+					pkgsUpdated = true
+					continue
+				} else if strings.Contains(err.Error(), "use existing import name") {
+					// extract the name from the error message that enclosed by double quotes
+					// e.g. "use existing import name \"prometheus\""
+					// then replace the pkg name with the new name
+					newName := strings.Trim(
+						strings.Split(err.Error(), "\"")[1],
+						"\"")
+					log.Infof("use existing import name \"%s\" for pkg %+v", newName, pkg)
+					pkg.Name = newName
+					pkgsUpdated = true
+					continue
+				} else {
+					return err
+				}
+			}
+			break
+		}
+	}
+
+	if pkgsUpdated {
+		for _, ident := range pkgPatchTable {
+			for _, name := range names {
+				// search if pkg name is a substring of ident name
+				if strings.Contains(ident.Name, name) {
+					// replace the substring with the new name
+					ident.Name = strings.Replace(ident.Name, name, pkgs[name].Name, 1)
+				}
+			}
+		}
+	}
+	return nil
+}
+
 // SetGlobalDefineFunc sets the global define function
 func (t *CollectInfo) SetGlobalDefineFunc(d Directive,
 	addedDecl *dst.FuncDecl,
@@ -287,55 +386,19 @@ func (t *CollectInfo) SetGlobalDefineFunc(d Directive,
 		}
 	}
 
-	for _, decor := range d.declaration.Decorations().Start.All() {
-		if d.text == decor {
-			// add import
-			pkgsUpdated := false
-			for name, pkg := range pkgs {
-				// loop until AddPkgImport succeeds
-				for {
-					if err := t.AddPkgImport(d.filename, pkg.Name, pkg.Path); err != nil {
-						if err.Error() == "change import name" {
-							pkg.Name = fmt.Sprintf("%s_%d", pkg.Name, rand.Intn(100))
-							pkgsUpdated = true
-							continue
-						} else if strings.Contains(err.Error(), "use existing import name") {
-							// extract the name from the error message that enclosed by double quotes
-							// e.g. "use existing import name \"prometheus\""
-							// then replace the pkg name with the new name
-							newName := strings.Trim(
-								strings.Split(err.Error(), "\"")[1],
-								"\"")
-							log.Infof("use existing import name \"%s\" for pkg %+v", newName, pkg)
-							pkgs[name].Name = newName
-							pkgsUpdated = true
-							continue
-						} else {
-							return err
-						}
-					}
-					break
-				}
-			}
-
-			if pkgsUpdated {
-				for _, ident := range pkgPatchTable {
-					for name, pkg := range pkgs {
-						// search if pkg name is a substring of ident name
-						if strings.Contains(ident.Name, name) {
-							// replace the substring with the new name
-							ident.Name = strings.Replace(ident.Name, name, pkg.Name, 1)
-						}
-					}
-				}
-			}
-
-			t.modifiedFiles[d.filename] = true
-			// break 2 loops
-			goto out
-		}
+	// add import
+	if err := t.addPkgImports(d.filename, pkgs, pkgPatchTable); err != nil {
+		return err
 	}
-out:
+	log.Debugf("add global define function for: %s", d.filename)
+	return t.insertDeclsAfterDirective(d, []dst.Decl{addedDecl})
+}
+
+// insertDeclsAfterDirective inserts generated declarations between the comment
+// of a declaration directive and its declaration
+func (t *CollectInfo) insertDeclsAfterDirective(d Directive,
+	globalDecl []dst.Decl,
+) error {
 	directiveIdx := -1
 	file := t.filesDst[d.filename]
 	for idx, decl := range file.Decls {
@@ -344,6 +407,9 @@ out:
 			break
 		}
 	}
+	if directiveIdx == -1 {
+		return fmt.Errorf("declaration not found")
+	}
 	for idx, decor := range d.declaration.Decorations().Start.All() {
 		if d.text == decor {
 			var prevComment, nextComment []string
@@ -356,17 +422,16 @@ out:
 				nextComment,
 				d.declaration.Decorations().Start.All()[idx+1:]...)
 
-			prevComment = append(prevComment, BeginUUID(t.genUUID))
-			nextComment = append([]string{EndUUID(t.genUUID)}, nextComment...)
+			prevComment = append(prevComment, BeginUUID(t.FileUUID(d.filename)))
+			nextComment = append([]string{EndUUID(t.FileUUID(d.filename))}, nextComment...)
 
-			addedDecl.Decorations().Start.Replace(
+			globalDecl[0].Decorations().Start.Replace(
 				append([]string{"\n"}, prevComment...)...)
 			d.declaration.Decorations().Start.Replace(nextComment...)
 
 			// insert code before the declaration index
-			log.Debugf("add global define function for: %s", d.filename)
 			file.Decls = append(file.Decls[:directiveIdx],
-				append([]dst.Decl{addedDecl}, file.Decls[directiveIdx:]...)...)
+				append(globalDecl, file.Decls[directiveIdx:]...)...)
 
 			t.modifiedFiles[d.filename] = true
 			return nil
@@ -395,64 +460,33 @@ func (t *CollectInfo) SetFunctionInnerTracing(d Directive,
 	if !ok {
 		return fmt.Errorf("declaration is not a function")
 	}
-	for _, stmt := range funDecl.Body.List {
-		for _, decor := range stmt.Decorations().Start.All() {
-			if d.text == decor {
-				// add import
-				pkgsUpdated := false
-				for name, pkg := range pkgs {
-					for {
-						if err := t.AddPkgImport(d.filename, pkg.Name, pkg.Path); err != nil {
-							if err.Error() == "change import name" {
-								pkg.Name = fmt.Sprintf("%s_%d", pkg.Name, rand.Intn(100))
-								pkgsUpdated = true
-								continue
-							} else if strings.Contains(err.Error(), "use existing import name") {
-								// extract the name from the error message that enclosed by double quotes
-								// e.g. "use existing import name \"prometheus\""
-								// then replace the pkg name with the new name
-								newName := strings.Trim(
-									strings.Split(err.Error(), "\"")[1],
-									"\"")
-								log.Infof("use existing import name \"%s\" for pkg %+v", newName, pkg)
-								pkgs[name].Name = newName
-								pkgsUpdated = true
-								continue
-							} else {
-								return err
-							}
-						}
-						break
-					}
-				}
-
-				if pkgsUpdated {
-					for _, ident := range pkgPatchTable {
-						for name, pkg := range pkgs {
-							// search if pkg name is a substring of ident name
-							if strings.Contains(ident.Name, name) {
-								// replace the substring with the new name
-								ident.Name = strings.Replace(
-									ident.Name,
-									name,
-									pkg.Name,
-									1,
-								)
-							}
-						}
-					}
-				}
+	if d.stmt == nil || funDecl.Body == nil {
+		return fmt.Errorf("directive is not inside the function body")
+	}
+	list, idx := findStmt(funDecl.Body, d.stmt)
+	if list == nil {
+		return fmt.Errorf("statement of the directive not found")
+	}
 
-				t.modifiedFiles[d.filename] = true
-				// break 2 loops
-				goto out
-			}
-		}
+	// add import
+	if err := t.addPkgImports(d.filename, pkgs, pkgPatchTable); err != nil {
+		return err
 	}
-out:
+
 	// add global statements
+	if err := t.insertInnerDecls(d.filename, globalDecl); err != nil {
+		return err
+	}
+
+	// add local statements
+	return t.insertBeforeDirective(d, list, idx, inFuncStmts)
+}
+
+// insertInnerDecls inserts the global declarations of inner directives before
+// the last function declaration of a file
+func (t *CollectInfo) insertInnerDecls(filename string, globalDecl []dst.Decl) error {
 	directiveIdx := -1
-	file := t.filesDst[d.filename]
+	file := t.filesDst[filename]
 	for idx, decl := range file.Decls {
 		if _, ok := decl.(*dst.FuncDecl); ok {
 			directiveIdx = idx
@@ -461,50 +495,135 @@ out:
 	if directiveIdx == -1 {
 		return fmt.Errorf("declaration not found")
 	}
+	t.insertDeclsAt(filename, directiveIdx, globalDecl)
+	return nil
+}
 
-	// insert code before the function declaration
+// insertDeclsAt inserts generated declarations before the declaration at idx
+func (t *CollectInfo) insertDeclsAt(filename string, directiveIdx int,
+	globalDecl []dst.Decl,
+) {
+	file := t.filesDst[filename]
 	if len(globalDecl) != 0 {
-		globalDecl[0].Decorations().Start.Prepend("\n", BeginUUID(t.genUUID))
-		globalDecl[len(globalDecl)-1].Decorations().End.Append("\n", EndUUID(t.UUID()))
+		// code generated before the declaration must stay above the inserted
+		// code so that its end marker is not moved
+		decs := file.Decls[directiveIdx].Decorations()
+		prevComment, nextComment := splitAfterEndMarker(decs.Start.All())
+		decs.Start.Replace(nextComment...)
+		globalDecl[0].Decorations().Start.Prepend("\n", BeginUUID(t.FileUUID(filename)))
+		if len(prevComment) != 0 {
+			globalDecl[0].Decorations().Start.Prepend(
+				append([]string{"\n"}, prevComment...)...)
+		}
+		globalDecl[len(globalDecl)-1].Decorations().End.Append("\n", EndUUID(t.FileUUID(filename)))
 		file.Decls = append(file.Decls[:directiveIdx],
 			append(globalDecl, file.Decls[directiveIdx:]...)...)
+		t.modifiedFiles[filename] = true
 	}
+}
 
-	// add local statements
-	for idx, stmt := range funDecl.Body.List {
-		for idx2, decor := range stmt.Decorations().Start.All() {
-			if d.text == decor {
-				var prevComment, nextComment []string
+// insertBeforeDirective inserts statements before the statement of an inner
+// directive, list and idx locate the statement
+func (t *CollectInfo) insertBeforeDirective(d Directive, list *[]dst.Stmt,
+	idx int, inFuncStmts []dst.Stmt,
+) error {
+	stmt := d.stmt
+	for idx2, decor := range stmt.Decorations().Start.All() {
+		if d.text == decor {
+			var prevComment, nextComment []string
 
-				// copy decorations to prevComment and nextComment
-				prevComment = append(
-					prevComment,
-					stmt.Decorations().Start.All()[:idx2+1]...)
-				nextComment = append(
-					nextComment,
-					stmt.Decorations().Start.All()[idx2+1:]...)
+			// copy decorations to prevComment and nextComment
+			prevComment = append(
+				prevComment,
+				stmt.Decorations().Start.All()[:idx2+1]...)
+			nextComment = append(
+				nextComment,
+				stmt.Decorations().Start.All()[idx2+1:]...)
 
-				prevComment = append(prevComment, BeginUUID(t.genUUID))
-				nextComment = append([]string{EndUUID(t.UUID())}, nextComment...)
+			prevComment = append(prevComment, BeginUUID(t.FileUUID(d.filename)))
+			nextComment = append([]string{EndUUID(t.FileUUID(d.filename))}, nextComment...)
 
-				log.Debugf("prevComment: %v", prevComment)
-				log.Debugf("nextComment: %v", nextComment)
+			log.Debugf("prevComment: %v", prevComment)
+			log.Debugf("nextComment: %v", nextComment)
 
-				// \n prevComment BeginUUID
-				inFuncStmts[0].Decorations().Start.Prepend(prevComment...)
-				inFuncStmts[0].Decorations().Start.Prepend("\n")
-				stmt.Decorations().Start.Replace(nextComment...)
+			// prevComment BeginUUID, the inserted statements also take the
+			// empty line before the statement so clean can cut them out
+			inFuncStmts[0].Decorations().Start.Prepend(prevComment...)
+			inFuncStmts[0].Decorations().Before = stmt.Decorations().Before
+			if inFuncStmts[0].Decorations().Before == dst.None {
+				inFuncStmts[0].Decorations().Before = dst.NewLine
+			}
+			stmt.Decorations().Before = dst.NewLine
+			stmt.Decorations().Start.Replace(nextComment...)
 
-				// insert code before the declaration index
-				funDecl.Body.List = append(funDecl.Body.List[:idx],
-					append(inFuncStmts, funDecl.Body.List[idx:]...)...)
+			// insert code before the statement in the block that contains it
+			*list = append((*list)[:idx],
+				append(inFuncStmts, (*list)[idx:]...)...)
 
-				t.modifiedFiles[d.filename] = true
-				return nil
+			t.modifiedFiles[d.filename] = true
+			return nil
+		}
+	}
+	return fmt.Errorf("directive not found")
+}
+
+// stmtLists returns all the statement lists in a function body, including the
+// nested blocks, case clauses and function literals, in source order
+func stmtLists(body *dst.BlockStmt) []*[]dst.Stmt {
+	res := []*[]dst.Stmt{}
+	dst.Inspect(body, func(n dst.Node) bool {
+		switch n := n.(type) {
+		case *dst.BlockStmt:
+			res = append(res, &n.List)
+		case *dst.CaseClause:
+			res = append(res, &n.Body)
+		case *dst.CommClause:
+			res = append(res, &n.Body)
+		}
+		return true
+	})
+	return res
+}
+
+// walkBodyStmts calls fn for all the statements of a function body that
+// directives can be attached to, in source order. fn is called with after set
+// to false before the nested statements of a statement are visited, and with
+// after set to true once they are.
+func walkBodyStmts(body *dst.BlockStmt, fn func(stmt dst.Stmt, after bool)) {
+	inList := make(map[dst.Stmt]bool)
+	for _, list := range stmtLists(body) {
+		for _, stmt := range *list {
+			inList[stmt] = true
+		}
+	}
+	stack := []dst.Node{}
+	dst.Inspect(body, func(n dst.Node) bool {
+		if n == nil {
+			n, stack = stack[len(stack)-1], stack[:len(stack)-1]
+			if stmt, ok := n.(dst.Stmt); ok && inList[stmt] {
+				fn(stmt, true)
+			}
+			return true
+		}
+		stack = append(stack, n)
+		if stmt, ok := n.(dst.Stmt); ok && inList[stmt] {
+			fn(stmt, false)
+		}
+		return true
+	})
+}
+
+// findStmt returns the statement list that contains a statement and its index
+// in the list
+func findStmt(body *dst.BlockStmt, stmt dst.Stmt) (*[]dst.Stmt, int) {
+	for _, list := range stmtLists(body) {
+		for idx, s := range *list {
+			if s == stmt {
+				return list, idx
 			}
 		}
 	}
-	return fmt.Errorf("not implemented")
+	return nil, -1
 }
 
 // SetFunctionTracking sets the function time tracing
@@ -528,42 +647,8 @@ func (t *CollectInfo) SetFunctionTimeTracing(d Directive,
 	}
 
 	// add import
-	pkgsUpdated := false
-	for name, pkg := range pkgs {
-		for {
-			if err := t.AddPkgImport(d.filename, pkg.Name, pkg.Path); err != nil {
-				if err.Error() == "change import name" {
-					pkg.Name = fmt.Sprintf("%s_%d", pkg.Name, rand.Intn(100))
-					pkgsUpdated = true
-					continue
-				} else if strings.Contains(err.Error(), "use existing import name") {
-					// extract the name from the error message that enclosed by double quotes
-					// e.g. "use existing import name \"prometheus\""
-					// then replace the pkg name with the new name
-					newName := strings.Trim(
-						strings.Split(err.Error(), "\"")[1],
-						"\"")
-					log.Infof("use existing import name \"%s\" for pkg %+v", newName, pkg)
-					pkgs[name].Name = newName
-					pkgsUpdated = true
-					continue
-				} else {
-					return err
-				}
-			}
-			break
-		}
-	}
-	if pkgsUpdated {
-		for _, ident := range pkgPatchTable {
-			for name, pkg := range pkgs {
-				// search if pkg name is a substring of ident name
-				if strings.Contains(ident.Name, name) {
-					// replace the substring with the new name
-					ident.Name = strings.Replace(ident.Name, name, pkg.Name, 1)
-				}
-			}
-		}
+	if err := t.addPkgImports(d.filename, pkgs, pkgPatchTable); err != nil {
+		return err
 	}
 
 	directiveIdx := -1
@@ -579,7 +664,11 @@ func (t *CollectInfo) SetFunctionTimeTracing(d Directive,
 	}
 
 	// insert code before the function declaration
-	if len(globalDecl) != 0 {
+	if len(globalDecl) != 0 && d.origin != nil {
+		// the directive is not written in the comments of the function
+		log.Debugf("add global define function for: %s", d.filename)
+		t.insertDeclsAt(d.filename, directiveIdx, globalDecl)
+	} else if len(globalDecl) != 0 {
 		for idx, decor := range d.declaration.Decorations().Start.All() {
 			if d.text == decor {
 				var prevComment, nextComment []string
@@ -592,8 +681,8 @@ func (t *CollectInfo) SetFunctionTimeTracing(d Directive,
 					nextComment,
 					d.declaration.Decorations().Start.All()[idx+1:]...)
 
-				prevComment = append(prevComment, BeginUUID(t.genUUID))
-				nextComment = append([]string{EndUUID(t.UUID())}, nextComment...)
+				prevComment = append(prevComment, BeginUUID(t.FileUUID(d.filename)))
+				nextComment = append([]string{EndUUID(t.FileUUID(d.filename))}, nextComment...)
 
 				globalDecl[0].Decorations().Start.Replace(
 					append([]string{"\n"}, prevComment...)...)
@@ -616,11 +705,11 @@ func (t *CollectInfo) SetFunctionTimeTracing(d Directive,
 		d.declaration.(*dst.FuncDecl).Name.Name,
 	)
 
-	inFuncStmts[0].Decorations().Start.Prepend("\n", BeginUUID(t.genUUID))
-	inFuncStmts[len(inFuncStmts)-1].Decorations().End.Append("\n", EndUUID(t.UUID()))
+	body := d.declaration.(*dst.FuncDecl).Body
+	markGenerated(inFuncStmts, t.blockBeginUUID(d.filename, body),
+		EndUUID(t.FileUUID(d.filename)))
 
-	d.declaration.(*dst.FuncDecl).Body.List = append(inFuncStmts,
-		d.declaration.(*dst.FuncDecl).Body.List...)
+	body.List = append(inFuncStmts, body.List...)
 
 	t.modifiedFiles[d.filename] = true
 	return nil
@@ -628,34 +717,22 @@ func (t *CollectInfo) SetFunctionTimeTracing(d Directive,
 
 // return all the directives in a file
 func (t *CollectInfo) readFileDirectives(filename string) ([]*Directive, error) {
-	res := []*Directive{}
 	file, ok := t.filesDst[filename]
 	if !ok {
 		log.Errorf("file %s not found", filename)
-		return res, fmt.Errorf("file not found")
+		return []*Directive{}, fmt.Errorf("file not found")
 	}
+	return readDirectives(filename, file)
+}
+
+// return all the directives in a dst.File
+func readDirectives(filename string, file *dst.File) ([]*Directive, error) {
+	res := readPackageDirectives(filename, file)
 	for _, decl := range file.Decls {
 		// check all prefix comments and find out the directives
 		for _, decor := range decl.Decorations().Start.All() {
-			if traceType, err := ParseStringDirectiveType(decor); err == nil {
-				if traceType != Invalid {
-					d := &Directive{
-						filename:    filename,
-						declaration: decl,
-						text:        decor,
-						traceType:   traceType,
-					}
-					// find all arguments
-					if params, err := ParseDirectiveParams(decor); err == nil {
-						if len(params) != 0 {
-							log.Debugf("found directive params: %v", params)
-						}
-						d.params = params
-					}
-					res = append(res, d)
-				}
-			} else {
-				return nil, err
+			if d := newDirective(filename, decl, nil, decor); d != nil {
+				res = append(res, d)
 			}
 		}
 
@@ -664,39 +741,86 @@ func (t *CollectInfo) readFileDirectives(filename string) ([]*Directive, error)
 			if funcDecl.Body == nil {
 				continue
 			}
-			for _, stmt := range funcDecl.Body.List {
-				for _, decor := range stmt.Decorations().Start.All() {
-					if traceType, err := ParseStringDirectiveType(decor); err == nil {
-						if traceType != Invalid {
-							log.Debugf("found inner directive: %s", decor)
-							d := &Directive{
-								filename:    filename,
-								declaration: funcDecl,
-								text:        decor,
-								traceType:   traceType,
-							}
-							// find all arguments
-							if params, err := ParseDirectiveParams(decor); err == nil {
-								if len(params) != 0 {
-									log.Debugf("found directive params: %v", params)
-								}
-								d.params = params
-							}
+			walkBodyStmts(funcDecl.Body, func(stmt dst.Stmt, after bool) {
+				if after {
+					// region-end can also follow the last statement of a block
+					for _, decor := range stmt.Decorations().End.All() {
+						if d := newDirective(filename, funcDecl, stmt, decor); d != nil &&
+							d.traceType == RegionEnd {
+							d.after = true
 							res = append(res, d)
 						}
-					} else {
-						return nil, err
 					}
+					return
 				}
-			}
+				for _, decor := range stmt.Decorations().Start.All() {
+					if d := newDirective(filename, funcDecl, stmt, decor); d != nil {
+						log.Debugf("found inner directive: %s", decor)
+						res = append(res, d)
+					}
+				}
+			})
 		}
 	}
 	return res, nil
 }
 
+// newDirective creates a directive from a comment, or returns nil if the
+// comment is not a trace directive. Unknown directives are kept as Invalid so
+// they can be reported with their position.
+func newDirective(filename string, decl dst.Decl, stmt dst.Stmt,
+	decor string,
+) *Directive {
+	traceType, err := ParseStringDirectiveType(decor)
+	if err != nil {
+		log.Debugf("found unknown directive: %v", err)
+	} else if traceType == Invalid {
+		return nil
+	}
+	d := &Directive{
+		filename:    filename,
+		declaration: decl,
+		stmt:        stmt,
+		text:        decor,
+		traceType:   traceType,
+	}
+	// find all arguments
+	if params, err := ParseDirectiveParams(decor); err == nil {
+		if len(params) != 0 {
+			log.Debugf("found directive params: %v", params)
+		}
+		d.params = params
+	}
+	return d
+}
+
 // HasDefinitionDirective checks if the CollectInfo struct has a definition directive
 func (t *CollectInfo) HasDefinitionDirective() bool {
-	return t.defFileName != ""
+	return len(t.defFiles) != 0
+}
+
+// DefinitionDirective returns the definition directive of the module that
+// contains a file, or nil if there is none
+func (t *CollectInfo) DefinitionDirective(filename string) *Directive {
+	return t.ModuleDefinitionDirective(t.fileGoMod[filename])
+}
+
+// ModuleDefinitionDirective returns the definition directive of the module of
+// a go.mod. A module without one uses the definition directive of the project
+// if there is only one, nil is returned otherwise.
+func (t *CollectInfo) ModuleDefinitionDirective(goMod string) *Directive {
+	defFile, ok := t.defFiles[goMod]
+	if !ok && len(t.defFiles) == 1 {
+		for _, filename := range t.defFiles {
+			defFile = filename
+		}
+	}
+	for _, directive := range t.fileDirectives[defFile] {
+		if directive.traceType == Define && directive.stmt == nil {
+			return directive
+		}
+	}
+	return nil
 }
 
 // Files returns all the files in the CollectInfo struct
@@ -705,6 +829,7 @@ func (t *CollectInfo) Files() []string {
 	for filename := range t.filesDst {
 		res = append(res, filename)
 	}
+	sort.Strings(res)
 	return res
 }
 
@@ -717,11 +842,10 @@ func (t *CollectInfo) IsModified(filename string) bool {
 	return t.modifiedFiles[filename]
 }
 
-func (t *CollectInfo) GoModPath() string {
-	if t.goModPath == "" {
-		log.Infof("go.mod not found")
-	}
-	return t.goModPath
+// GoModPath returns the go.mod of the module that contains a file, or an empty
+// string if the file is not in a module
+func (t *CollectInfo) GoModPath(filename string) string {
+	return t.fileGoMod[filename]
 }
 
 func (t *CollectInfo) FileDirectives(filename string) ([]*Directive, error) {
@@ -731,14 +855,243 @@ func (t *CollectInfo) FileDirectives(filename string) ([]*Directive, error) {
 	return t.fileDirectives[filename], nil
 }
 
-func (t *CollectInfo) UUID() string {
-	return t.genUUID
+// SetGeneratorKey sets the key identifying the generator and its config. The
+// key is part of the generated uuids so changing it regenerates all the code.
+func (t *CollectInfo) SetGeneratorKey(key string) {
+	t.genKey = key
+}
+
+// FileUUID returns the uuid of the generated code blocks in a file. It is
+// derived from the generator key, the package path, the definition directive
+// of the module and the directives in the file so it only changes when one of
+// them changes.
+func (t *CollectInfo) FileUUID(filename string) string {
+	return t.directivesUUID(filename, t.fileDirectives[filename])
+}
+
+func (t *CollectInfo) directivesUUID(filename string, directives []*Directive) string {
+	data := []string{t.genKey, t.packageKey(filename)}
+	if def := t.DefinitionDirective(filename); def != nil {
+		// the definition directive holds the defaults of the other directives
+		data = append(data, def.text)
+	}
+	for _, directive := range directives {
+		if directive.traceType == GenBegine || directive.traceType == GenEnd {
+			continue
+		}
+		line := fmt.Sprintf("%s:%s", directiveFuncName(directive), directive.text)
+		if t.sharesNamedVars(filename, directives, directive) {
+			// the code changes when the variables are declared elsewhere
+			line += " shared"
+		}
+		data = append(data, line)
+	}
+	return uuid.NewSHA1(genNamespace, []byte(strings.Join(data, "\n"))).String()
+}
+
+// SharesInFlightGauge checks if a func-in-flight directive uses the variables
+// of another func-in-flight directive with the same name in its package, the
+// variables are declared with the first directive of the first file of the
+// package
+func (t *CollectInfo) SharesInFlightGauge(d *Directive) bool {
+	return t.sharesNamedVars(d.filename, t.fileDirectives[d.filename], d)
+}
+
+// sharesNamedVars checks if the directive d, one of the directives of
+// filename, is not the first directive of its type with its name in the
+// package. Only go-spawn and func-in-flight directives with a name share the
+// package variables of their metrics.
+func (t *CollectInfo) sharesNamedVars(filename string, directives []*Directive,
+	d *Directive,
+) bool {
+	if d.traceType != GoSpawn && d.traceType != FuncInFlight {
+		return false
+	}
+	name, ok := d.Param("name")
+	if !ok {
+		return false
+	}
+	sameName := func(directive *Directive) bool {
+		v, ok := directive.Param("name")
+		return directive.traceType == d.traceType && ok && v == name
+	}
+	// the files of a package are in the same directory
+	for _, other := range t.Files() {
+		if other >= filename {
+			break
+		}
+		if filepath.Dir(other) != filepath.Dir(filename) ||
+			t.PackageName(other) != t.PackageName(filename) {
+			continue
+		}
+		for _, directive := range t.fileDirectives[other] {
+			if sameName(directive) {
+				return true
+			}
+		}
+	}
+	for _, directive := range directives {
+		if directive == d {
+			return false
+		}
+		if sameName(directive) {
+			return true
+		}
+	}
+	return false
+}
+
+// packageKey returns the package path of a file, or the package name if the
+// file was not loaded with go/packages
+func (t *CollectInfo) packageKey(filename string) string {
+	if pkgPath := t.PackagePath(filename); pkgPath != "" {
+		return pkgPath
+	}
+	return t.PackageName(filename)
+}
+
+// directiveFuncName returns the name of the function a directive belongs to,
+// prefixed with the receiver type for methods, or an empty string for
+// directives on other declarations
+func directiveFuncName(d *Directive) string {
+	if funcDecl, ok := d.declaration.(*dst.FuncDecl); ok {
+		if recv := recvTypeName(funcDecl); recv != "" {
+			return recv + "." + funcDecl.Name.Name
+		}
+		return funcDecl.Name.Name
+	}
+	return ""
+}
+
+// DirectiveID returns a short identifier for the generated code of a
+// directive. It is derived from the package path, the function and the text
+// of the directive so generating unchanged code again gives the same names.
+// Identical directives in a function are told apart by their order, not by
+// their line, so moving code around does not rename anything.
+func (t *CollectInfo) DirectiveID(d *Directive) string {
+	if n := t.directiveOccurrence(d); n != 0 {
+		return utils.StableHash(8, t.packageKey(d.filename), directiveFuncName(d),
+			d.text, strconv.Itoa(n))
+	}
+	return utils.StableHash(8, t.packageKey(d.filename), directiveFuncName(d),
+		d.text)
+}
+
+// directiveOccurrence returns the number of identical directives before d in
+// the same function. d may be a copy of the directive collected for the file.
+func (t *CollectInfo) directiveOccurrence(d *Directive) int {
+	funcName := directiveFuncName(d)
+	n := 0
+	for _, directive := range t.fileDirectives[d.filename] {
+		if directive == d || directive.text == d.text &&
+			directive.declaration == d.declaration && directive.stmt == d.stmt &&
+			directive.after == d.after && directive.origin == d.origin {
+			return n
+		}
+		if directive.text == d.text && directive.declaration == d.declaration &&
+			directiveFuncName(directive) == funcName {
+			n++
+		}
+	}
+	return 0
+}
+
+// PrepareRegenerate checks the generated code blocks of all the files. Files
+// with blocks generated from the same directives and generator are marked as
+// up to date, stale blocks are removed so they can be generated again. With
+// force, the blocks of all the files are removed whatever their uuids are.
+func (t *CollectInfo) PrepareRegenerate(force bool) error {
+	for _, filename := range t.Files() {
+		if !t.HasGenerated(filename) {
+			continue
+		}
+		if force {
+			if err := t.RemoveGenerated(filename); err != nil {
+				return err
+			}
+			continue
+		}
+		// directives have to be read from a copy without the generated code
+		clone := dst.Clone(t.filesDst[filename]).(*dst.File)
+		if _, _, err := removeGenerated(clone); err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+		directives, err := readDirectives(filename, clone)
+		if err != nil {
+			return err
+		}
+		directives = t.withPackageDirectives(filename, clone, directives)
+		fileUUID := t.directivesUUID(filename, directives)
+		upToDate := true
+		for _, directive := range t.fileDirectives[filename] {
+			if directive.traceType != GenBegine && directive.traceType != GenEnd {
+				continue
+			}
+			if v, ok := directive.Param("uuid"); !ok || v != fileUUID {
+				upToDate = false
+				break
+			}
+		}
+		if upToDate {
+			log.Infof("generated code in %s is up to date", filename)
+			t.upToDate[filename] = true
+			continue
+		}
+		log.Infof("regenerating stale code in %s", filename)
+		if err := t.RemoveGenerated(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IsUpToDate checks if the generated code in a file needs no change
+func (t *CollectInfo) IsUpToDate(filename string) bool {
+	return t.upToDate[filename]
+}
+
+// splitAfterEndMarker splits decorations after the last end-generated marker
+func splitAfterEndMarker(decs []string) ([]string, []string) {
+	for idx := len(decs) - 1; idx >= 0; idx-- {
+		if strings.HasPrefix(decs[idx], "// +trace:end-generated") {
+			return append([]string{}, decs[:idx+1]...),
+				append([]string{}, decs[idx+1:]...)
+		}
+	}
+	return nil, decs
 }
 
 func BeginUUID(uuid string) string {
 	return fmt.Sprintf("// +trace:begin-generated uuid=%s", uuid)
 }
 
+// markGenerated wraps inserted statements in generated code markers. The
+// first statement starts on a new line so the begin marker is not written
+// after an opening brace.
+func markGenerated(stmts []dst.Stmt, begin string, end string) {
+	decs := stmts[0].Decorations()
+	decs.Start.Prepend(begin)
+	if decs.Before == dst.None {
+		decs.Before = dst.NewLine
+	}
+	stmts[len(stmts)-1].Decorations().End.Append("\n", end)
+}
+
+// blockBeginUUID returns the begin marker of code inserted at the beginning
+// of a block. The marker tells clean to join the block again if it was
+// written on a single line and to restore the results of the function if they
+// were renamed.
+func (t *CollectInfo) blockBeginUUID(filename string, block *dst.BlockStmt) string {
+	begin := BeginUUID(t.FileUUID(filename))
+	if t.onOneLine(filename, block) {
+		begin += " oneline=true"
+	}
+	if t.renamedResults[block] {
+		begin += " results=renamed"
+	}
+	return begin
+}
+
 func EndUUID(uuid string) string {
 	return fmt.Sprintf("// +trace:end-generated uuid=%s", uuid)
 }
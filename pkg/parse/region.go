@@ -0,0 +1,210 @@
+package parse
+
+import (
+	"fmt"
+
+	"github.com/dave/dst"
+)
+
+// Region is a pair of region-begin and region-end directives with the same
+// name. Both directives are attached to statements of the same statement list,
+// the region is made of the statements from the begin statement up to the end
+// statement, which is included if the region-end follows it.
+type Region struct {
+	Name  string
+	Begin *Directive
+	End   *Directive
+}
+
+// RegionError is an unbalanced or crossing region directive
+type RegionError struct {
+	Directive *Directive
+	Message   string
+}
+
+func (e *RegionError) Error() string {
+	return e.Message
+}
+
+// Regions matches the region-begin and region-end directives of a file. Regions
+// can be nested but must not cross, and a region must begin and end in the same
+// block.
+func (t *CollectInfo) Regions(filename string) ([]*Region, error) {
+	directives, err := t.FileDirectives(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []*Region{}
+	open := []*Region{}
+	var funcDecl dst.Decl
+	unclosed := func() error {
+		if len(open) == 0 {
+			return nil
+		}
+		r := open[len(open)-1]
+		return &RegionError{
+			Directive: r.Begin,
+			Message:   fmt.Sprintf("region-begin %q without region-end", r.Name),
+		}
+	}
+	for _, directive := range directives {
+		if directive.traceType != RegionBegin && directive.traceType != RegionEnd {
+			continue
+		}
+		name, ok := directive.Param("name")
+		if directive.stmt == nil || !ok || name == "" {
+			// misplaced directives and missing names are reported by the linter
+			continue
+		}
+		if directive.declaration != funcDecl {
+			if err := unclosed(); err != nil {
+				return nil, err
+			}
+			funcDecl = directive.declaration
+		}
+
+		if directive.traceType == RegionBegin {
+			for _, r := range open {
+				if r.Name == name {
+					return nil, &RegionError{
+						Directive: directive,
+						Message:   fmt.Sprintf("region %q begins again before it ends", name),
+					}
+				}
+			}
+			open = append(open, &Region{Name: name, Begin: directive})
+			continue
+		}
+
+		if len(open) == 0 || open[len(open)-1].Name != name {
+			for _, r := range open {
+				if r.Name == name {
+					return nil, &RegionError{
+						Directive: directive,
+						Message: fmt.Sprintf("region %q ends inside region %q, "+
+							"regions must not cross", name, open[len(open)-1].Name),
+					}
+				}
+			}
+			return nil, &RegionError{
+				Directive: directive,
+				Message:   fmt.Sprintf("region-end %q without region-begin", name),
+			}
+		}
+		r := open[len(open)-1]
+		open = open[:len(open)-1]
+		r.End = directive
+		if r.Begin.stmt == r.End.stmt && !r.End.after {
+			return nil, &RegionError{
+				Directive: directive,
+				Message:   fmt.Sprintf("region %q has no statements", name),
+			}
+		}
+
+		body := directive.declaration.(*dst.FuncDecl).Body
+		beginList, _ := findStmt(body, r.Begin.stmt)
+		endList, _ := findStmt(body, r.End.stmt)
+		if beginList != endList {
+			return nil, &RegionError{
+				Directive: directive,
+				Message: fmt.Sprintf("region %q must begin and end in the same block",
+					name),
+			}
+		}
+		res = append(res, r)
+	}
+	if err := unclosed(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// returnStmts returns the return statements of the function that are nested in
+// stmts, the returns of function literals are not included
+func returnStmts(stmts []dst.Stmt) []*dst.ReturnStmt {
+	res := []*dst.ReturnStmt{}
+	for _, stmt := range stmts {
+		dst.Inspect(stmt, func(n dst.Node) bool {
+			switch node := n.(type) {
+			case *dst.FuncLit:
+				return false
+			case *dst.ReturnStmt:
+				res = append(res, node)
+			}
+			return true
+		})
+	}
+	return res
+}
+
+// SetRegionTracing inserts beginStmts before the statement of the region-begin
+// directive, and the statements returned by endStmts before the statement of
+// the region-end directive and before every return inside the region.
+// endStmts returns new statements and their patch table on every call.
+func (t *CollectInfo) SetRegionTracing(r *Region,
+	globalDecl []dst.Decl,
+	beginStmts []dst.Stmt,
+	endStmts func() ([]dst.Stmt, []*dst.Ident),
+	pkgsIn map[string]*PackageInfo,
+	pkgPatchTable []*dst.Ident,
+) error {
+	// deep copy pkgs
+	pkgs := make(map[string]*PackageInfo)
+	for k, v := range pkgsIn {
+		pkgs[k] = &PackageInfo{
+			Name: v.Name,
+			Path: v.Path,
+		}
+	}
+
+	body := r.Begin.declaration.(*dst.FuncDecl).Body
+	list, beginIdx := findStmt(body, r.Begin.stmt)
+	_, endIdx := findStmt(body, r.End.stmt)
+	if list == nil || endIdx == -1 {
+		return fmt.Errorf("statements of region %q not found", r.Name)
+	}
+
+	if r.End.after {
+		endIdx++
+	}
+
+	// early returns leave the region, the inserted statements are found again
+	// with the returns since the list changes
+	patchTable := append([]*dst.Ident{}, pkgPatchTable...)
+	for _, ret := range returnStmts((*list)[beginIdx:endIdx]) {
+		retList, retIdx := findStmt(body, ret)
+		if retList == nil {
+			// a labeled return is not in a statement list
+			return fmt.Errorf("return statement in region %q is not supported",
+				r.Name)
+		}
+		stmts, stmtsPatchTable := endStmts()
+		patchTable = append(patchTable, stmtsPatchTable...)
+		markGenerated(stmts, BeginUUID(t.FileUUID(r.Begin.filename)),
+			EndUUID(t.FileUUID(r.Begin.filename)))
+		*retList = append((*retList)[:retIdx], append(stmts, (*retList)[retIdx:]...)...)
+	}
+
+	stmts, stmtsPatchTable := endStmts()
+	patchTable = append(patchTable, stmtsPatchTable...)
+	_, endIdx = findStmt(body, r.End.stmt)
+	if r.End.after {
+		// the region-end comment stays after its statement
+		markGenerated(stmts, BeginUUID(t.FileUUID(r.End.filename)),
+			EndUUID(t.FileUUID(r.End.filename)))
+		*list = append((*list)[:endIdx+1], append(stmts, (*list)[endIdx+1:]...)...)
+	} else if err := t.insertBeforeDirective(*r.End, list, endIdx, stmts); err != nil {
+		return err
+	}
+	_, beginIdx = findStmt(body, r.Begin.stmt)
+	if err := t.insertBeforeDirective(*r.Begin, list, beginIdx, beginStmts); err != nil {
+		return err
+	}
+
+	// all the idents are renamed at once if an import name is taken
+	if err := t.addPkgImports(r.Begin.filename, pkgs, patchTable); err != nil {
+		return err
+	}
+	return t.insertInnerDecls(r.Begin.filename, globalDecl)
+}
@@ -0,0 +1,247 @@
+package parse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+)
+
+// collectSource adds a file with src to a new CollectInfo
+func collectSource(t *testing.T, src string) (*CollectInfo, string) {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "main.go")
+	if err := os.WriteFile(filename, []byte(src), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info := NewCollectInfo()
+	if err := info.AddTraceFiles([]string{filename}); err != nil {
+		t.Fatal(err)
+	}
+	return info, filename
+}
+
+// printSource prints a file of a CollectInfo
+func printSource(t *testing.T, info *CollectInfo, filename string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := decorator.Fprint(&buf, info.FileDst(filename)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// regionSource returns a file with a function of body, the body starts on
+// line 4
+func regionSource(body string) string {
+	return "package main\n\nfunc f() {" + body + "\n}\n"
+}
+
+func TestRegions(t *testing.T) {
+	// the regions in the order they end with the lines of their directives
+	tests := map[string][]string{
+		`
+	// +trace:region-begin name=outer
+	a()
+	// +trace:region-begin name=inner
+	b()
+	// +trace:region-end name=inner
+	c()
+	// +trace:region-end name=outer
+	d()`: {"inner 6-8", "outer 4-10"},
+		`
+	// +trace:region-begin name=r
+	a()
+	// +trace:region-end name=r`: {"r 4-6"},
+		`
+	// +trace:region-begin name=a
+	a()
+	// +trace:region-end name=a
+	// +trace:region-begin name=b
+	b()
+	// +trace:region-end name=b`: {"a 4-6", "b 7-9"},
+	}
+	for body, want := range tests {
+		info, filename := collectSource(t, regionSource(body))
+		regions, err := info.Regions(filename)
+		if err != nil {
+			t.Fatalf("%v in:%s", err, body)
+		}
+		got := []string{}
+		for _, r := range regions {
+			got = append(got, fmt.Sprintf("%s %d-%d", r.Name,
+				info.DirectivePosition(r.Begin).Line,
+				info.DirectivePosition(r.End).Line))
+		}
+		if strings.Join(got, ", ") != strings.Join(want, ", ") {
+			t.Errorf("got regions %v, want %v in:%s", got, want, body)
+		}
+	}
+}
+
+// the errors are reported at the directive that can not be matched
+func TestRegionErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		line int
+		want string
+	}{
+		{
+			name: "begin without end",
+			body: `
+	// +trace:region-begin name=r
+	a()`,
+			line: 4,
+			want: `region-begin "r" without region-end`,
+		},
+		{
+			name: "end without begin",
+			body: `
+	a()
+	// +trace:region-end name=r
+	b()`,
+			line: 5,
+			want: `region-end "r" without region-begin`,
+		},
+		{
+			name: "crossing",
+			body: `
+	// +trace:region-begin name=a
+	a()
+	// +trace:region-begin name=b
+	b()
+	// +trace:region-end name=a
+	c()
+	// +trace:region-end name=b
+	d()`,
+			line: 8,
+			want: `region "a" ends inside region "b", regions must not cross`,
+		},
+		{
+			name: "begins again",
+			body: `
+	// +trace:region-begin name=r
+	a()
+	// +trace:region-begin name=r
+	b()
+	// +trace:region-end name=r
+	c()`,
+			line: 6,
+			want: `region "r" begins again before it ends`,
+		},
+		{
+			name: "different blocks",
+			body: `
+	// +trace:region-begin name=r
+	a()
+	if ok() {
+		// +trace:region-end name=r
+		b()
+	}`,
+			line: 7,
+			want: `region "r" must begin and end in the same block`,
+		},
+		{
+			name: "no statements",
+			body: `
+	a()
+	// +trace:region-begin name=r
+	// +trace:region-end name=r
+	b()`,
+			line: 6,
+			want: `region "r" has no statements`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, filename := collectSource(t, regionSource(tt.body))
+			_, err := info.Regions(filename)
+			var regionErr *RegionError
+			if !errors.As(err, &regionErr) {
+				t.Fatalf("got error %v, want a region error", err)
+			}
+			if regionErr.Message != tt.want {
+				t.Errorf("got error %q, want %q", regionErr.Message, tt.want)
+			}
+			if line := info.DirectivePosition(regionErr.Directive).Line; line != tt.line {
+				t.Errorf("error reported at line %d, want %d", line, tt.line)
+			}
+		})
+	}
+}
+
+// the end statements are inserted before the returns inside a region too
+func TestSetRegionTracingEarlyReturn(t *testing.T) {
+	info, filename := collectSource(t, `package main
+
+func f(n int) int {
+	// +trace:region-begin name=r
+	if n < 0 {
+		return 0
+	}
+	g := func() int {
+		return n
+	}
+	// +trace:region-end name=r
+	n = g()
+	return n
+}
+`)
+	regions, err := info.Regions(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(regions) != 1 {
+		t.Fatalf("got %d regions, want 1", len(regions))
+	}
+	call := func(name string) dst.Stmt {
+		return &dst.ExprStmt{X: &dst.CallExpr{Fun: dst.NewIdent(name)}}
+	}
+	endStmts := func() ([]dst.Stmt, []*dst.Ident) {
+		return []dst.Stmt{call("end")}, nil
+	}
+	if err := info.SetRegionTracing(regions[0], nil,
+		[]dst.Stmt{call("begin")}, endStmts, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the end statements are inserted once before the early return and once
+	// at the end of the region, not before the return of the function literal
+	// nor before the return after the region
+	begin := BeginUUID(info.FileUUID(filename))
+	end := EndUUID(info.FileUUID(filename))
+	want := `package main
+
+func f(n int) int {
+	// +trace:region-begin name=r
+	` + begin + `
+	begin()
+	` + end + `
+	if n < 0 {
+		` + begin + `
+		end()
+		` + end + `
+		return 0
+	}
+	g := func() int {
+		return n
+	}
+	// +trace:region-end name=r
+	` + begin + `
+	end()
+	` + end + `
+	n = g()
+	return n
+}
+`
+	if got := printSource(t, info, filename); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,134 @@
+package parse
+
+import (
+	"fmt"
+	"go/types"
+	"strings"
+
+	"github.com/dave/dst"
+)
+
+// prefix of the result names added by the generator, they are removed again
+// with the generated code
+const genResultPrefix = "metrics_gen_"
+
+// isRenamedResultsMarker checks if a comment is a begin-generated marker
+// recording that the results of its function were renamed by the generator
+func isRenamedResultsMarker(text string) bool {
+	if traceType, _ := ParseStringDirectiveType(text); traceType != GenBegine {
+		return false
+	}
+	params, _ := ParseDirectiveParams(text)
+	return params["results"] == "renamed"
+}
+
+// hasRenamedResults checks if the generated code of a function body records
+// that the results of the function were renamed
+func hasRenamedResults(body *dst.BlockStmt) bool {
+	if body == nil {
+		return false
+	}
+	for _, stmt := range body.List {
+		for _, decor := range stmt.Decorations().Start.All() {
+			if isRenamedResultsMarker(decor) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isErrorType checks if a result type is the predeclared error type
+func (t *CollectInfo) isErrorType(filename string, expr dst.Expr) bool {
+	if typ := t.TypeOf(filename, expr); typ != nil {
+		return types.Identical(typ, types.Universe.Lookup("error").Type())
+	}
+	ident, ok := expr.(*dst.Ident)
+	return ok && ident.Name == "error" && ident.Path == ""
+}
+
+// ErrorResultName returns the name of the last result of the function of a
+// directive, which must be an error. Unnamed results are named and a blank
+// error result is renamed so that deferred code can read the returned error.
+// The generated code of a function with renamed results is marked so that
+// only these results are restored with it.
+func (t *CollectInfo) ErrorResultName(d Directive) (string, error) {
+	funcDecl, ok := d.declaration.(*dst.FuncDecl)
+	if !ok {
+		return "", fmt.Errorf("not a func declaration")
+	}
+	results := funcDecl.Type.Results
+	if results == nil || len(results.List) == 0 ||
+		!t.isErrorType(d.filename, results.List[len(results.List)-1].Type) {
+		return "", fmt.Errorf("function %s does not return an error as its "+
+			"last result", funcDecl.Name.Name)
+	}
+
+	last := results.List[len(results.List)-1]
+	if len(last.Names) == 0 {
+		// results are either all named or all unnamed
+		for idx, field := range results.List {
+			field.Names = []*dst.Ident{
+				dst.NewIdent(fmt.Sprintf("%sr%d", genResultPrefix, idx)),
+			}
+		}
+		last.Names[0].Name = genResultPrefix + "err"
+		results.Opening = true
+		results.Closing = true
+		t.renamedResults[funcDecl.Body] = true
+		t.modifiedFiles[d.filename] = true
+	} else if name := last.Names[len(last.Names)-1]; name.Name == "_" {
+		name.Name = genResultPrefix + "err"
+		t.renamedResults[funcDecl.Body] = true
+		t.modifiedFiles[d.filename] = true
+	}
+	return last.Names[len(last.Names)-1].Name, nil
+}
+
+// restoreResultNames undoes the result renaming of ErrorResultName and returns
+// the number of restored functions. It has to run before the generated code is
+// removed since only functions whose generated code is marked are restored.
+func restoreResultNames(file *dst.File) int {
+	restored := 0
+	for _, decl := range file.Decls {
+		funcDecl, ok := decl.(*dst.FuncDecl)
+		if !ok || funcDecl.Type.Results == nil ||
+			!hasRenamedResults(funcDecl.Body) {
+			continue
+		}
+		results := funcDecl.Type.Results
+		generated, total := 0, 0
+		for _, field := range results.List {
+			for _, name := range field.Names {
+				total++
+				if strings.HasPrefix(name.Name, genResultPrefix) {
+					generated++
+				}
+			}
+		}
+		if generated == 0 {
+			continue
+		}
+		restored++
+
+		if generated == total {
+			// all the results were unnamed
+			for _, field := range results.List {
+				field.Names = nil
+			}
+			if len(results.List) == 1 {
+				results.Opening = false
+				results.Closing = false
+			}
+			continue
+		}
+		for _, field := range results.List {
+			for _, name := range field.Names {
+				if strings.HasPrefix(name.Name, genResultPrefix) {
+					name.Name = "_"
+				}
+			}
+		}
+	}
+	return restored
+}
@@ -0,0 +1,111 @@
+package parse
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+)
+
+// userResults is a function with results named like generated ones but
+// without a func-error-count directive, clean must not change it
+const userResults = "\nfunc g() (metrics_gen_n int) {\n\treturn 0\n}\n"
+
+func TestErrorResultName(t *testing.T) {
+	tests := []struct {
+		name     string
+		results  string
+		want     string // name of the error result
+		wantDecl string // results after the renaming
+		wantErr  string
+	}{
+		{
+			name:     "unnamed error",
+			results:  "error",
+			want:     "metrics_gen_err",
+			wantDecl: "(metrics_gen_err error)",
+		},
+		{
+			name:     "unnamed results",
+			results:  "(int, error)",
+			want:     "metrics_gen_err",
+			wantDecl: "(metrics_gen_r0 int, metrics_gen_err error)",
+		},
+		{
+			name:     "named results",
+			results:  "(n int, err error)",
+			want:     "err",
+			wantDecl: "(n int, err error)",
+		},
+		{
+			name:     "results sharing a type",
+			results:  "(a, err error)",
+			want:     "err",
+			wantDecl: "(a, err error)",
+		},
+		{
+			name:     "blank error",
+			results:  "(n int, _ error)",
+			want:     "metrics_gen_err",
+			wantDecl: "(n int, metrics_gen_err error)",
+		},
+		{
+			name:    "error not last",
+			results: "(error, int)",
+			wantErr: "function f does not return an error as its last result",
+		},
+		{
+			name:    "no results",
+			results: "",
+			wantErr: "function f does not return an error as its last result",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := "package main\n\n// +trace:func-error-count\nfunc f() " +
+				tt.results + " {\n\tpanic(0)\n}\n" + userResults
+			info, filename := collectSource(t, src)
+			directives, err := info.FileDirectives(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(directives) != 1 {
+				t.Fatalf("got %d directives, want 1", len(directives))
+			}
+			got, err := info.ErrorResultName(*directives[0])
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got result name %q, want %q", got, tt.want)
+			}
+			patched := printSource(t, info, filename)
+			if !strings.Contains(patched, "func f() "+tt.wantDecl+" {") {
+				t.Errorf("results not renamed to %s:\n%s", tt.wantDecl, patched)
+			}
+
+			// the renaming is undone with the generated code
+			body := directives[0].Declaration().(*dst.FuncDecl).Body
+			stmts := []dst.Stmt{&dst.ExprStmt{X: &dst.CallExpr{Fun: dst.NewIdent("trace")}}}
+			markGenerated(stmts, info.blockBeginUUID(filename, body),
+				EndUUID(info.FileUUID(filename)))
+			body.List = append(stmts, body.List...)
+			generated := printSource(t, info, filename)
+			if marked := strings.Contains(generated, "results=renamed"); marked != (tt.want != "err") {
+				t.Errorf("renamed results marked %v:\n%s", marked, generated)
+			}
+			if _, _, err := removeGenerated(info.FileDst(filename)); err != nil {
+				t.Fatal(err)
+			}
+			if restored := printSource(t, info, filename); restored != src {
+				t.Errorf("restored:\n%s\nwant:\n%s", restored, src)
+			}
+		})
+	}
+}
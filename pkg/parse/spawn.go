@@ -0,0 +1,217 @@
+package parse
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"strconv"
+	"strings"
+
+	"github.com/dave/dst"
+	log "github.com/sirupsen/logrus"
+)
+
+// prefix of the variables that keep the operands of a call spawned by a
+// go-spawn directive, they are removed again with the generated code
+const genSpawnPrefix = genResultPrefix + "spawn_"
+
+// isConstOperand checks if an operand of a call is a constant or nil, which
+// gives the same value whenever it is evaluated
+func (t *CollectInfo) isConstOperand(filename string, expr dst.Expr) bool {
+	if n, pkg := t.astNode(filename, expr); n != nil && pkg.TypesInfo != nil {
+		if tv, ok := pkg.TypesInfo.Types[n.(ast.Expr)]; ok {
+			return tv.Value != nil || tv.IsNil()
+		}
+	}
+	switch e := expr.(type) {
+	case *dst.BasicLit:
+		return true
+	case *dst.Ident:
+		return e.Path == "" &&
+			(e.Name == "nil" || e.Name == "true" || e.Name == "false")
+	}
+	return false
+}
+
+// checkSpawnedFunc returns an error if the function of a spawned call can not
+// be kept in a variable
+func (t *CollectInfo) checkSpawnedFunc(filename string, fun dst.Expr) error {
+	n, pkg := t.astNode(filename, fun)
+	if n == nil || pkg.TypesInfo == nil {
+		return nil
+	}
+	if tv, ok := pkg.TypesInfo.Types[n.(ast.Expr)]; ok && tv.IsBuiltin() {
+		return fmt.Errorf("builtin functions can not be spawned by go-spawn, " +
+			"use go func() { ... }()")
+	}
+	var ident *ast.Ident
+	switch e := n.(type) {
+	case *ast.Ident:
+		ident = e
+	case *ast.SelectorExpr:
+		ident = e.Sel
+	}
+	if _, ok := pkg.TypesInfo.Instances[ident]; ident != nil && ok {
+		return fmt.Errorf("type arguments of %s must be written for go-spawn",
+			ident.Name)
+	}
+	return nil
+}
+
+// SharesSpawnGauge checks if a go-spawn directive uses the variables of
+// another go-spawn directive with the same name in its package, the variables
+// are declared with the first directive of the first file of the package
+func (t *CollectInfo) SharesSpawnGauge(d *Directive) bool {
+	return t.sharesNamedVars(d.filename, t.fileDirectives[d.filename], d)
+}
+
+// SetGoSpawnTracing instruments the go statement of a go-spawn directive.
+// spawnStmts are inserted before the go statement and goroutineStmts at the
+// beginning of the spawned goroutine. A spawned function literal gets the
+// statements at the beginning of its body. Other calls are wrapped in a
+// function literal, their function and operands that are not constant are
+// kept in variables before so that they are still evaluated when the goroutine
+// is spawned.
+func (t *CollectInfo) SetGoSpawnTracing(d Directive,
+	globalDecl []dst.Decl,
+	spawnStmts []dst.Stmt,
+	goroutineStmts []dst.Stmt,
+	pkgsIn map[string]*PackageInfo,
+	pkgPatchTable []*dst.Ident,
+) error {
+	// deep copy pkgs
+	pkgs := make(map[string]*PackageInfo)
+	for k, v := range pkgsIn {
+		pkgs[k] = &PackageInfo{
+			Name: v.Name,
+			Path: v.Path,
+		}
+	}
+
+	goStmt, ok := d.stmt.(*dst.GoStmt)
+	if !ok {
+		return fmt.Errorf("go-spawn must be placed before a go statement")
+	}
+	list, idx := findStmt(d.declaration.(*dst.FuncDecl).Body, d.stmt)
+	if list == nil {
+		// a labeled go statement is not in a statement list
+		return fmt.Errorf("statement of the directive not found")
+	}
+
+	if lit, ok := goStmt.Call.Fun.(*dst.FuncLit); ok {
+		markGenerated(goroutineStmts, t.blockBeginUUID(d.filename, lit.Body),
+			EndUUID(t.FileUUID(d.filename)))
+		lit.Body.List = append(goroutineStmts, lit.Body.List...)
+	} else {
+		markGenerated(goroutineStmts, BeginUUID(t.FileUUID(d.filename)),
+			EndUUID(t.FileUUID(d.filename)))
+		call := goStmt.Call
+		if err := t.checkSpawnedFunc(d.filename, call.Fun); err != nil {
+			return err
+		}
+
+		// fn, arg0 := f, x
+		// go func() { ...; fn(arg0, 1) }()
+		assign := &dst.AssignStmt{Tok: token.DEFINE}
+		id := t.DirectiveID(&d)
+		keep := func(expr dst.Expr, suffix string) dst.Expr {
+			name := fmt.Sprintf("%s%s_%s", genSpawnPrefix, id, suffix)
+			assign.Lhs = append(assign.Lhs, dst.NewIdent(name))
+			assign.Rhs = append(assign.Rhs, expr)
+			return dst.NewIdent(name)
+		}
+		// the function is always kept, the wrapped call is found with it
+		call.Fun = keep(call.Fun, "fn")
+		for i, arg := range call.Args {
+			if !t.isConstOperand(d.filename, arg) {
+				call.Args[i] = keep(arg, strconv.Itoa(i))
+			}
+		}
+		spawnStmts = append(spawnStmts, assign)
+		goStmt.Call = &dst.CallExpr{
+			Fun: &dst.FuncLit{
+				Type: &dst.FuncType{Func: true, Params: &dst.FieldList{}},
+				Body: &dst.BlockStmt{
+					List: append(goroutineStmts, &dst.ExprStmt{X: call}),
+				},
+			},
+		}
+	}
+	log.Debugf("add go-spawn tracing in %s", d.filename)
+
+	if err := t.insertBeforeDirective(d, list, idx, spawnStmts); err != nil {
+		return err
+	}
+	if err := t.addPkgImports(d.filename, pkgs, pkgPatchTable); err != nil {
+		return err
+	}
+	return t.insertInnerDecls(d.filename, globalDecl)
+}
+
+// spawnedCall returns the call wrapped by SetGoSpawnTracing in a go
+// statement, or nil if the go statement was not changed
+func spawnedCall(goStmt *dst.GoStmt) *dst.CallExpr {
+	lit, ok := goStmt.Call.Fun.(*dst.FuncLit)
+	if !ok || len(goStmt.Call.Args) != 0 || len(lit.Body.List) == 0 {
+		return nil
+	}
+	stmt, ok := lit.Body.List[len(lit.Body.List)-1].(*dst.ExprStmt)
+	if !ok {
+		return nil
+	}
+	call, ok := stmt.X.(*dst.CallExpr)
+	if !ok {
+		return nil
+	}
+	if ident, ok := call.Fun.(*dst.Ident); !ok ||
+		!strings.HasPrefix(ident.Name, genSpawnPrefix) {
+		return nil
+	}
+	return call
+}
+
+// restoreSpawns undoes the wrapping of the calls spawned by go-spawn
+// directives and returns the number of restored go statements. It has to run
+// before the generated statements that keep the operands are removed.
+func restoreSpawns(file *dst.File) int {
+	operands := make(map[string]dst.Expr)
+	goStmts := []*dst.GoStmt{}
+	dst.Inspect(file, func(n dst.Node) bool {
+		switch node := n.(type) {
+		case *dst.AssignStmt:
+			for idx, lhs := range node.Lhs {
+				ident, ok := lhs.(*dst.Ident)
+				if ok && strings.HasPrefix(ident.Name, genSpawnPrefix) &&
+					idx < len(node.Rhs) {
+					operands[ident.Name] = node.Rhs[idx]
+				}
+			}
+		case *dst.GoStmt:
+			goStmts = append(goStmts, node)
+		}
+		return true
+	})
+
+	restored := 0
+	restore := func(expr dst.Expr) dst.Expr {
+		if ident, ok := expr.(*dst.Ident); ok {
+			if v, ok := operands[ident.Name]; ok {
+				return v
+			}
+		}
+		return expr
+	}
+	for _, goStmt := range goStmts {
+		call := spawnedCall(goStmt)
+		if call == nil {
+			continue
+		}
+		call.Fun = restore(call.Fun)
+		for i, arg := range call.Args {
+			call.Args[i] = restore(arg)
+		}
+		goStmt.Call = call
+		restored++
+	}
+	return restored
+}
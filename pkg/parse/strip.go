@@ -0,0 +1,407 @@
+package parse
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"sort"
+	"strings"
+)
+
+// sourceEdit replaces the bytes between two offsets of a source
+type sourceEdit struct {
+	start, end int
+	text       string
+}
+
+// CleanSource returns the content of a file on disk without its generated
+// code. The generated blocks are cut out of the source instead of printing the
+// file again, so the rest of the file keeps its formatting byte for byte.
+func (t *CollectInfo) CleanSource(filename string) ([]byte, error) {
+	src, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	res, err := stripGeneratedSource(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return res, nil
+}
+
+// stripGeneratedSource removes the generated blocks, the wrapping of spawned
+// calls, the generated result names and the imports only used by the
+// generated code from a source
+func stripGeneratedSource(src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "", src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	offset := func(pos token.Pos) int { return fset.Position(pos).Offset }
+
+	edits, err := generatedBlockEdits(src, file, offset)
+	if err != nil {
+		return nil, err
+	}
+	edits = append(edits, spawnEdits(src, file, offset)...)
+	edits = append(edits, resultNameEdits(src, file, offset)...)
+	if len(edits) == 0 {
+		return src, nil
+	}
+	res := applyEdits(src, edits)
+
+	// the imports are only unused once the generated code is gone
+	fset = token.NewFileSet()
+	file, err = parser.ParseFile(fset, "", res, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("invalid source without generated code: %v", err)
+	}
+	return applyEdits(res, unusedImportEdits(res, file, offset)), nil
+}
+
+// generatedBlockEdits returns the edits removing the lines from every
+// begin-generated marker to its end-generated marker. Blocks that were on a
+// single line are joined again.
+func generatedBlockEdits(src []byte, file *ast.File,
+	offset func(token.Pos) int,
+) ([]sourceEdit, error) {
+	edits := []sourceEdit{}
+	oneLine := []token.Pos{}
+	begin := -1
+	for _, group := range file.Comments {
+		for _, comment := range group.List {
+			traceType, _ := ParseStringDirectiveType(comment.Text)
+			switch traceType {
+			case GenBegine:
+				if begin != -1 {
+					return nil, fmt.Errorf("nested begin-generated marker")
+				}
+				begin = lineStart(src, offset(comment.Pos()))
+				if params, _ := ParseDirectiveParams(comment.Text); params["oneline"] == "true" {
+					oneLine = append(oneLine, comment.Pos())
+				}
+			case GenEnd:
+				if begin == -1 {
+					return nil, fmt.Errorf("end-generated marker without begin-generated")
+				}
+				edits = append(edits, sourceEdit{
+					start: begin,
+					end:   lineEnd(src, offset(comment.End())),
+				})
+				begin = -1
+			}
+		}
+	}
+	if begin != -1 {
+		return nil, fmt.Errorf("begin-generated marker without end-generated")
+	}
+
+	for _, pos := range oneLine {
+		// the innermost block around the marker
+		var block *ast.BlockStmt
+		ast.Inspect(file, func(n ast.Node) bool {
+			if n == nil || n.Pos() > pos || n.End() <= pos {
+				return false
+			}
+			if b, ok := n.(*ast.BlockStmt); ok {
+				block = b
+			}
+			return true
+		})
+		if block == nil {
+			continue
+		}
+		start, end := offset(block.Lbrace), offset(block.Rbrace)+1
+		inner := []sourceEdit{}
+		for _, edit := range edits {
+			if edit.start > start && edit.end < end {
+				inner = append(inner, sourceEdit{start: edit.start - start, end: edit.end - start})
+			}
+		}
+		stmts := []string{}
+		body := applyEdits(src[start:end], inner)
+		for _, line := range strings.Split(string(body[1:len(body)-1]), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				stmts = append(stmts, line)
+			}
+		}
+		text := "{}"
+		if len(stmts) != 0 {
+			text = "{ " + strings.Join(stmts, "; ") + " }"
+		}
+		edits = append(edits, sourceEdit{start: start, end: end, text: text})
+	}
+	return edits, nil
+}
+
+// spawnEdits returns the edits restoring the calls wrapped by go-spawn
+// directives with the operands kept by the generated code
+func spawnEdits(src []byte, file *ast.File,
+	offset func(token.Pos) int,
+) []sourceEdit {
+	text := func(node ast.Node) string {
+		return string(src[offset(node.Pos()):offset(node.End())])
+	}
+	operands := make(map[string]string)
+	goStmts := []*ast.GoStmt{}
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch node := n.(type) {
+		case *ast.AssignStmt:
+			for idx, lhs := range node.Lhs {
+				ident, ok := lhs.(*ast.Ident)
+				if ok && strings.HasPrefix(ident.Name, genSpawnPrefix) &&
+					idx < len(node.Rhs) {
+					operands[ident.Name] = text(node.Rhs[idx])
+				}
+			}
+		case *ast.GoStmt:
+			goStmts = append(goStmts, node)
+		}
+		return true
+	})
+
+	restore := func(expr ast.Expr) string {
+		if ident, ok := expr.(*ast.Ident); ok {
+			if v, ok := operands[ident.Name]; ok {
+				return v
+			}
+		}
+		return text(expr)
+	}
+	edits := []sourceEdit{}
+	for _, goStmt := range goStmts {
+		call := spawnedAstCall(goStmt)
+		if call == nil {
+			continue
+		}
+		args := []string{}
+		for _, arg := range call.Args {
+			args = append(args, restore(arg))
+		}
+		ellipsis := ""
+		if call.Ellipsis.IsValid() {
+			ellipsis = "..."
+		}
+		edits = append(edits, sourceEdit{
+			start: offset(goStmt.Call.Pos()),
+			end:   offset(goStmt.Call.End()),
+			text: fmt.Sprintf("%s(%s%s)", restore(call.Fun),
+				strings.Join(args, ", "), ellipsis),
+		})
+	}
+	return edits
+}
+
+// spawnedAstCall returns the call wrapped by SetGoSpawnTracing in a go
+// statement, or nil if the go statement was not changed
+func spawnedAstCall(goStmt *ast.GoStmt) *ast.CallExpr {
+	lit, ok := goStmt.Call.Fun.(*ast.FuncLit)
+	if !ok || len(goStmt.Call.Args) != 0 || len(lit.Body.List) == 0 {
+		return nil
+	}
+	stmt, ok := lit.Body.List[len(lit.Body.List)-1].(*ast.ExprStmt)
+	if !ok {
+		return nil
+	}
+	call, ok := stmt.X.(*ast.CallExpr)
+	if !ok {
+		return nil
+	}
+	if ident, ok := call.Fun.(*ast.Ident); !ok ||
+		!strings.HasPrefix(ident.Name, genSpawnPrefix) {
+		return nil
+	}
+	return call
+}
+
+// resultNameEdits returns the edits undoing the result renaming of
+// ErrorResultName in the functions whose generated code is marked
+func resultNameEdits(src []byte, file *ast.File,
+	offset func(token.Pos) int,
+) []sourceEdit {
+	renamed := func(body *ast.BlockStmt) bool {
+		if body == nil {
+			return false
+		}
+		for _, group := range file.Comments {
+			if group.Pos() < body.Lbrace || group.End() > body.Rbrace {
+				continue
+			}
+			for _, comment := range group.List {
+				if isRenamedResultsMarker(comment.Text) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	edits := []sourceEdit{}
+	for _, decl := range file.Decls {
+		funcDecl, ok := decl.(*ast.FuncDecl)
+		if !ok || funcDecl.Type.Results == nil || !renamed(funcDecl.Body) {
+			continue
+		}
+		results := funcDecl.Type.Results
+		generated := []*ast.Ident{}
+		total := 0
+		for _, field := range results.List {
+			for _, name := range field.Names {
+				total++
+				if strings.HasPrefix(name.Name, genResultPrefix) {
+					generated = append(generated, name)
+				}
+			}
+		}
+		if len(generated) == 0 {
+			continue
+		}
+
+		if len(generated) != total {
+			// a blank error result was renamed
+			for _, name := range generated {
+				edits = append(edits, sourceEdit{
+					start: offset(name.Pos()),
+					end:   offset(name.End()),
+					text:  "_",
+				})
+			}
+			continue
+		}
+		// all the results were unnamed, the generator names every field
+		types := []string{}
+		for _, field := range results.List {
+			types = append(types, string(src[offset(field.Type.Pos()):offset(field.Type.End())]))
+		}
+		text := strings.Join(types, ", ")
+		if len(types) != 1 {
+			text = "(" + text + ")"
+		}
+		edits = append(edits, sourceEdit{
+			start: offset(results.Pos()),
+			end:   offset(results.End()),
+			text:  text,
+		})
+	}
+	return edits
+}
+
+// unusedImportEdits returns the edits removing the imports that are not
+// referenced in a file
+func unusedImportEdits(src []byte, file *ast.File,
+	offset func(token.Pos) int,
+) []sourceEdit {
+	used := make(map[string]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		switch node := n.(type) {
+		case *ast.ImportSpec:
+			return false
+		case *ast.Ident:
+			used[node.Name] = true
+		}
+		return true
+	})
+	unused := func(spec *ast.ImportSpec) bool {
+		name := importAstName(spec)
+		if name == "" || name == "_" || name == "." {
+			return false
+		}
+		return !used[name]
+	}
+	lines := func(node ast.Node) sourceEdit {
+		return sourceEdit{
+			start: lineStart(src, offset(node.Pos())),
+			end:   lineEnd(src, offset(node.End())),
+		}
+	}
+
+	edits := []sourceEdit{}
+	for _, decl := range file.Decls {
+		genDecl, ok := decl.(*ast.GenDecl)
+		if !ok || genDecl.Tok != token.IMPORT {
+			continue
+		}
+		removed := []sourceEdit{}
+		for _, spec := range genDecl.Specs {
+			if unused(spec.(*ast.ImportSpec)) {
+				removed = append(removed, lines(spec))
+			}
+		}
+		if len(removed) == len(genDecl.Specs) {
+			edits = append(edits, lines(genDecl))
+		} else if genDecl.Lparen.IsValid() {
+			edits = append(edits, removed...)
+		}
+	}
+	return edits
+}
+
+// importAstName returns the name used to refer to an import in the file. It
+// returns an empty string if the name can not be known without loading the
+// package.
+func importAstName(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	path := strings.Trim(spec.Path.Value, `"`)
+	if !strings.Contains(path, "/") && !strings.Contains(path, ".") {
+		// standard library packages are named after their path
+		return path
+	}
+	return ""
+}
+
+// applyEdits applies edits to a source. Edits inside another edit are dropped.
+// Removing lines never leaves two empty lines in a row, which gofmt would not
+// print either.
+func applyEdits(src []byte, edits []sourceEdit) []byte {
+	sort.SliceStable(edits, func(i, j int) bool {
+		if edits[i].start != edits[j].start {
+			return edits[i].start < edits[j].start
+		}
+		return edits[i].end > edits[j].end
+	})
+	var buf bytes.Buffer
+	cuts := []int{}
+	last := 0
+	for _, edit := range edits {
+		if edit.start < last {
+			continue
+		}
+		buf.Write(src[last:edit.start])
+		buf.WriteString(edit.text)
+		if edit.text == "" {
+			cuts = append(cuts, buf.Len())
+		}
+		last = edit.end
+	}
+	buf.Write(src[last:])
+
+	res := buf.Bytes()
+	for idx := len(cuts) - 1; idx >= 0; idx-- {
+		cut := cuts[idx]
+		if cut >= 2 && cut < len(res) && res[cut] == '\n' &&
+			res[cut-1] == '\n' && res[cut-2] == '\n' {
+			res = append(res[:cut], res[cut+1:]...)
+		}
+	}
+	return res
+}
+
+// lineStart returns the offset of the beginning of the line of an offset
+func lineStart(src []byte, offset int) int {
+	return bytes.LastIndexByte(src[:offset], '\n') + 1
+}
+
+// lineEnd returns the offset after the end of the line of an offset,
+// including the newline
+func lineEnd(src []byte, offset int) int {
+	if idx := bytes.IndexByte(src[offset:], '\n'); idx != -1 {
+		return offset + idx + 1
+	}
+	return len(src)
+}
@@ -0,0 +1,255 @@
+package parse
+
+import "testing"
+
+const testBegin = "// +trace:begin-generated uuid=1"
+
+const testEnd = "// +trace:end-generated uuid=1"
+
+func TestStripGeneratedSource(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			name: "one-line body",
+			src: `package main
+
+import "time"
+
+func (b *Box[T]) Get() T {
+	` + testBegin + ` oneline=true
+	defer observe(time.Now())
+	` + testEnd + `
+	return b.v
+}
+`,
+			want: `package main
+
+func (b *Box[T]) Get() T { return b.v }
+`,
+		},
+		{
+			name: "empty one-line body",
+			src: `package main
+
+func f() {
+	` + testBegin + ` oneline=true
+	defer done()
+	` + testEnd + `
+}
+`,
+			want: `package main
+
+func f() {}
+`,
+		},
+		{
+			name: "empty body on two lines",
+			src: `package main
+
+func f() {
+	` + testBegin + `
+	defer done()
+	` + testEnd + `
+}
+`,
+			want: `package main
+
+func f() {
+}
+`,
+		},
+		{
+			name: "adjacent blocks and empty lines",
+			src: `package main
+
+func f() {
+	x := 1
+
+	// +trace:inner-counter
+	` + testBegin + `
+	inc()
+	` + testEnd + `
+	use(x)
+}
+
+` + testBegin + `
+var a int
+
+` + testEnd + `
+
+` + testBegin + `
+var b int
+
+` + testEnd + `
+
+func g() {}
+`,
+			want: `package main
+
+func f() {
+	x := 1
+
+	// +trace:inner-counter
+	use(x)
+}
+
+func g() {}
+`,
+		},
+		{
+			name: "spawned call",
+			src: `package main
+
+func f(n int) {
+	// +trace:go-spawn
+	` + testBegin + `
+	metrics_gen_spawn_1_fn, metrics_gen_spawn_1_0, metrics_gen_spawn_1_2 := work, n, []int{n}
+	` + testEnd + `
+	go func() {
+		` + testBegin + `
+		defer done()
+		` + testEnd + `
+		metrics_gen_spawn_1_fn(metrics_gen_spawn_1_0, 1, metrics_gen_spawn_1_2...)
+	}()
+}
+`,
+			want: `package main
+
+func f(n int) {
+	// +trace:go-spawn
+	go work(n, 1, []int{n}...)
+}
+`,
+		},
+		{
+			name: "result names",
+			src: `package main
+
+func f() (metrics_gen_err error) {
+	` + testBegin + ` results=renamed
+	defer count(metrics_gen_err)
+	` + testEnd + `
+	return nil
+}
+
+func g() (metrics_gen_r0 int, metrics_gen_err error) {
+	` + testBegin + ` results=renamed
+	defer count(metrics_gen_err)
+	` + testEnd + `
+	return 0, nil
+}
+
+func h() (n int, metrics_gen_err error) {
+	` + testBegin + ` results=renamed
+	defer count(metrics_gen_err)
+	` + testEnd + `
+	return 0, nil
+}
+
+func user() (metrics_gen_n int, _ error) {
+	return 0, nil
+}
+`,
+			want: `package main
+
+func f() error {
+	return nil
+}
+
+func g() (int, error) {
+	return 0, nil
+}
+
+func h() (n int, _ error) {
+	return 0, nil
+}
+
+func user() (metrics_gen_n int, _ error) {
+	return 0, nil
+}
+`,
+		},
+		{
+			name: "imports of generated code",
+			src: `package main
+
+import "sync"
+import prometheus "github.com/prometheus/client_golang/prometheus"
+
+import (
+	"fmt"
+	"time"
+)
+
+` + testBegin + `
+var m sync.Mutex
+var c prometheus.Counter
+
+` + testEnd + `
+func f() {
+	fmt.Println(time.Now())
+}
+`,
+			want: `package main
+
+import (
+	"fmt"
+	"time"
+)
+
+func f() {
+	fmt.Println(time.Now())
+}
+`,
+		},
+		{
+			name: "no generated code",
+			src: `package main
+
+func f() { g() }
+`,
+			want: `package main
+
+func f() { g() }
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := stripGeneratedSource([]byte(tt.src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// unbalanced markers are reported instead of cutting out original code
+func TestStripGeneratedSourceErrors(t *testing.T) {
+	tests := map[string]string{
+		"nested begin-generated marker": `
+	` + testBegin + `
+	` + testBegin + `
+	g()
+	` + testEnd,
+		"end-generated marker without begin-generated": `
+	g()
+	` + testEnd,
+		"begin-generated marker without end-generated": `
+	` + testBegin + `
+	g()`,
+	}
+	for want, body := range tests {
+		src := "package main\n\nfunc f() {" + body + "\n}\n"
+		got, err := stripGeneratedSource([]byte(src))
+		if err == nil || err.Error() != want {
+			t.Errorf("got error %v, want %q, result:\n%s", err, want, got)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package platform
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Buckets are the upper bounds of histogram buckets, either listed or
+// generated from a start value
+type Buckets struct {
+	Func   string    // "" for listed bounds, "exp" or "lin"
+	Values []float64 // bounds, or start, factor or width and count
+}
+
+// ParseBuckets parses histogram buckets written as a list of bounds
+// "0.005,0.01,0.1", as exponential buckets "exp:start,factor,count" or as
+// linear buckets "lin:start,width,count"
+func ParseBuckets(text string) (*Buckets, error) {
+	res := &Buckets{}
+	if idx := strings.Index(text, ":"); idx != -1 {
+		res.Func = text[:idx]
+		text = text[idx+1:]
+		if res.Func != "exp" && res.Func != "lin" {
+			return nil, fmt.Errorf("unknown buckets function %q, use exp or lin",
+				res.Func)
+		}
+	}
+	for _, item := range strings.Split(text, ",") {
+		v, err := strconv.ParseFloat(strings.TrimSpace(item), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", item)
+		}
+		res.Values = append(res.Values, v)
+	}
+
+	switch res.Func {
+	case "":
+		for idx := 1; idx < len(res.Values); idx++ {
+			if res.Values[idx] <= res.Values[idx-1] {
+				return nil, fmt.Errorf("buckets must be in increasing order")
+			}
+		}
+	default:
+		if len(res.Values) != 3 {
+			return nil, fmt.Errorf("%s buckets need start, %s and count",
+				res.Func, map[string]string{"exp": "factor", "lin": "width"}[res.Func])
+		}
+		count := res.Values[2]
+		if count < 1 || count != float64(int(count)) {
+			return nil, fmt.Errorf("bucket count must be a positive integer")
+		}
+		if res.Func == "exp" && (res.Values[0] <= 0 || res.Values[1] <= 1) {
+			return nil, fmt.Errorf("exp buckets need a positive start and " +
+				"a factor greater than 1")
+		}
+		if res.Func == "lin" && res.Values[1] <= 0 {
+			return nil, fmt.Errorf("lin buckets need a positive width")
+		}
+	}
+	return res, nil
+}
+
+// Objective is a quantile of a summary and its absolute error
+type Objective struct {
+	Quantile float64
+	Error    float64
+}
+
+// ParseObjectives parses summary objectives written as "quantile:error,..."
+func ParseObjectives(text string) ([]Objective, error) {
+	res := []Objective{}
+	for _, item := range strings.Split(text, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("objective %q must be written as "+
+				"quantile:error", item)
+		}
+		q, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || q <= 0 || q >= 1 {
+			return nil, fmt.Errorf("quantile %q must be a number between 0 and 1",
+				parts[0])
+		}
+		e, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || e < 0 || e >= 1 {
+			return nil, fmt.Errorf("error %q must be a number between 0 and 1",
+				parts[1])
+		}
+		res = append(res, Objective{Quantile: q, Error: e})
+	}
+	return res, nil
+}
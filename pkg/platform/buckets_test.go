@@ -0,0 +1,73 @@
+package platform
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBuckets(t *testing.T) {
+	tests := map[string]*Buckets{
+		"0.005, 0.01,0.1": {Values: []float64{0.005, 0.01, 0.1}},
+		"1":               {Values: []float64{1}},
+		"exp:0.001,2,10":  {Func: "exp", Values: []float64{0.001, 2, 10}},
+		"lin:0,0.5,4":     {Func: "lin", Values: []float64{0, 0.5, 4}},
+	}
+	for text, want := range tests {
+		got, err := ParseBuckets(text)
+		if err != nil {
+			t.Errorf("%q: %v", text, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: got %+v, want %+v", text, got, want)
+		}
+	}
+
+	errs := map[string]string{
+		"0.1,0.1":     "buckets must be in increasing order",
+		"1,0.5":       "buckets must be in increasing order",
+		"0.1,fast":    `"fast" is not a number`,
+		"":            `"" is not a number`,
+		"log:1,2,3":   `unknown buckets function "log", use exp or lin`,
+		"exp:1,2":     "exp buckets need start, factor and count",
+		"lin:1,2,3,4": "lin buckets need start, width and count",
+		"exp:1,2,0":   "bucket count must be a positive integer",
+		"lin:0,1,2.5": "bucket count must be a positive integer",
+		"exp:0,2,3":   "exp buckets need a positive start and a factor greater than 1",
+		"exp:1,1,3":   "exp buckets need a positive start and a factor greater than 1",
+		"lin:0,0,3":   "lin buckets need a positive width",
+	}
+	for text, want := range errs {
+		if _, err := ParseBuckets(text); err == nil || err.Error() != want {
+			t.Errorf("%q: got error %v, want %q", text, err, want)
+		}
+	}
+}
+
+func TestParseObjectives(t *testing.T) {
+	got, err := ParseObjectives("0.5:0.05, 0.99:0.001,0.9:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Objective{
+		{Quantile: 0.5, Error: 0.05},
+		{Quantile: 0.99, Error: 0.001},
+		{Quantile: 0.9, Error: 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+
+	errs := map[string]string{
+		"0.5":         `objective "0.5" must be written as quantile:error`,
+		"0.5:0.1:0.2": `objective "0.5:0.1:0.2" must be written as quantile:error`,
+		"1:0.01":      `quantile "1" must be a number between 0 and 1`,
+		"0:0.01":      `quantile "0" must be a number between 0 and 1`,
+		"median:0.01": `quantile "median" must be a number between 0 and 1`,
+		"0.5:1":       `error "1" must be a number between 0 and 1`,
+		"0.5:-0.1":    `error "-0.1" must be a number between 0 and 1`,
+	}
+	for text, want := range errs {
+		if _, err := ParseObjectives(text); err == nil || err.Error() != want {
+			t.Errorf("%q: got error %v, want %q", text, err, want)
+		}
+	}
+}
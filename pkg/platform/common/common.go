@@ -16,12 +16,14 @@ func MetricsProviderFactory(
 			config.Suffix,
 			config.DryRun,
 			config.MetricsPrefix,
+			config.OverlayDir,
 		)
 	case "gometrics":
 		return gometrics.NewGoMetricsProvider(
 			config.Inplace,
 			config.Suffix,
 			config.DryRun,
+			config.OverlayDir,
 		)
 	default:
 		return nil
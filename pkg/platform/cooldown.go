@@ -0,0 +1,163 @@
+package platform
+
+import (
+	"fmt"
+	"go/token"
+	"time"
+
+	"github.com/dave/dst"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+)
+
+// CooldownPeriod returns the cooldown of a directive, or 0 if every call is
+// measured. gm-cooldown-time is the deprecated name of the parameter.
+func CooldownPeriod(directive *parse.Directive) (time.Duration, error) {
+	name := "cooldown"
+	v, ok := directive.Param(name)
+	if !ok {
+		name = "gm-cooldown-time"
+		if v, ok = directive.Param(name); !ok {
+			return 0, nil
+		}
+	}
+	cooldown, err := time.ParseDuration(v)
+	if err != nil || cooldown < 0 {
+		return 0, fmt.Errorf("invalid %s %q, use a duration like \"10s\"",
+			name, v)
+	}
+	return cooldown, nil
+}
+
+// timestampDecl returns the declaration of the variable that keeps the unix
+// time in nanoseconds of the last run of statements limited by onceEveryStmt
+//
+//	var name int64
+func timestampDecl(varName string) dst.Decl {
+	return &dst.GenDecl{
+		Tok: token.VAR,
+		Specs: []dst.Spec{
+			&dst.ValueSpec{
+				Names: []*dst.Ident{dst.NewIdent(varName)},
+				Type:  dst.NewIdent("int64"),
+			},
+		},
+	}
+}
+
+// onceEveryStmt returns the statement that runs stmts if they did not run
+// within the interval. The time of the last run is swapped atomically in the
+// timestamp variable, so only one of concurrent calls runs them. The local
+// variables are named after the timestamp variable so that they do not shadow
+// the variables used by stmts. The returned idents have to be added to the
+// patch table.
+//
+//	if name_now, name_last := time.Now().UnixNano(), atomic.LoadInt64(&name); name_now-name_last >= int64(10 * time.Second) &&
+//		atomic.CompareAndSwapInt64(&name, name_last, name_now) {
+//		stmts...
+//	}
+func onceEveryStmt(varName string, interval time.Duration,
+	stmts []dst.Stmt,
+) (dst.Stmt, []*dst.Ident) {
+	now := fmt.Sprintf("%s_now", varName)
+	last := fmt.Sprintf("%s_last", varName)
+	timePkg := dst.NewIdent("time")
+	loadPkg := dst.NewIdent("atomic")
+	swapPkg := dst.NewIdent("atomic")
+	intervalExpr, intervalPkg := DurationExpr(interval)
+	timestamp := func() dst.Expr {
+		return &dst.UnaryExpr{Op: token.AND, X: dst.NewIdent(varName)}
+	}
+	return &dst.IfStmt{
+		Init: &dst.AssignStmt{
+			Lhs: []dst.Expr{dst.NewIdent(now), dst.NewIdent(last)},
+			Tok: token.DEFINE,
+			Rhs: []dst.Expr{
+				&dst.CallExpr{
+					Fun: &dst.SelectorExpr{
+						X: &dst.CallExpr{
+							Fun: &dst.SelectorExpr{
+								X:   timePkg,
+								Sel: dst.NewIdent("Now"),
+							},
+						},
+						Sel: dst.NewIdent("UnixNano"),
+					},
+				},
+				&dst.CallExpr{
+					Fun:  &dst.SelectorExpr{X: loadPkg, Sel: dst.NewIdent("LoadInt64")},
+					Args: []dst.Expr{timestamp()},
+				},
+			},
+		},
+		Cond: &dst.BinaryExpr{
+			X: &dst.BinaryExpr{
+				X: &dst.BinaryExpr{
+					X:  dst.NewIdent(now),
+					Op: token.SUB,
+					Y:  dst.NewIdent(last),
+				},
+				Op: token.GEQ,
+				Y: &dst.CallExpr{
+					Fun:  dst.NewIdent("int64"),
+					Args: []dst.Expr{intervalExpr},
+				},
+			},
+			Op: token.LAND,
+			Y: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   swapPkg,
+					Sel: dst.NewIdent("CompareAndSwapInt64"),
+				},
+				Args: []dst.Expr{
+					timestamp(),
+					dst.NewIdent(last),
+					dst.NewIdent(now),
+				},
+			},
+		},
+		Body: &dst.BlockStmt{List: stmts},
+	}, []*dst.Ident{timePkg, loadPkg, swapPkg, intervalPkg}
+}
+
+// Cooldown makes the statements of a directive with a cooldown parameter skip
+// the calls that start within the cooldown after the last measured call. The
+// skipped calls are not measured at all, their durations are not aggregated
+// into the next observation.
+//
+//	var filename_id_last_measured int64
+//
+//	if ...; ..._now-..._last >= int64(5 * time.Second) && ... {
+//		stmts...
+//	}
+func Cooldown(d *parse.CollectInfo, directive *parse.Directive,
+	globalDecl []dst.Decl, stmts []dst.Stmt, patchTable []*dst.Ident,
+) ([]dst.Decl, []dst.Stmt, []*dst.Ident, error) {
+	cooldown, err := CooldownPeriod(directive)
+	if err != nil || cooldown == 0 {
+		return globalDecl, stmts, patchTable, err
+	}
+
+	timestamp := fmt.Sprintf("%s_%s_last_measured",
+		FileName(d, directive.Filename()), d.DirectiveID(directive))
+	stmt, idents := onceEveryStmt(timestamp, cooldown, stmts)
+	return append(globalDecl, timestampDecl(timestamp)), []dst.Stmt{stmt},
+		append(patchTable, idents...), nil
+}
+
+// PkgsWithCooldown returns pkgs with the packages needed by the cooldown of a
+// directive added
+func PkgsWithCooldown(pkgs map[string]*parse.PackageInfo,
+	directive *parse.Directive,
+) map[string]*parse.PackageInfo {
+	if cooldown, err := CooldownPeriod(directive); err != nil || cooldown == 0 {
+		return pkgs
+	}
+	res := map[string]*parse.PackageInfo{
+		"time":   {Name: "time", Path: "time"},
+		"atomic": {Name: "atomic", Path: "sync/atomic"},
+	}
+	for k, v := range pkgs {
+		res[k] = v
+	}
+	return res
+}
@@ -0,0 +1,150 @@
+package gometrics
+
+import (
+	"fmt"
+
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/platform"
+)
+
+// funcKey returns the key of the metric of a function directive, the name
+// parameter if given, otherwise the file, the function and the suffix
+func funcKey(directive *parse.Directive, filename string, funcName string,
+	suffix string,
+) string {
+	if v, ok := directive.Param("name"); ok {
+		if v == funcName {
+			return fmt.Sprintf("fn_%s", funcName)
+		}
+		return v
+	}
+	return fmt.Sprintf("%s#%s#%s", filename, funcName, suffix)
+}
+
+// funcTimeKey returns the key of the durations of a function. The durations
+// measured with a cooldown are named after the name parameter, the other ones
+// after the file and the function.
+func funcTimeKey(directive *parse.Directive, filename string, funcName string,
+	cooldown bool,
+) string {
+	if !cooldown {
+		return fmt.Sprintf("%s#%s", filename, funcName)
+	}
+	if v, ok := directive.Param("name"); ok {
+		if v == funcName {
+			return fmt.Sprintf("fn_%s", funcName)
+		}
+		return v
+	}
+	return fmt.Sprintf("%s_%s", filename, funcName)
+}
+
+// inFlightNames returns the variable that keeps the value of the in-flight
+// gauge of a function and the key of the gauge
+func inFlightNames(directive *parse.Directive, filename string,
+	funcName string,
+) (string, string) {
+	key := funcKey(directive, filename, funcName, "in_flight")
+	if _, ok := directive.Param("name"); ok {
+		return key, key
+	}
+	return fmt.Sprintf("%s_%s_in_flight", filename, funcName), key
+}
+
+// chanDepthName returns the name the keys of the gauges of a chan-depth
+// directive start with
+func chanDepthName(filename string, varName string,
+	directive *parse.Directive,
+) string {
+	if v, ok := directive.Param("name"); ok && v != "" {
+		return v
+	}
+	return fmt.Sprintf("%s_%s", filename, varName)
+}
+
+// GeneratedNames implements platform.Namer. go-metrics takes the labels with
+// every update, so only the kinds of the metrics with the same key have to
+// match. Only the in-flight gauges named after the name parameter declare
+// variables that can collide, the directives with the same name in a package
+// share them.
+func (g *goMetricsProvider) GeneratedNames(d *parse.CollectInfo,
+	directive *parse.Directive,
+) []platform.GeneratedName {
+	filename := platform.FileName(d, directive.Filename())
+	funcName := platform.FuncName(d, directive)
+	name, _ := directive.Param("name")
+	metric := func(key string, kind string) platform.GeneratedName {
+		return platform.GeneratedName{Metric: key, Kind: kind}
+	}
+
+	switch directive.TraceType() {
+	case parse.FuncExecTime, parse.InnerExecTime:
+		cooldown, err := platform.CooldownPeriod(directive)
+		if err != nil {
+			return nil
+		}
+		return []platform.GeneratedName{
+			metric(funcTimeKey(directive, filename, funcName, cooldown != 0),
+				"sample"),
+		}
+	case parse.FuncErrorCount:
+		return []platform.GeneratedName{
+			metric(funcKey(directive, filename, funcName, "errors"), "counter"),
+		}
+	case parse.FuncPanicCount:
+		return []platform.GeneratedName{
+			metric(funcKey(directive, filename, funcName, "panics"), "counter"),
+		}
+	case parse.FuncInFlight:
+		varName, key := inFlightNames(directive, filename, funcName)
+		if d.SharesInFlightGauge(directive) {
+			varName = ""
+		}
+		return []platform.GeneratedName{
+			{Ident: varName, Metric: key, Kind: "gauge"},
+		}
+	case parse.InnerGauge, parse.InnerObserve:
+		if name == "" {
+			return nil
+		}
+		kind := "gauge"
+		if directive.TraceType() == parse.InnerObserve {
+			kind = "sample"
+		}
+		return []platform.GeneratedName{
+			metric(fmt.Sprintf("%s#%s#%s", filename, funcName, name), kind),
+		}
+	case parse.RegionBegin:
+		if name == "" {
+			return nil
+		}
+		return []platform.GeneratedName{metric(name, "sample")}
+	case parse.GoSpawn:
+		if name == "" {
+			return nil
+		}
+		return []platform.GeneratedName{
+			metric(fmt.Sprintf("%s#spawns", name), "counter"),
+			metric(fmt.Sprintf("%s#goroutines", name), "gauge"),
+		}
+	case parse.LockWait:
+		if name == "" {
+			return nil
+		}
+		return []platform.GeneratedName{
+			metric(fmt.Sprintf("%s#wait", name), "sample"),
+			metric(fmt.Sprintf("%s#hold", name), "sample"),
+		}
+	case parse.ChanDepth:
+		varName, err := d.ChanVarName(*directive)
+		if err != nil {
+			return nil
+		}
+		name := chanDepthName(filename, varName, directive)
+		return []platform.GeneratedName{
+			metric(fmt.Sprintf("%s#len", name), "gauge"),
+			metric(fmt.Sprintf("%s#cap", name), "gauge"),
+		}
+	}
+	return nil
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"go/token"
 	"os"
-	"path/filepath"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -22,24 +21,164 @@ var pkgsRequired = map[string]*parse.PackageInfo{
 	"time":      {Name: "time", Path: "time"},
 }
 
+var pkgsGoMetricsRequired = map[string]*parse.PackageInfo{
+	"gometrics": {Name: "gometrics", Path: "github.com/hashicorp/go-metrics"},
+}
+
+var pkgsGaugeUpdateRequired = map[string]*parse.PackageInfo{
+	"gometrics": {Name: "gometrics", Path: "github.com/hashicorp/go-metrics"},
+	"sync":      {Name: "sync", Path: "sync"},
+}
+
+var funcExecTimeSchema = &platform.DirectiveSchema{
+	Placement: platform.FuncPlacement,
+	Params: map[string]platform.ParamSchema{
+		"name":           {Type: platform.NameParam},
+		"labels":         {Type: platform.LabelsParam},
+		"cooldown":       {Type: platform.DurationParam},
+		"sample-rate":    {Type: platform.RateParam},
+		"slow-threshold": {Type: platform.DurationParam},
+		"slow-stack":     {Type: platform.IntParam},
+		"gm-cooldown-time": {
+			Type:       platform.DurationParam,
+			Deprecated: "cooldown",
+		},
+	},
+}
+
+var directiveSchema = platform.Schema{
+	parse.Define: {
+		Placement: platform.DeclPlacement,
+		Params: map[string]platform.ParamSchema{
+			"gm-interval":                 {Type: platform.DurationParam},
+			"gm-duration":                 {Type: platform.DurationParam},
+			"gm-runtime-metrics":          {Type: platform.BoolParam},
+			"gm-runtime-metrics-interval": {Type: platform.DurationParam},
+			"pkg-path":                    {Type: platform.BoolParam},
+			"slow-logger": {
+				Type:   platform.StringParam,
+				Values: platform.SlowLoggerNames,
+			},
+			"slow-log-interval": {Type: platform.DurationParam},
+			"runtime-metrics-interval": {
+				Type:       platform.DurationParam,
+				Deprecated: "gm-runtime-metrics-interval",
+			},
+		},
+	},
+	parse.FuncExecTime:    funcExecTimeSchema,
+	parse.PackageExecTime: platform.PackageSchema(funcExecTimeSchema),
+	parse.FuncErrorCount: {
+		Placement: platform.FuncPlacement,
+		Params: map[string]platform.ParamSchema{
+			"name":   {Type: platform.NameParam},
+			"labels": {Type: platform.LabelsParam},
+		},
+	},
+	parse.FuncInFlight: {
+		Placement: platform.FuncPlacement,
+		Params: map[string]platform.ParamSchema{
+			"name": {Type: platform.NameParam},
+		},
+	},
+	parse.FuncPanicCount: {
+		Placement: platform.FuncPlacement,
+		Params: map[string]platform.ParamSchema{
+			"name":      {Type: platform.NameParam},
+			"labels":    {Type: platform.LabelsParam},
+			"log-stack": {Type: platform.BoolParam},
+		},
+	},
+	parse.InnerExecTime: {
+		Placement: platform.StmtPlacement,
+		Params: map[string]platform.ParamSchema{
+			"name":        {Type: platform.NameParam},
+			"labels":      {Type: platform.LabelsParam},
+			"cooldown":    {Type: platform.DurationParam},
+			"sample-rate": {Type: platform.RateParam},
+		},
+	},
+	parse.RegionBegin: {
+		Placement: platform.StmtPlacement,
+		Params: map[string]platform.ParamSchema{
+			"name":   {Type: platform.NameParam, Required: true},
+			"labels": {Type: platform.LabelsParam},
+		},
+	},
+	parse.GoSpawn: {
+		Placement: platform.GoPlacement,
+		Params: map[string]platform.ParamSchema{
+			"name": {Type: platform.NameParam, Required: true},
+		},
+	},
+	parse.ChanDepth: {
+		Placement: platform.VarPlacement,
+		Params: map[string]platform.ParamSchema{
+			"name":     {Type: platform.NameParam},
+			"interval": {Type: platform.DurationParam},
+		},
+	},
+	parse.LockWait: {
+		Placement: platform.LockPlacement,
+		Params: map[string]platform.ParamSchema{
+			"name": {Type: platform.NameParam, Required: true},
+		},
+	},
+	parse.RegionEnd: {
+		Placement: platform.StmtPlacement,
+		Params: map[string]platform.ParamSchema{
+			"name": {Type: platform.NameParam, Required: true},
+		},
+	},
+	parse.InnerObserve: {
+		Placement: platform.StmtPlacement,
+		Params: map[string]platform.ParamSchema{
+			"name":    {Type: platform.NameParam, Required: true},
+			"labels":  {Type: platform.LabelsParam},
+			"value":   {Type: platform.ExprParam, Required: true},
+			"buckets": {Type: platform.BucketsParam},
+		},
+	},
+	parse.InnerGauge: {
+		Placement: platform.StmtPlacement,
+		Params: map[string]platform.ParamSchema{
+			"name":   {Type: platform.NameParam, Required: true},
+			"labels": {Type: platform.LabelsParam},
+			"value":  {Type: platform.ExprParam, Required: true},
+			"op": {
+				Type:   platform.StringParam,
+				Values: []string{"set", "add", "sub"},
+			},
+		},
+	},
+}
+
 type goMetricsProvider struct {
-	inplace bool
-	suffix  string
-	dryRun  bool
+	inplace    bool
+	suffix     string
+	dryRun     bool
+	overlayDir string
 }
 
 func NewGoMetricsProvider(
 	inplace bool,
 	suffix string,
 	dryRun bool,
+	overlayDir string,
 ) platform.MetricsProvider {
 	return &goMetricsProvider{
-		inplace: inplace,
-		suffix:  suffix,
-		dryRun:  dryRun,
+		inplace:    inplace,
+		suffix:     suffix,
+		dryRun:     dryRun,
+		overlayDir: overlayDir,
 	}
 }
 
+// Schema implements platform.MetricsProvider.
+func (g *goMetricsProvider) Schema() platform.Schema {
+	return directiveSchema
+}
+
 // PrePatch implements platform.MetricsProvider.
 func (g *goMetricsProvider) PrePatch(info *parse.CollectInfo) error {
 	if !info.HasDefinitionDirective() {
@@ -58,6 +197,17 @@ func (g *goMetricsProvider) Patch(info *parse.CollectInfo) error {
 
 // PostPatch implements platform.MetricsProvider.
 func (g *goMetricsProvider) PostPatch(info *parse.CollectInfo) error {
+	if g.overlayDir != "" {
+		if err := platform.StoreOverlay(info, g.overlayDir, g.dryRun); err != nil {
+			return err
+		}
+		if g.dryRun {
+			return nil
+		}
+		// only update the go.mod copy in the overlay directory
+		return platform.FetchOverlayPackages(info,
+			[]string{"github.com/hashicorp/go-metrics"}, g.overlayDir)
+	}
 	if err := StoreFiles(info, g.inplace, g.suffix, g.dryRun); err != nil {
 		return err
 	}
@@ -67,228 +217,1047 @@ func (g *goMetricsProvider) PostPatch(info *parse.CollectInfo) error {
 	return nil
 }
 
+// TraceFuncTimeStmts returns the deferred statement that measures the
+// duration of a function, onReturn statements run in the deferred function
+// with the duration in d
 func TraceFuncTimeStmts(filename string, funcName string,
-	directive *parse.Directive,
-) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt, identPatchTable []*dst.Ident) {
-	cooldownTime := ""
-	if v, ok := directive.Param("gm-cooldown-time"); ok {
-		cooldownTime = v
-		if _, err := time.ParseDuration(cooldownTime); err != nil {
-			log.Fatalf("invalid gm-cooldown-time: %s, %s", err, cooldownTime)
-		}
+	directive *parse.Directive, onReturn []dst.Stmt,
+) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt, identPatchTable []*dst.Ident,
+	err error,
+) {
+	labels, err := directive.Labels()
+	if err != nil {
+		return nil, nil, nil, err
 	}
-
-	var varName string
-	if v, ok := directive.Param("name"); ok {
-		varName = v
-		if varName == funcName {
-			varName = fmt.Sprintf("fn_%s", funcName)
-		}
-	} else {
-		varName = fmt.Sprintf(`%s_%s`, filename, funcName)
+	cooldown, err := platform.CooldownPeriod(directive)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
+	key := funcTimeKey(directive, filename, funcName, cooldown != 0)
+
 	identPatchTable = []*dst.Ident{}
-	g := []dst.Decl{}
-	l := []dst.Stmt{}
-	if cooldownTime != "" {
-		cooldownTimeVarName, _ := timeConvertStatement("cooldown_time_", cooldownTime)
-		g = []dst.Decl{
-			&dst.GenDecl{
-				Tok: token.VAR,
-				Specs: []dst.Spec{
-					&dst.ValueSpec{
-						Names: []*dst.Ident{
-							{Name: fmt.Sprintf("lastInv_%s", funcName)},
+	l := []dst.Stmt{
+		&dst.DeferStmt{
+			Call: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   &dst.Ident{Name: "gometrics"},
+					Sel: &dst.Ident{Name: "MeasureSince"},
+				},
+				Args: []dst.Expr{
+					// value of []string{""}
+					&dst.CompositeLit{
+						Type: &dst.ArrayType{
+							Elt: &dst.Ident{Name: "string"},
 						},
-						Type: &dst.Ident{Name: "time.Time"},
-						Values: []dst.Expr{
-							&dst.CallExpr{
-								Fun: &dst.SelectorExpr{
-									X:   &dst.Ident{Name: "time"},
-									Sel: &dst.Ident{Name: "Now"},
-								},
+						Elts: []dst.Expr{
+							&dst.BasicLit{
+								Kind:  token.STRING,
+								Value: fmt.Sprintf(`"%s"`, key),
 							},
 						},
 					},
+					&dst.CallExpr{
+						Fun: &dst.SelectorExpr{
+							X:   &dst.Ident{Name: "time"},
+							Sel: &dst.Ident{Name: "Now"},
+						},
+					},
+				},
+			},
+		},
+	}
+	// add gemetrics
+	identPatchTable = append(identPatchTable,
+		l[0].(*dst.DeferStmt).Call.Fun.(*dst.SelectorExpr).X.(*dst.Ident))
+	// add time
+	identPatchTable = append(identPatchTable,
+		l[0].(*dst.DeferStmt).Call.Args[1].(*dst.CallExpr).
+			Fun.(*dst.SelectorExpr).X.(*dst.Ident))
+	measure := l[0].(*dst.DeferStmt).Call
+
+	if len(labels) != 0 {
+		// gometrics.MeasureSinceWithLabels(key, time.Now(), labels)
+		elts, patchTable := labelElts(labels)
+		identPatchTable = append(identPatchTable, patchTable...)
+		lit, ident := labelsLit(elts)
+		identPatchTable = append(identPatchTable, ident)
+		measure.Fun.(*dst.SelectorExpr).Sel.Name = "MeasureSinceWithLabels"
+		measure.Args = append(measure.Args, lit)
+	}
+	if len(onReturn) != 0 {
+		stmt, idents := onReturnDeferStmt(measure, onReturn)
+		l = []dst.Stmt{stmt}
+		identPatchTable = append(identPatchTable, idents...)
+	}
+	return nil, l, identPatchTable, nil
+}
+
+// labelElt returns a label of a metric
+//
+//	{Name: "name", Value: value}
+func labelElt(name string, value dst.Expr) dst.Expr {
+	return &dst.CompositeLit{
+		Elts: []dst.Expr{
+			&dst.KeyValueExpr{
+				Key: &dst.Ident{Name: "Name"},
+				Value: &dst.BasicLit{
+					Kind:  token.STRING,
+					Value: fmt.Sprintf(`"%s"`, name),
+				},
+			},
+			&dst.KeyValueExpr{
+				Key:   &dst.Ident{Name: "Value"},
+				Value: value,
+			},
+		},
+	}
+}
+
+// labelElts returns the labels of a directive with values converted to strings
+func labelElts(labels []parse.Label) ([]dst.Expr, []*dst.Ident) {
+	elts := []dst.Expr{}
+	identPatchTable := []*dst.Ident{}
+	for _, label := range labels {
+		value, ident := platform.LabelValue(label)
+		elts = append(elts, labelElt(label.Name, value))
+		// add fmt
+		identPatchTable = append(identPatchTable, ident)
+	}
+	return elts, identPatchTable
+}
+
+// labelsLit returns a slice of labels, the returned ident has to be added to
+// the patch table
+//
+//	[]gometrics.Label{{Name: "name", Value: value}}
+func labelsLit(elts []dst.Expr) (dst.Expr, *dst.Ident) {
+	labelType := &dst.Ident{Name: "gometrics.Label"}
+	return &dst.CompositeLit{
+		Type: &dst.ArrayType{Elt: labelType},
+		Elts: elts,
+	}, labelType
+}
+
+// TraceGaugeStmts returns the statements that update a gauge. The gauge is set
+// to the value expression of the directive, or increased or decreased by it
+// with op=add|sub. go-metrics only sets gauges, so the current value of an
+// updated gauge is kept in a global variable.
+func TraceGaugeStmts(filename string, funcName string, id string,
+	directive *parse.Directive,
+) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt, identPatchTable []*dst.Ident,
+	err error,
+) {
+	name, ok := directive.Param("name")
+	if !ok || name == "" {
+		return nil, nil, nil, fmt.Errorf("name is required for inner gauge")
+	}
+	value, ok := directive.Param("value")
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("value is required for inner gauge")
+	}
+	valueExpr, err := parse.ParseExpr(value)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	valueExpr = &dst.CallExpr{
+		Fun:  &dst.Ident{Name: "float32"},
+		Args: []dst.Expr{valueExpr},
+	}
+
+	// value of []string{"filename#funcName#name"}
+	key := &dst.CompositeLit{
+		Type: &dst.ArrayType{
+			Elt: &dst.Ident{Name: "string"},
+		},
+		Elts: []dst.Expr{
+			&dst.BasicLit{
+				Kind:  token.STRING,
+				Value: fmt.Sprintf(`"%s#%s#%s"`, filename, funcName, name),
+			},
+		},
+	}
+
+	labels, err := directive.Labels()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	op, _ := directive.Param("op")
+	switch op {
+	case "", "set":
+		// gometrics.SetGauge([]string{"..."}, float32(value))
+		call := &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X:   &dst.Ident{Name: "gometrics"},
+				Sel: &dst.Ident{Name: "SetGauge"},
+			},
+			Args: []dst.Expr{key, valueExpr},
+		}
+		// add gometrics
+		identPatchTable = []*dst.Ident{
+			call.Fun.(*dst.SelectorExpr).X.(*dst.Ident),
+		}
+		if len(labels) != 0 {
+			// gometrics.SetGaugeWithLabels([]string{"..."}, float32(value), labels)
+			elts, patchTable := labelElts(labels)
+			identPatchTable = append(identPatchTable, patchTable...)
+			lit, ident := labelsLit(elts)
+			identPatchTable = append(identPatchTable, ident)
+			call.Fun.(*dst.SelectorExpr).Sel.Name = "SetGaugeWithLabels"
+			call.Args = append(call.Args, lit)
+		}
+		return nil, []dst.Stmt{&dst.ExprStmt{X: call}}, identPatchTable, nil
+	case "add", "sub":
+		if len(labels) != 0 {
+			return nil, nil, nil, fmt.Errorf("labels are not supported for "+
+				"inner gauge with op=%s", op)
+		}
+	default:
+		return nil, nil, nil, fmt.Errorf("invalid op %s for inner gauge", op)
+	}
+
+	assignOp := token.ADD_ASSIGN
+	if op == "sub" {
+		assignOp = token.SUB_ASSIGN
+	}
+	varName := fmt.Sprintf("%s_%s_%s_%s", filename, funcName, name, id)
+	g, identPatchTable := gaugeValueDecls(varName)
+
+	// {
+	// 	update the gauge
+	// }
+	update, patchTable := gaugeUpdateStmts(varName,
+		fmt.Sprintf("%s#%s#%s", filename, funcName, name), assignOp, valueExpr)
+	identPatchTable = append(identPatchTable, patchTable...)
+	l := []dst.Stmt{&dst.BlockStmt{List: update}}
+	return g, l, identPatchTable, nil
+}
+
+// gaugeValueDecls returns the declarations of the variables that keep the
+// current value of a gauge, go-metrics can only set gauges
+//
+//	var gaugename float32
+//	var gaugename_mutex sync.Mutex
+func gaugeValueDecls(varName string) ([]dst.Decl, []*dst.Ident) {
+	g := []dst.Decl{
+		&dst.GenDecl{
+			Tok: token.VAR,
+			Specs: []dst.Spec{
+				&dst.ValueSpec{
+					Names: []*dst.Ident{{Name: varName}},
+					Type:  &dst.Ident{Name: "float32"},
+				},
+			},
+		},
+		&dst.GenDecl{
+			Tok: token.VAR,
+			Specs: []dst.Spec{
+				&dst.ValueSpec{
+					Names: []*dst.Ident{{Name: fmt.Sprintf("%s_mutex", varName)}},
+					Type: &dst.SelectorExpr{
+						X:   &dst.Ident{Name: "sync"},
+						Sel: &dst.Ident{Name: "Mutex"},
+					},
 				},
 			},
-			&dst.GenDecl{
-				Tok: token.VAR,
-				Specs: []dst.Spec{
-					&dst.ValueSpec{
-						Names: []*dst.Ident{
-							{Name: cooldownTimeVarName},
-							{Name: "_"},
+		},
+	}
+	// add sync
+	identPatchTable := []*dst.Ident{
+		g[1].(*dst.GenDecl).Specs[0].(*dst.ValueSpec).Type.(*dst.SelectorExpr).
+			X.(*dst.Ident),
+	}
+	return g, identPatchTable
+}
+
+// gaugeUpdateStmts returns the statements that update the value of a gauge
+// declared by gaugeValueDecls and set the gauge
+//
+//	gaugename_mutex.Lock()
+//	gaugename += value
+//	gometrics.SetGauge([]string{"key"}, gaugename)
+//	gaugename_mutex.Unlock()
+func gaugeUpdateStmts(varName string, key string, assignOp token.Token,
+	valueExpr dst.Expr,
+) ([]dst.Stmt, []*dst.Ident) {
+	mutexName := fmt.Sprintf("%s_mutex", varName)
+	l := []dst.Stmt{
+		&dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   &dst.Ident{Name: mutexName},
+					Sel: &dst.Ident{Name: "Lock"},
+				},
+			},
+		},
+		&dst.AssignStmt{
+			Lhs: []dst.Expr{&dst.Ident{Name: varName}},
+			Tok: assignOp,
+			Rhs: []dst.Expr{valueExpr},
+		},
+		&dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   &dst.Ident{Name: "gometrics"},
+					Sel: &dst.Ident{Name: "SetGauge"},
+				},
+				Args: []dst.Expr{
+					&dst.CompositeLit{
+						Type: &dst.ArrayType{
+							Elt: &dst.Ident{Name: "string"},
 						},
-						Values: []dst.Expr{
-							&dst.CallExpr{
-								Fun: &dst.SelectorExpr{
-									X:   &dst.Ident{Name: "time"},
-									Sel: &dst.Ident{Name: "ParseDuration"},
-								},
-								Args: []dst.Expr{
-									&dst.BasicLit{
-										Kind:  token.STRING,
-										Value: fmt.Sprintf(`"%s"`, cooldownTime),
-									},
-								},
+						Elts: []dst.Expr{
+							&dst.BasicLit{
+								Kind:  token.STRING,
+								Value: fmt.Sprintf(`"%s"`, key),
 							},
 						},
 					},
+					&dst.Ident{Name: varName},
 				},
 			},
+		},
+		&dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   &dst.Ident{Name: mutexName},
+					Sel: &dst.Ident{Name: "Unlock"},
+				},
+			},
+		},
+	}
+	// add gometrics
+	identPatchTable := []*dst.Ident{
+		l[2].(*dst.ExprStmt).X.(*dst.CallExpr).Fun.(*dst.SelectorExpr).
+			X.(*dst.Ident),
+	}
+	return l, identPatchTable
+}
+
+// TraceObserveStmts returns the statement that adds the value expression of the
+// directive to a sample. go-metrics keeps the samples in a histogram without
+// buckets, the buckets of the directive are only used by Prometheus.
+func TraceObserveStmts(filename string, funcName string,
+	directive *parse.Directive,
+) (inFuncStmts []dst.Stmt, identPatchTable []*dst.Ident, err error) {
+	name, ok := directive.Param("name")
+	if !ok || name == "" {
+		return nil, nil, fmt.Errorf("name is required for inner observe")
+	}
+	value, ok := directive.Param("value")
+	if !ok {
+		return nil, nil, fmt.Errorf("value is required for inner observe")
+	}
+	valueExpr, err := parse.ParseExpr(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	labels, err := directive.Labels()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// gometrics.AddSample([]string{"filename#funcName#name"}, float32(value))
+	call := &dst.CallExpr{
+		Fun: &dst.SelectorExpr{
+			X:   &dst.Ident{Name: "gometrics"},
+			Sel: &dst.Ident{Name: "AddSample"},
+		},
+		Args: []dst.Expr{
+			&dst.CompositeLit{
+				Type: &dst.ArrayType{
+					Elt: &dst.Ident{Name: "string"},
+				},
+				Elts: []dst.Expr{
+					&dst.BasicLit{
+						Kind:  token.STRING,
+						Value: fmt.Sprintf(`"%s#%s#%s"`, filename, funcName, name),
+					},
+				},
+			},
+			&dst.CallExpr{
+				Fun:  &dst.Ident{Name: "float32"},
+				Args: []dst.Expr{valueExpr},
+			},
+		},
+	}
+	// add gometrics
+	identPatchTable = []*dst.Ident{
+		call.Fun.(*dst.SelectorExpr).X.(*dst.Ident),
+	}
+	if len(labels) != 0 {
+		// gometrics.AddSampleWithLabels([]string{"..."}, float32(value), labels)
+		elts, patchTable := labelElts(labels)
+		identPatchTable = append(identPatchTable, patchTable...)
+		lit, ident := labelsLit(elts)
+		identPatchTable = append(identPatchTable, ident)
+		call.Fun.(*dst.SelectorExpr).Sel.Name = "AddSampleWithLabels"
+		call.Args = append(call.Args, lit)
+	}
+	return []dst.Stmt{&dst.ExprStmt{X: call}}, identPatchTable, nil
+}
+
+// TraceInFlightStmts returns the statements that increase a gauge when a
+// function is entered and decrease it when the function returns. The
+// directives with the same name in a package share the value of the gauge, it
+// is only declared if shared is false.
+func TraceInFlightStmts(filename string, funcName string,
+	directive *parse.Directive, shared bool,
+) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt, identPatchTable []*dst.Ident) {
+	varName, key := inFlightNames(directive, filename, funcName)
+	var g []dst.Decl
+	if !shared {
+		g, identPatchTable = gaugeValueDecls(varName)
+	}
+
+	// {
+	// 	increase the gauge
+	// }
+	// defer func() {
+	// 	decrease the gauge
+	// }()
+	inc, patchTable := gaugeUpdateStmts(varName, key, token.ADD_ASSIGN,
+		&dst.BasicLit{Kind: token.INT, Value: "1"})
+	identPatchTable = append(identPatchTable, patchTable...)
+	dec, patchTable := gaugeUpdateStmts(varName, key, token.SUB_ASSIGN,
+		&dst.BasicLit{Kind: token.INT, Value: "1"})
+	identPatchTable = append(identPatchTable, patchTable...)
+	l := []dst.Stmt{
+		&dst.BlockStmt{List: inc},
+		&dst.DeferStmt{
+			Call: &dst.CallExpr{
+				Fun: &dst.FuncLit{
+					Type: &dst.FuncType{},
+					Body: &dst.BlockStmt{List: dec},
+				},
+			},
+		},
+	}
+	return g, l, identPatchTable
+}
+
+// TraceErrorCountStmts returns the statement that counts the calls of a
+// function with a result label set to "error" if the returned error named
+// errName is not nil
+func TraceErrorCountStmts(filename string, funcName string, errName string,
+	directive *parse.Directive,
+) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt, identPatchTable []*dst.Ident,
+	err error,
+) {
+	key := funcKey(directive, filename, funcName, "errors")
+	labels, err := directive.Labels()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, label := range labels {
+		if label.Name == "result" {
+			return nil, nil, nil, fmt.Errorf("label name \"result\" is " +
+				"reserved by func-error-count")
 		}
-		// add time.Time
-		identPatchTable = append(identPatchTable,
-			g[0].(*dst.GenDecl).Specs[0].(*dst.ValueSpec).Type.(*dst.Ident))
-		// add 1st time
-		identPatchTable = append(
-			identPatchTable,
-			g[0].(*dst.GenDecl).Specs[0].(*dst.ValueSpec).Values[0].(*dst.CallExpr).
-				Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-		)
-		// add 2nd time
-		identPatchTable = append(
-			identPatchTable,
-			g[1].(*dst.GenDecl).Specs[0].(*dst.ValueSpec).Values[0].(*dst.CallExpr).
-				Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-		)
-
-		l = []dst.Stmt{
-			&dst.IfStmt{
-				Cond: &dst.BinaryExpr{
-					X: &dst.CallExpr{
-						Fun: &dst.SelectorExpr{
-							X:   &dst.Ident{Name: "time"},
-							Sel: &dst.Ident{Name: "Since"},
+	}
+
+	// label values are evaluated when the function is entered and passed as
+	// "labels []gometrics.Label" to the deferred function
+	identPatchTable = []*dst.Ident{}
+	funcType := &dst.FuncType{}
+	args := []dst.Expr{}
+	if len(labels) != 0 {
+		elts, patchTable := labelElts(labels)
+		identPatchTable = append(identPatchTable, patchTable...)
+		lit, ident := labelsLit(elts)
+		paramType := &dst.Ident{Name: "gometrics.Label"}
+		identPatchTable = append(identPatchTable, ident, paramType)
+		funcType.Params = &dst.FieldList{
+			List: []*dst.Field{
+				{
+					Names: []*dst.Ident{{Name: "labels"}},
+					Type:  &dst.ArrayType{Elt: paramType},
+				},
+			},
+		}
+		args = append(args, lit)
+	}
+
+	// gometrics.IncrCounterWithLabels([]string{"..."}, 1,
+	// 	[]gometrics.Label{{Name: "result", Value: result}})
+	incr := func(result string) dst.Stmt {
+		resultLabel := labelElt("result", &dst.BasicLit{
+			Kind:  token.STRING,
+			Value: fmt.Sprintf(`"%s"`, result),
+		})
+		var labelsArg dst.Expr
+		if len(labels) != 0 {
+			// append(labels, gometrics.Label{Name: "result", Value: result})
+			labelType := &dst.Ident{Name: "gometrics.Label"}
+			resultLabel.(*dst.CompositeLit).Type = labelType
+			identPatchTable = append(identPatchTable, labelType)
+			labelsArg = &dst.CallExpr{
+				Fun:  &dst.Ident{Name: "append"},
+				Args: []dst.Expr{&dst.Ident{Name: "labels"}, resultLabel},
+			}
+		} else {
+			lit, ident := labelsLit([]dst.Expr{resultLabel})
+			identPatchTable = append(identPatchTable, ident)
+			labelsArg = lit
+		}
+		fun := &dst.SelectorExpr{
+			X:   &dst.Ident{Name: "gometrics"},
+			Sel: &dst.Ident{Name: "IncrCounterWithLabels"},
+		}
+		// add gometrics
+		identPatchTable = append(identPatchTable, fun.X.(*dst.Ident))
+		return &dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: fun,
+				Args: []dst.Expr{
+					&dst.CompositeLit{
+						Type: &dst.ArrayType{
+							Elt: &dst.Ident{Name: "string"},
 						},
-						Args: []dst.Expr{
-							&dst.Ident{Name: fmt.Sprintf("lastInv_%s", funcName)},
+						Elts: []dst.Expr{
+							&dst.BasicLit{
+								Kind:  token.STRING,
+								Value: fmt.Sprintf(`"%s"`, key),
+							},
 						},
 					},
-					Op: token.GTR,
-					Y:  &dst.Ident{Name: cooldownTimeVarName},
-				},
-				Body: &dst.BlockStmt{
-					List: []dst.Stmt{
-						&dst.AssignStmt{
-							Lhs: []dst.Expr{
-								&dst.Ident{Name: fmt.Sprintf("lastInv_%s", funcName)},
-							},
-							Tok: token.ASSIGN,
-							Rhs: []dst.Expr{
-								&dst.CallExpr{
-									Fun: &dst.SelectorExpr{
-										X:   &dst.Ident{Name: "time"},
-										Sel: &dst.Ident{Name: "Now"},
-									},
+					&dst.BasicLit{Kind: token.INT, Value: "1"},
+					labelsArg,
+				},
+			},
+		}
+	}
+
+	// defer func() {
+	// 	if err != nil {
+	// 		gometrics.IncrCounterWithLabels(..., "error")
+	// 	} else {
+	// 		gometrics.IncrCounterWithLabels(..., "ok")
+	// 	}
+	// }()
+	l := []dst.Stmt{
+		&dst.DeferStmt{
+			Call: &dst.CallExpr{
+				Fun: &dst.FuncLit{
+					Type: funcType,
+					Body: &dst.BlockStmt{
+						List: []dst.Stmt{
+							&dst.IfStmt{
+								Cond: &dst.BinaryExpr{
+									X:  &dst.Ident{Name: errName},
+									Op: token.NEQ,
+									Y:  &dst.Ident{Name: "nil"},
 								},
-							},
-						},
-						&dst.DeferStmt{
-							Call: &dst.CallExpr{
-								Fun: &dst.SelectorExpr{
-									X:   &dst.Ident{Name: "gometrics"},
-									Sel: &dst.Ident{Name: "MeasureSince"},
+								Body: &dst.BlockStmt{
+									List: []dst.Stmt{incr("error")},
 								},
-								Args: []dst.Expr{
-									// value of []string{""}
-									&dst.CompositeLit{
-										Type: &dst.ArrayType{
-											Elt: &dst.Ident{Name: "string"},
-										},
-										Elts: []dst.Expr{
-											&dst.BasicLit{
-												Kind:  token.STRING,
-												Value: fmt.Sprintf(`"%s"`, varName),
-											},
-										},
-									},
-									&dst.CallExpr{
-										Fun: &dst.SelectorExpr{
-											X:   &dst.Ident{Name: "time"},
-											Sel: &dst.Ident{Name: "Now"},
-										},
-									},
+								Else: &dst.BlockStmt{
+									List: []dst.Stmt{incr("ok")},
 								},
 							},
 						},
 					},
 				},
+				Args: args,
+			},
+		},
+	}
+	return nil, l, identPatchTable, nil
+}
+
+// TracePanicCountStmts returns the statement that recovers a panic of a
+// function, counts it and panics again
+func TracePanicCountStmts(filename string, funcName string,
+	directive *parse.Directive,
+) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt, identPatchTable []*dst.Ident,
+	err error,
+) {
+	key := funcKey(directive, filename, funcName, "panics")
+	labels, err := directive.Labels()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// gometrics.IncrCounter([]string{"..."}, 1)
+	// or with labels, evaluated when the function is entered and passed as
+	// "labels []gometrics.Label" to the deferred function
+	// gometrics.IncrCounterWithLabels([]string{"..."}, 1, labels)
+	identPatchTable = []*dst.Ident{}
+	funcType := &dst.FuncType{}
+	args := []dst.Expr{}
+	fun := &dst.SelectorExpr{
+		X:   &dst.Ident{Name: "gometrics"},
+		Sel: &dst.Ident{Name: "IncrCounter"},
+	}
+	// add gometrics
+	identPatchTable = append(identPatchTable, fun.X.(*dst.Ident))
+	incrArgs := []dst.Expr{
+		&dst.CompositeLit{
+			Type: &dst.ArrayType{
+				Elt: &dst.Ident{Name: "string"},
+			},
+			Elts: []dst.Expr{
+				&dst.BasicLit{
+					Kind:  token.STRING,
+					Value: fmt.Sprintf(`"%s"`, key),
+				},
+			},
+		},
+		&dst.BasicLit{Kind: token.INT, Value: "1"},
+	}
+	if len(labels) != 0 {
+		elts, patchTable := labelElts(labels)
+		identPatchTable = append(identPatchTable, patchTable...)
+		lit, ident := labelsLit(elts)
+		paramType := &dst.Ident{Name: "gometrics.Label"}
+		identPatchTable = append(identPatchTable, ident, paramType)
+		funcType.Params = &dst.FieldList{
+			List: []*dst.Field{
+				{
+					Names: []*dst.Ident{{Name: "labels"}},
+					Type:  &dst.ArrayType{Elt: paramType},
+				},
 			},
 		}
+		args = append(args, lit)
+		fun.Sel.Name = "IncrCounterWithLabels"
+		incrArgs = append(incrArgs, &dst.Ident{Name: "labels"})
+	}
+
+	// defer func() {
+	// 	if r := recover(); r != nil {
+	// 		gometrics.IncrCounter(...)
+	// 		panic(r)
+	// 	}
+	// }()
+	recoverStmt, patchTable := platform.RecoverStmt(funcName, []dst.Stmt{
+		&dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun:  fun,
+				Args: incrArgs,
+			},
+		},
+	}, platform.LogStack(directive))
+	identPatchTable = append(identPatchTable, patchTable...)
+	l := []dst.Stmt{
+		&dst.DeferStmt{
+			Call: &dst.CallExpr{
+				Fun: &dst.FuncLit{
+					Type: funcType,
+					Body: &dst.BlockStmt{List: []dst.Stmt{recoverStmt}},
+				},
+				Args: args,
+			},
+		},
+	}
+	return nil, l, identPatchTable, nil
+}
 
-		// add 1st time
-		identPatchTable = append(
-			identPatchTable,
-			l[0].(*dst.IfStmt).Cond.(*dst.BinaryExpr).X.(*dst.CallExpr).
-				Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-		)
-		// add 2nd time
-		identPatchTable = append(
-			identPatchTable,
-			l[0].(*dst.IfStmt).Body.List[0].(*dst.AssignStmt).Rhs[0].(*dst.CallExpr).
-				Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-		)
-		// add 3rd time
-		identPatchTable = append(
-			identPatchTable,
-			l[0].(*dst.IfStmt).Body.List[1].(*dst.DeferStmt).Call.Args[1].(*dst.CallExpr).
-				Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-		)
+// TraceRegionStmts returns the statement that stores the start time of a
+// region and a function returning new statements that measure the region, they
+// are inserted at the end of the region and before every return inside it
+func TraceRegionStmts(filename string, funcName string, id string,
+	region *parse.Region,
+) (beginStmts []dst.Stmt, endStmts func() ([]dst.Stmt, []*dst.Ident),
+	identPatchTable []*dst.Ident, err error,
+) {
+	if _, err := region.Begin.Labels(); err != nil {
+		return nil, nil, nil, err
+	}
+	// the name of the region is only used for the key of the metric
+	startName := fmt.Sprintf("%s_%s_%s_start", filename, funcName, id)
+
+	// region_start := time.Now()
+	timeNow := &dst.SelectorExpr{
+		X:   &dst.Ident{Name: "time"},
+		Sel: &dst.Ident{Name: "Now"},
+	}
+	// add time
+	identPatchTable = []*dst.Ident{timeNow.X.(*dst.Ident)}
+	b := []dst.Stmt{
+		&dst.EmptyStmt{},
+		&dst.AssignStmt{
+			Lhs: []dst.Expr{&dst.Ident{Name: startName}},
+			Tok: token.DEFINE,
+			Rhs: []dst.Expr{&dst.CallExpr{Fun: timeNow}},
+		},
+	}
+
+	// gometrics.MeasureSince([]string{"region"}, region_start)
+	//
+	// label values are evaluated when the region ends
+	endStmts = func() ([]dst.Stmt, []*dst.Ident) {
+		fun := &dst.SelectorExpr{
+			X:   &dst.Ident{Name: "gometrics"},
+			Sel: &dst.Ident{Name: "MeasureSince"},
+		}
 		// add gometrics
-		identPatchTable = append(
-			identPatchTable,
-			l[0].(*dst.IfStmt).Body.List[1].(*dst.DeferStmt).Call.
-				Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-		)
-	} else {
-		l = []dst.Stmt{
-			&dst.DeferStmt{
-				Call: &dst.CallExpr{
-					Fun: &dst.SelectorExpr{
-						X:   &dst.Ident{Name: "gometrics"},
-						Sel: &dst.Ident{Name: "MeasureSince"},
+		patchTable := []*dst.Ident{fun.X.(*dst.Ident)}
+		args := []dst.Expr{
+			&dst.CompositeLit{
+				Type: &dst.ArrayType{
+					Elt: &dst.Ident{Name: "string"},
+				},
+				Elts: []dst.Expr{
+					&dst.BasicLit{
+						Kind:  token.STRING,
+						Value: fmt.Sprintf(`"%s"`, region.Name),
 					},
-					Args: []dst.Expr{
-						// value of []string{""}
-						&dst.CompositeLit{
-							Type: &dst.ArrayType{
-								Elt: &dst.Ident{Name: "string"},
-							},
-							Elts: []dst.Expr{
-								&dst.BasicLit{
-									Kind: token.STRING,
-									Value: fmt.Sprintf(`"%s#%s"`,
-										filename, funcName),
-								},
+				},
+			},
+			&dst.Ident{Name: startName},
+		}
+		if labels, _ := region.Begin.Labels(); len(labels) != 0 {
+			elts, eltsPatchTable := labelElts(labels)
+			patchTable = append(patchTable, eltsPatchTable...)
+			lit, ident := labelsLit(elts)
+			patchTable = append(patchTable, ident)
+			fun.Sel.Name = "MeasureSinceWithLabels"
+			args = append(args, lit)
+		}
+		return []dst.Stmt{
+			&dst.EmptyStmt{},
+			&dst.ExprStmt{
+				X: &dst.CallExpr{
+					Fun:  fun,
+					Args: args,
+				},
+			},
+		}, patchTable
+	}
+	return b, endStmts, identPatchTable, nil
+}
+
+// TraceGoSpawnStmts returns the statement that counts a spawned goroutine and
+// the statements of the goroutine that keep the gauge of running goroutines up
+// to date. The directives with the same name in a package share the value of
+// the gauge, it is only declared if shared is false.
+func TraceGoSpawnStmts(name string, shared bool) (globalDecl []dst.Decl,
+	spawnStmts []dst.Stmt, goroutineStmts []dst.Stmt,
+	identPatchTable []*dst.Ident,
+) {
+	varName := fmt.Sprintf("go_spawn_%s_goroutines", utils.StableHash(8, name))
+	var g []dst.Decl
+	if !shared {
+		g, identPatchTable = gaugeValueDecls(varName)
+	}
+
+	// gometrics.IncrCounter([]string{"name#spawns"}, 1)
+	incr := &dst.SelectorExpr{
+		X:   &dst.Ident{Name: "gometrics"},
+		Sel: &dst.Ident{Name: "IncrCounter"},
+	}
+	// add gometrics
+	identPatchTable = append(identPatchTable, incr.X.(*dst.Ident))
+	s := []dst.Stmt{
+		&dst.EmptyStmt{},
+		&dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: incr,
+				Args: []dst.Expr{
+					&dst.CompositeLit{
+						Type: &dst.ArrayType{
+							Elt: &dst.Ident{Name: "string"},
+						},
+						Elts: []dst.Expr{
+							&dst.BasicLit{
+								Kind:  token.STRING,
+								Value: fmt.Sprintf(`"%s#spawns"`, name),
 							},
 						},
+					},
+					&dst.BasicLit{Kind: token.INT, Value: "1"},
+				},
+			},
+		},
+	}
+
+	// in the goroutine
+	// {
+	// 	increase the gauge
+	// }
+	// defer func() {
+	// 	decrease the gauge
+	// }()
+	key := fmt.Sprintf("%s#goroutines", name)
+	inc, patchTable := gaugeUpdateStmts(varName, key, token.ADD_ASSIGN,
+		&dst.BasicLit{Kind: token.INT, Value: "1"})
+	identPatchTable = append(identPatchTable, patchTable...)
+	dec, patchTable := gaugeUpdateStmts(varName, key, token.SUB_ASSIGN,
+		&dst.BasicLit{Kind: token.INT, Value: "1"})
+	identPatchTable = append(identPatchTable, patchTable...)
+	l := []dst.Stmt{
+		&dst.BlockStmt{List: inc},
+		&dst.DeferStmt{
+			Call: &dst.CallExpr{
+				Fun: &dst.FuncLit{
+					Type: &dst.FuncType{},
+					Body: &dst.BlockStmt{List: dec},
+				},
+			},
+		},
+	}
+	return g, s, l, identPatchTable
+}
+
+// TraceLockWaitStmts returns the statements that measure the time a lock call
+// blocks around the call, and the statements that measure the time the mutex
+// is held when it is released. The hold time is only measured if the unlock is
+// found.
+func TraceLockWaitStmts(filename string, funcName string, id string,
+	lock *parse.Lock,
+) (beforeStmts []dst.Stmt, afterStmts []dst.Stmt,
+	holdStmts func() ([]dst.Stmt, []*dst.Ident), identPatchTable []*dst.Ident,
+	err error,
+) {
+	name, ok := lock.Directive.Param("name")
+	if !ok || name == "" {
+		return nil, nil, nil, nil, fmt.Errorf("name is required for lock-wait")
+	}
+	// the name is only used for the keys of the metrics
+	waitStart := fmt.Sprintf("%s_%s_%s_wait_start", filename, funcName, id)
+	holdStart := fmt.Sprintf("%s_%s_%s_hold_start", filename, funcName, id)
+
+	// filename_funcName_id_wait_start := time.Now()
+	startStmt, ident := timeNowStmt(waitStart)
+	identPatchTable = append(identPatchTable, ident)
+	b := []dst.Stmt{&dst.EmptyStmt{}, startStmt}
+
+	// gometrics.MeasureSince([]string{"name#wait"}, filename_funcName_id_wait_start)
+	// filename_funcName_id_hold_start := time.Now()
+	measure, ident := measureSinceStmt(fmt.Sprintf("%s#wait", name), waitStart)
+	identPatchTable = append(identPatchTable, ident)
+	a := []dst.Stmt{measure}
+	if lock.Holds() {
+		startStmt, ident := timeNowStmt(holdStart)
+		identPatchTable = append(identPatchTable, ident)
+		a = append(a, startStmt)
+	}
+
+	// gometrics.MeasureSince([]string{"name#hold"}, filename_funcName_id_hold_start)
+	holdStmts = func() ([]dst.Stmt, []*dst.Ident) {
+		measure, ident := measureSinceStmt(fmt.Sprintf("%s#hold", name),
+			holdStart)
+		return []dst.Stmt{measure}, []*dst.Ident{ident}
+	}
+	return b, a, holdStmts, identPatchTable, nil
+}
+
+// timeNowStmt returns the statement that keeps the current time in a variable,
+// the returned ident has to be added to the patch table
+//
+//	name := time.Now()
+func timeNowStmt(varName string) (dst.Stmt, *dst.Ident) {
+	pkg := &dst.Ident{Name: "time"}
+	return &dst.AssignStmt{
+		Lhs: []dst.Expr{&dst.Ident{Name: varName}},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Fun: &dst.SelectorExpr{X: pkg, Sel: &dst.Ident{Name: "Now"}},
+			},
+		},
+	}, pkg
+}
+
+// onReturnDeferStmt turns a deferred measure call into a deferred function
+// that also runs the statements with the duration of the call in d. The start
+// time and the labels are still evaluated when the function is entered and
+// passed to the deferred function. The measure call reads the clock again
+// since go-metrics only takes a start time. The returned idents have to be
+// added to the patch table.
+//
+//	defer func(t time.Time, labels []gometrics.Label) {
+//		d := time.Since(t)
+//		gometrics.MeasureSinceWithLabels([]string{"key"}, t, labels)
+//		stmts...
+//	}(time.Now(), []gometrics.Label{...})
+func onReturnDeferStmt(measure *dst.CallExpr, stmts []dst.Stmt) (dst.Stmt, []*dst.Ident) {
+	timeType := &dst.Ident{Name: "time"}
+	timeSince := &dst.Ident{Name: "time"}
+	idents := []*dst.Ident{timeType, timeSince}
+	params := []*dst.Field{
+		{
+			Names: []*dst.Ident{{Name: "t"}},
+			Type: &dst.SelectorExpr{
+				X:   timeType,
+				Sel: &dst.Ident{Name: "Time"},
+			},
+		},
+	}
+	args := []dst.Expr{measure.Args[1]}
+	measure.Args[1] = &dst.Ident{Name: "t"}
+	if len(measure.Args) > 2 {
+		labelType := &dst.Ident{Name: "gometrics.Label"}
+		idents = append(idents, labelType)
+		params = append(params, &dst.Field{
+			Names: []*dst.Ident{{Name: "labels"}},
+			Type:  &dst.ArrayType{Elt: labelType},
+		})
+		args = append(args, measure.Args[2])
+		measure.Args[2] = &dst.Ident{Name: "labels"}
+	}
+	body := append([]dst.Stmt{
+		&dst.AssignStmt{
+			Lhs: []dst.Expr{&dst.Ident{Name: "d"}},
+			Tok: token.DEFINE,
+			Rhs: []dst.Expr{
+				&dst.CallExpr{
+					Fun:  &dst.SelectorExpr{X: timeSince, Sel: &dst.Ident{Name: "Since"}},
+					Args: []dst.Expr{&dst.Ident{Name: "t"}},
+				},
+			},
+		},
+		&dst.ExprStmt{X: measure},
+	}, stmts...)
+	return &dst.DeferStmt{
+		Call: &dst.CallExpr{
+			Fun: &dst.FuncLit{
+				Type: &dst.FuncType{
+					Params: &dst.FieldList{List: params},
+				},
+				Body: &dst.BlockStmt{List: body},
+			},
+			Args: args,
+		},
+	}, idents
+}
+
+// measureSinceStmt returns the statement that measures the time elapsed since
+// the time kept in a variable, the returned ident has to be added to the patch
+// table
+//
+//	gometrics.MeasureSince([]string{"key"}, start)
+func measureSinceStmt(key string, startName string) (dst.Stmt, *dst.Ident) {
+	pkg := &dst.Ident{Name: "gometrics"}
+	return &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X:   pkg,
+				Sel: &dst.Ident{Name: "MeasureSince"},
+			},
+			Args: []dst.Expr{
+				&dst.CompositeLit{
+					Type: &dst.ArrayType{
+						Elt: &dst.Ident{Name: "string"},
+					},
+					Elts: []dst.Expr{
+						&dst.BasicLit{
+							Kind:  token.STRING,
+							Value: fmt.Sprintf(`"%s"`, key),
+						},
+					},
+				},
+				&dst.Ident{Name: startName},
+			},
+		},
+	}, pkg
+}
+
+// TraceChanDepthDecls returns the init function that starts a goroutine
+// setting the gauges of the length and the capacity of a channel every interval
+//
+//	func init() {
+//		go func() {
+//			interval_xxx, _ := time.ParseDuration("10s")
+//			for {
+//				gometrics.SetGauge([]string{"name#len"}, float32(len(ch)))
+//				gometrics.SetGauge([]string{"name#cap"}, float32(cap(ch)))
+//				time.Sleep(interval_xxx)
+//			}
+//		}()
+//	}
+func TraceChanDepthDecls(filename string, varName string,
+	directive *parse.Directive,
+) (globalDecl []dst.Decl, identPatchTable []*dst.Ident, err error) {
+	name := chanDepthName(filename, varName, directive)
+	interval := "10s"
+	if v, ok := directive.Param("interval"); ok {
+		interval = v
+	}
+	if _, err := time.ParseDuration(interval); err != nil {
+		return nil, nil, fmt.Errorf("invalid interval %s: %v", interval, err)
+	}
+
+	intervalVarName, parseStmt := timeConvertStatement("interval_", interval)
+	// add time
+	identPatchTable = append(identPatchTable, parseStmt.(*dst.AssignStmt).
+		Rhs[0].(*dst.CallExpr).Fun.(*dst.SelectorExpr).X.(*dst.Ident))
+
+	loop := []dst.Stmt{}
+	for _, builtin := range []string{"len", "cap"} {
+		call := &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X:   &dst.Ident{Name: "gometrics"},
+				Sel: &dst.Ident{Name: "SetGauge"},
+			},
+			Args: []dst.Expr{
+				&dst.CompositeLit{
+					Type: &dst.ArrayType{
+						Elt: &dst.Ident{Name: "string"},
+					},
+					Elts: []dst.Expr{
+						&dst.BasicLit{
+							Kind:  token.STRING,
+							Value: fmt.Sprintf(`"%s#%s"`, name, builtin),
+						},
+					},
+				},
+				&dst.CallExpr{
+					Fun: &dst.Ident{Name: "float32"},
+					Args: []dst.Expr{
 						&dst.CallExpr{
-							Fun: &dst.SelectorExpr{
-								X:   &dst.Ident{Name: "time"},
-								Sel: &dst.Ident{Name: "Now"},
-							},
+							Fun:  &dst.Ident{Name: builtin},
+							Args: []dst.Expr{&dst.Ident{Name: varName}},
 						},
 					},
 				},
 			},
 		}
-		// add gemetrics
-		identPatchTable = append(identPatchTable,
-			l[0].(*dst.DeferStmt).Call.Fun.(*dst.SelectorExpr).X.(*dst.Ident))
-		// add time
+		// add gometrics
 		identPatchTable = append(identPatchTable,
-			l[0].(*dst.DeferStmt).Call.Args[1].(*dst.CallExpr).
-				Fun.(*dst.SelectorExpr).X.(*dst.Ident))
+			call.Fun.(*dst.SelectorExpr).X.(*dst.Ident))
+		loop = append(loop, &dst.ExprStmt{X: call})
+	}
+	sleep := &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X:   &dst.Ident{Name: "time"},
+				Sel: &dst.Ident{Name: "Sleep"},
+			},
+			Args: []dst.Expr{&dst.Ident{Name: intervalVarName}},
+		},
 	}
+	// add time
+	identPatchTable = append(identPatchTable,
+		sleep.X.(*dst.CallExpr).Fun.(*dst.SelectorExpr).X.(*dst.Ident))
+	loop = append(loop, sleep)
 
-	return g, l, identPatchTable
+	initDecl := platform.DSTInitFunc([]dst.Stmt{
+		&dst.GoStmt{
+			Call: &dst.CallExpr{
+				Fun: &dst.FuncLit{
+					Type: &dst.FuncType{},
+					Body: &dst.BlockStmt{
+						List: []dst.Stmt{
+							parseStmt,
+							&dst.ForStmt{
+								Body: &dst.BlockStmt{List: loop},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	return []dst.Decl{initDecl}, identPatchTable, nil
 }
 
+// timeConvertStatement returns a statement that parses timeStr into a
+// variable. The variable name is derived from varPrefix and timeStr.
 func timeConvertStatement(varPrefix string, timeStr string) (string, dst.Stmt) {
-	varName := fmt.Sprintf("%s%s", varPrefix, utils.GenerateRandNumString(8))
+	varName := fmt.Sprintf("%s%s", varPrefix, utils.StableHash(8, varPrefix, timeStr))
 	return varName, &dst.AssignStmt{
 		Lhs: []dst.Expr{
 			&dst.Ident{Name: varName},
@@ -349,7 +1318,10 @@ func DefineFuncInitDecl(d *parse.CollectInfo, name string,
 		}
 	}
 
-	if val, ok := directive.Param("runtime-metrics-interval"); ok {
+	if val, ok := directive.Param("gm-runtime-metrics-interval"); ok {
+		runtimeMetricsInterval = val
+	} else if val, ok := directive.Param("runtime-metrics-interval"); ok {
+		// deprecated name
 		runtimeMetricsInterval = val
 	} else {
 		runtimeMetricsInterval = "10s"
@@ -503,15 +1475,19 @@ func DefineFuncInitDecl(d *parse.CollectInfo, name string,
 
 func PatchProject(d *parse.CollectInfo, _ bool) error {
 	for _, fullpath := range d.Files() {
+		if d.IsUpToDate(fullpath) {
+			continue
+		}
 		directives, err := d.FileDirectives(fullpath)
 		if err != nil {
 			return err
 		}
+		regions, err := platform.RegionsByBegin(d, fullpath)
+		if err != nil {
+			return err
+		}
 		for _, directive := range directives {
-			base := filepath.Base(
-				fullpath,
-			) // Get the base (filename) from the full path
-			filename := base[:len(base)-len(filepath.Ext(base))] // Remove the extension
+			filename := platform.FileName(d, fullpath)
 			if directive.TraceType() == parse.Define {
 				// add the init function
 				initDecl, patchTable := DefineFuncInitDecl(d, filename, directive)
@@ -521,26 +1497,211 @@ func PatchProject(d *parse.CollectInfo, _ bool) error {
 				}
 			} else if directive.TraceType() == parse.FuncExecTime {
 				// add the defer statement
-				g, l, patchTable := TraceFuncTimeStmts(filename,
-					directive.Declaration().(*dst.FuncDecl).Name.Name, directive)
-				if err := d.SetFunctionTimeTracing(*directive, g, l, pkgsRequired,
+				slowDecl, slowStmts, slowPatchTable, err := platform.SlowCallStmts(d,
+					directive, "d")
+				if err != nil {
+					return err
+				}
+				g, l, patchTable, err := TraceFuncTimeStmts(filename,
+					platform.FuncName(d, directive), directive, slowStmts)
+				if err != nil {
+					return err
+				}
+				g = append(g, slowDecl...)
+				patchTable = append(patchTable, slowPatchTable...)
+				g, l, patchTable, err = platform.Cooldown(d, directive, g, l,
+					patchTable)
+				if err != nil {
+					return err
+				}
+				g, l, patchTable, err = platform.Sampled(d, directive, g, l,
+					patchTable)
+				if err != nil {
+					return err
+				}
+				pkgs := platform.PkgsWithLabels(pkgsRequired, directive)
+				pkgs = platform.PkgsWithSlowLog(d, pkgs, directive)
+				pkgs = platform.PkgsWithCooldown(pkgs, directive)
+				if err := d.SetFunctionTimeTracing(*directive, g, l,
+					platform.PkgsWithSampling(pkgs, directive),
+					patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.FuncErrorCount {
+				// add the defer statement
+				errName, err := d.ErrorResultName(*directive)
+				if err != nil {
+					return err
+				}
+				g, l, patchTable, err := TraceErrorCountStmts(filename,
+					platform.FuncName(d, directive), errName,
+					directive)
+				if err != nil {
+					return err
+				}
+				if err := d.SetFunctionTimeTracing(*directive, g, l,
+					platform.PkgsWithLabels(pkgsGoMetricsRequired, directive),
+					patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.FuncInFlight {
+				// add the gauge updates
+				if _, ok := directive.Param("labels"); ok {
+					return fmt.Errorf("labels are not supported for func-in-flight")
+				}
+				g, l, patchTable := TraceInFlightStmts(filename,
+					platform.FuncName(d, directive), directive,
+					d.SharesInFlightGauge(directive))
+				pkgs := pkgsGoMetricsRequired
+				if len(g) != 0 {
+					pkgs = pkgsGaugeUpdateRequired
+				}
+				if err := d.SetFunctionTimeTracing(*directive, g, l, pkgs,
+					patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.FuncPanicCount {
+				// add the defer statement
+				g, l, patchTable, err := TracePanicCountStmts(filename,
+					platform.FuncName(d, directive), directive)
+				if err != nil {
+					return err
+				}
+				pkgs := platform.PkgsWithLabels(pkgsGoMetricsRequired, directive)
+				if err := d.SetFunctionTimeTracing(*directive, g, l,
+					platform.PkgsWithStackLog(pkgs, directive),
 					patchTable); err != nil {
 					return err
 				}
 			} else if directive.TraceType() == parse.InnerExecTime {
 				// add the defer statement
-				if _, ok := directive.Param("gm-cooldown-time"); ok {
-					return fmt.Errorf("gm-cooldown-time is not supported for inner-exec-time")
+				g, l, patchTable, err := TraceFuncTimeStmts(filename,
+					platform.FuncName(d, directive), directive, nil)
+				if err != nil {
+					return err
+				}
+				g, l, patchTable, err = platform.Cooldown(d, directive, g, l,
+					patchTable)
+				if err != nil {
+					return err
+				}
+				g, l, patchTable, err = platform.Sampled(d, directive, g, l,
+					patchTable)
+				if err != nil {
+					return err
+				}
+				pkgs := platform.PkgsWithLabels(pkgsRequired, directive)
+				pkgs = platform.PkgsWithCooldown(pkgs, directive)
+				if err := d.SetFunctionInnerTracing(*directive, g, l,
+					platform.PkgsWithSampling(pkgs, directive),
+					patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.InnerGauge {
+				// set the gauge
+				g, l, patchTable, err := TraceGaugeStmts(filename,
+					platform.FuncName(d, directive),
+					d.DirectiveID(directive), directive)
+				if err != nil {
+					return err
+				}
+				pkgs := platform.PkgsWithLabels(pkgsGoMetricsRequired, directive)
+				if len(g) != 0 {
+					pkgs = pkgsGaugeUpdateRequired
+				}
+				// prepend an empty statement to the inFuncStmts
+				l = append([]dst.Stmt{&dst.EmptyStmt{}}, l...)
+				if err := d.SetFunctionInnerTracing(*directive, g, l, pkgs,
+					patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.InnerObserve {
+				// add the value to the sample
+				l, patchTable, err := TraceObserveStmts(filename,
+					platform.FuncName(d, directive), directive)
+				if err != nil {
+					return err
+				}
+				// prepend an empty statement to the inFuncStmts
+				l = append([]dst.Stmt{&dst.EmptyStmt{}}, l...)
+				if err := d.SetFunctionInnerTracing(*directive, nil, l,
+					platform.PkgsWithLabels(pkgsGoMetricsRequired, directive),
+					patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.RegionBegin {
+				// add the region measurement
+				region, ok := regions[directive]
+				if !ok {
+					return fmt.Errorf("region of %s not found", directive.Text())
+				}
+				b, endStmts, patchTable, err := TraceRegionStmts(filename,
+					platform.FuncName(d, directive), d.DirectiveID(directive), region)
+				if err != nil {
+					return err
 				}
-				g, l, patchTable := TraceFuncTimeStmts(filename,
-					directive.Declaration().(*dst.FuncDecl).Name.Name, directive)
-				if err := d.SetFunctionInnerTracing(*directive, g, l, pkgsRequired,
+				if err := d.SetRegionTracing(region, nil, b, endStmts,
+					platform.PkgsWithLabels(pkgsRequired, directive),
 					patchTable); err != nil {
 					return err
 				}
+			} else if directive.TraceType() == parse.RegionEnd {
+				// the end of a region is added with its beginning
+				continue
+			} else if directive.TraceType() == parse.GoSpawn {
+				// count the spawned goroutines and the running ones
+				name, ok := directive.Param("name")
+				if !ok || name == "" {
+					return fmt.Errorf("name is required for go-spawn")
+				}
+				g, s, l, patchTable := TraceGoSpawnStmts(name,
+					d.SharesSpawnGauge(directive))
+				pkgs := pkgsGoMetricsRequired
+				if len(g) != 0 {
+					pkgs = pkgsGaugeUpdateRequired
+				}
+				if err := d.SetGoSpawnTracing(*directive, g, s, l, pkgs,
+					patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.ChanDepth {
+				// sample the length and the capacity of the channel
+				varName, err := d.ChanVarName(*directive)
+				if err != nil {
+					return err
+				}
+				g, patchTable, err := TraceChanDepthDecls(filename, varName,
+					directive)
+				if err != nil {
+					return err
+				}
+				if err := d.SetChanDepthTracing(*directive, g, pkgsRequired,
+					patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.LockWait {
+				// measure the time the mutex is waited for and held
+				lock, err := d.MatchUnlocks(*directive)
+				if err != nil {
+					return err
+				}
+				b, a, holdStmts, patchTable, err := TraceLockWaitStmts(filename,
+					platform.FuncName(d, directive), d.DirectiveID(directive), lock)
+				if err != nil {
+					return err
+				}
+				if err := d.SetLockWaitTracing(lock, nil, b, a, holdStmts,
+					pkgsRequired, patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.PackageExecTime {
+				// the functions of the package are traced by the func-exec-time
+				// directives synthesized from it
+				continue
 			} else if directive.TraceType() == parse.GenBegine ||
 				directive.TraceType() == parse.GenEnd {
-				return fmt.Errorf("metrics code already generated")
+				// stale generated code is removed before patching
+				continue
 			} else if directive.TraceType() == parse.Set {
 				return fmt.Errorf("set is not supported")
 			} else if directive.TraceType() == parse.InnerCounter {
@@ -601,6 +1762,6 @@ func UpdatePackages(d *parse.CollectInfo, dryRun bool) error {
 		return nil
 	}
 	log.Infof("updating go.mod...")
-	return utils.FetchPackages(d.GoModPath(),
+	return platform.FetchModulePackages(d,
 		[]string{"github.com/hashicorp/go-metrics"})
 }
@@ -0,0 +1,38 @@
+package platform
+
+import (
+	"github.com/dave/dst"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+)
+
+// LabelValue returns the value expression of a label converted to a string,
+// the returned ident has to be added to the patch table
+//
+//	fmt.Sprint(value)
+func LabelValue(label parse.Label) (dst.Expr, *dst.Ident) {
+	pkg := dst.NewIdent("fmt")
+	return &dst.CallExpr{
+		Fun: &dst.SelectorExpr{
+			X:   pkg,
+			Sel: dst.NewIdent("Sprint"),
+		},
+		Args: []dst.Expr{label.Value},
+	}, pkg
+}
+
+// PkgsWithLabels returns pkgs with the packages needed by the label values of
+// a directive added
+func PkgsWithLabels(pkgs map[string]*parse.PackageInfo,
+	directive *parse.Directive,
+) map[string]*parse.PackageInfo {
+	if _, ok := directive.Param("labels"); !ok {
+		return pkgs
+	}
+	res := map[string]*parse.PackageInfo{
+		"fmt": {Name: "fmt", Path: "fmt"},
+	}
+	for k, v := range pkgs {
+		res[k] = v
+	}
+	return res
+}
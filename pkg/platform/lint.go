@@ -0,0 +1,495 @@
+package platform
+
+import (
+	"fmt"
+	"go/token"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dave/dst"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+)
+
+// ParamType is the type of the value of a directive parameter
+type ParamType int
+
+const (
+	StringParam     ParamType = iota
+	NameParam                 // used in generated identifiers and metric names
+	BoolParam                 // "true" or "false"
+	IntParam                  // decimal integer
+	PortParam                 // tcp port number
+	DurationParam             // time.ParseDuration format, e.g. "10s"
+	ExprParam                 // Go expression evaluated in the traced code
+	LabelsParam               // comma separated labels, "name" or "name:expr"
+	BucketsParam              // histogram buckets, "0.1,1,10" or "exp:start,factor,count"
+	ObjectivesParam           // summary objectives, "quantile:error,..."
+	RegexpParam               // regular expression in the syntax of package regexp
+	RateParam                 // fraction greater than 0 and at most 1, e.g. "0.01"
+)
+
+// ParamSchema describes a directive parameter
+type ParamSchema struct {
+	Type       ParamType
+	Required   bool
+	Deprecated string   // name of the parameter that replaces a deprecated one
+	Values     []string // allowed values, any value of the type if empty
+}
+
+// Placement tells where a directive can be written
+type Placement int
+
+const (
+	DeclPlacement    Placement = iota // comment of a top level declaration
+	FuncPlacement                     // comment of a function with a body
+	StmtPlacement                     // comment of a statement in a function body
+	PackagePlacement                  // comment before the package clause
+	GoPlacement                       // comment of a go statement in a function body
+	VarPlacement                      // comment of a top level var declaration
+	LockPlacement                     // comment of a Lock or RLock call in a function body
+)
+
+// DirectiveSchema describes the placement and the parameters of a directive
+type DirectiveSchema struct {
+	Placement Placement
+	Params    map[string]ParamSchema
+}
+
+// PackageSchema returns the schema of a package directive that applies a
+// function directive to the functions of a package. The functions are selected
+// by the include and exclude regular expressions and the exported-only flag,
+// the other parameters of the function directive but its name are passed on.
+func PackageSchema(funcSchema *DirectiveSchema) *DirectiveSchema {
+	params := map[string]ParamSchema{
+		"include":       {Type: RegexpParam},
+		"exclude":       {Type: RegexpParam},
+		"exported-only": {Type: BoolParam},
+	}
+	for k, v := range funcSchema.Params {
+		if k != "name" {
+			params[k] = v
+		}
+	}
+	return &DirectiveSchema{
+		Placement: PackagePlacement,
+		Params:    params,
+	}
+}
+
+// Schema maps the directives supported by a provider to their schema
+type Schema map[parse.TraceType]*DirectiveSchema
+
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+)
+
+// Diagnostic is a problem found in a directive
+type Diagnostic struct {
+	Filename  string   `json:"file"`
+	Line      int      `json:"line"`
+	Column    int      `json:"column"`
+	Severity  Severity `json:"severity"`
+	Directive string   `json:"directive,omitempty"`
+	Message   string   `json:"message"`
+}
+
+// String formats a diagnostic as "file:line:col: severity: message"
+func (d Diagnostic) String() string {
+	if d.Filename == "" {
+		return fmt.Sprintf("%s: %s", d.Severity, d.Message)
+	}
+	pos := d.Filename
+	if d.Line != 0 {
+		pos = fmt.Sprintf("%s:%d:%d", d.Filename, d.Line, d.Column)
+	}
+	return fmt.Sprintf("%s: %s: %s", pos, d.Severity, d.Message)
+}
+
+var nameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// checkParamValue returns an error if a value does not match a parameter
+func checkParamValue(param ParamSchema, value string) error {
+	if len(param.Values) != 0 {
+		for _, v := range param.Values {
+			if v == value {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", value,
+			strings.Join(param.Values, ", "))
+	}
+	switch param.Type {
+	case NameParam:
+		if !nameRegexp.MatchString(value) {
+			return fmt.Errorf("%q is not a valid name, use letters, digits "+
+				"and underscores", value)
+		}
+	case BoolParam:
+		if value != "true" && value != "false" {
+			return fmt.Errorf("%q is not a bool, use true or false", value)
+		}
+	case IntParam:
+		if _, err := strconv.Atoi(value); err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+	case PortParam:
+		if port, err := strconv.Atoi(value); err != nil || port <= 0 || port > 65535 {
+			return fmt.Errorf("%q is not a valid port", value)
+		}
+	case DurationParam:
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("%q is not a duration, use a value like \"10s\"",
+				value)
+		}
+	case ExprParam:
+		if _, err := parse.ParseExpr(value); err != nil {
+			return err
+		}
+	case LabelsParam:
+		if _, err := parse.ParseLabels(value); err != nil {
+			return err
+		}
+	case BucketsParam:
+		if _, err := ParseBuckets(value); err != nil {
+			return err
+		}
+	case ObjectivesParam:
+		if _, err := ParseObjectives(value); err != nil {
+			return err
+		}
+	case RegexpParam:
+		if _, err := regexp.Compile(value); err != nil {
+			return fmt.Errorf("%q is not a regular expression: %v", value, err)
+		}
+	case RateParam:
+		if _, err := parseRate(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// editDistance returns the levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// similarParam returns the known parameter closest to an unknown one, or an
+// empty string if none is close enough
+func similarParam(name string, params map[string]ParamSchema) string {
+	res := ""
+	best := 3
+	for known := range params {
+		if strings.HasSuffix(known, "-"+name) {
+			// missing provider prefix, e.g. runtime-metrics vs gm-runtime-metrics
+			return known
+		}
+		if dist := editDistance(name, known); dist < best ||
+			(dist == best && known < res) {
+			res, best = known, dist
+		}
+	}
+	return res
+}
+
+// checkPlacement returns an error if a directive is written at a place its
+// schema does not allow
+func checkPlacement(directive *parse.Directive, placement Placement) error {
+	switch placement {
+	case DeclPlacement:
+		if directive.Stmt() != nil {
+			return fmt.Errorf("must be placed before a top level declaration, " +
+				"not inside a function")
+		}
+	case FuncPlacement:
+		funcDecl, ok := directive.Declaration().(*dst.FuncDecl)
+		if directive.Stmt() != nil || !ok {
+			return fmt.Errorf("must be placed before a function declaration")
+		}
+		if funcDecl.Body == nil {
+			return fmt.Errorf("function %s has no body", funcDecl.Name.Name)
+		}
+	case StmtPlacement:
+		if directive.Stmt() == nil {
+			return fmt.Errorf("must be placed before a statement inside a function")
+		}
+	case GoPlacement:
+		if _, ok := directive.Stmt().(*dst.GoStmt); !ok {
+			return fmt.Errorf("must be placed before a go statement")
+		}
+	case LockPlacement:
+		if mutex, _ := parse.LockCall(directive.Stmt()); mutex == nil {
+			return fmt.Errorf("must be placed before a Lock or RLock call")
+		}
+	case VarPlacement:
+		genDecl, ok := directive.Declaration().(*dst.GenDecl)
+		if directive.Stmt() != nil || !ok || genDecl.Tok != token.VAR {
+			return fmt.Errorf("must be placed before a package level var " +
+				"declaration")
+		}
+	case PackagePlacement:
+		if directive.Declaration() != nil {
+			return fmt.Errorf("must be placed before the package clause")
+		}
+	}
+	return nil
+}
+
+// LintDirectives checks the directives of files against the schema of a
+// provider and returns the diagnostics sorted by position
+func LintDirectives(info *parse.CollectInfo, schema Schema, provider string,
+	files []string,
+) []Diagnostic {
+	res := []Diagnostic{}
+	for _, filename := range files {
+		directives, err := info.FileDirectives(filename)
+		if err != nil {
+			res = append(res, Diagnostic{
+				Filename: filename,
+				Severity: SeverityError,
+				Message:  err.Error(),
+			})
+			continue
+		}
+
+		for _, directive := range directives {
+			pos := info.DirectivePosition(directive)
+			name := parse.ParseDirectiveName(directive.Text())
+			report := func(severity Severity, format string, args ...interface{}) {
+				res = append(res, Diagnostic{
+					Filename:  pos.Filename,
+					Line:      pos.Line,
+					Column:    pos.Column,
+					Severity:  severity,
+					Directive: name,
+					Message:   fmt.Sprintf(format, args...),
+				})
+			}
+
+			if directive.Origin() != nil {
+				// checked with the package directive it comes from
+				continue
+			}
+
+			switch directive.TraceType() {
+			case parse.GenBegine, parse.GenEnd:
+				continue
+			case parse.Empty:
+				report(SeverityWarning, "empty trace directive")
+				continue
+			case parse.Invalid:
+				report(SeverityError, "unknown trace directive %q", name)
+				continue
+			}
+
+			s, ok := schema[directive.TraceType()]
+			if !ok {
+				report(SeverityError, "%s is not supported by the %s provider",
+					name, provider)
+				continue
+			}
+			if err := checkPlacement(directive, s.Placement); err != nil {
+				report(SeverityError, "%s %v", name, err)
+			}
+
+			params := directive.Params()
+			keys := []string{}
+			for key := range params {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				param, ok := s.Params[key]
+				if !ok {
+					if similar := similarParam(key, s.Params); similar != "" {
+						report(SeverityWarning, "unknown parameter %q of %s, "+
+							"did you mean %q?", key, name, similar)
+					} else {
+						report(SeverityWarning, "unknown parameter %q of %s",
+							key, name)
+					}
+					continue
+				}
+				if param.Deprecated != "" {
+					report(SeverityWarning, "parameter %q of %s is deprecated, "+
+						"use %q", key, name, param.Deprecated)
+				}
+				if err := checkParamValue(param, params[key]); err != nil {
+					report(SeverityError, "invalid %s of %s: %v", key, name, err)
+				}
+			}
+
+			required := []string{}
+			for key, param := range s.Params {
+				if _, ok := params[key]; param.Required && !ok {
+					required = append(required, key)
+				}
+			}
+			sort.Strings(required)
+			for _, key := range required {
+				report(SeverityError, "%s requires parameter %q", name, key)
+			}
+		}
+
+		// region-begin and region-end directives have to be balanced
+		if _, err := info.Regions(filename); err != nil {
+			diag := Diagnostic{
+				Filename: filename,
+				Severity: SeverityError,
+				Message:  err.Error(),
+			}
+			if regionErr, ok := err.(*parse.RegionError); ok {
+				pos := info.DirectivePosition(regionErr.Directive)
+				diag.Filename, diag.Line, diag.Column = pos.Filename, pos.Line, pos.Column
+				diag.Directive = regionErr.Directive.TraceType().String()
+			}
+			res = append(res, diag)
+		}
+	}
+
+	sortDiagnostics(res)
+	return res
+}
+
+// sortDiagnostics sorts diagnostics by position
+func sortDiagnostics(diags []Diagnostic) {
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].Filename != diags[j].Filename {
+			return diags[i].Filename < diags[j].Filename
+		}
+		if diags[i].Line != diags[j].Line {
+			return diags[i].Line < diags[j].Line
+		}
+		return diags[i].Column < diags[j].Column
+	})
+}
+
+// GeneratedName is a package level identifier declared by the generated code
+// of a directive, or a metric it records. Identifiers have to be unique in a
+// package. Metrics with the same name in a module are shared, so they must
+// have the same kind and labels.
+type GeneratedName struct {
+	Ident  string   // package level identifier, empty if it can not collide
+	Metric string   // name of the metric, empty if there is none
+	Kind   string   // kind of the metric, e.g. "counter"
+	Labels []string // label names of the metric
+}
+
+// Namer is implemented by the providers that can tell the names generated for
+// a directive without patching the files
+type Namer interface {
+	GeneratedNames(info *parse.CollectInfo, directive *parse.Directive) []GeneratedName
+}
+
+// describeMetric returns the kind and the labels of a metric for diagnostics
+func describeMetric(name GeneratedName) string {
+	if len(name.Labels) == 0 {
+		return name.Kind + " without labels"
+	}
+	return fmt.Sprintf("%s with labels %s", name.Kind,
+		strings.Join(name.Labels, ", "))
+}
+
+// LintGeneratedNames checks the names generated for the directives of all the
+// files together. It reports the identifiers declared twice in a package and
+// the metrics of a module that share a name but not their kind or labels.
+func LintGeneratedNames(info *parse.CollectInfo, namer Namer) []Diagnostic {
+	type use struct {
+		directive *parse.Directive
+		name      GeneratedName
+	}
+	idents := make(map[[2]string]use)  // package and identifier
+	metrics := make(map[[2]string]use) // go.mod and metric name
+	res := []Diagnostic{}
+	for _, filename := range info.Files() {
+		directives, err := info.FileDirectives(filename)
+		if err != nil {
+			continue
+		}
+		pkg := info.PackagePath(filename)
+		if pkg == "" {
+			pkg = filepath.Dir(filename) + ":" + info.PackageName(filename)
+		}
+		goMod := info.GoModPath(filename)
+
+		for _, directive := range directives {
+			pos := info.DirectivePosition(directive)
+			report := func(format string, args ...interface{}) {
+				res = append(res, Diagnostic{
+					Filename:  pos.Filename,
+					Line:      pos.Line,
+					Column:    pos.Column,
+					Severity:  SeverityError,
+					Directive: parse.ParseDirectiveName(directive.Text()),
+					Message:   fmt.Sprintf(format, args...),
+				})
+			}
+			at := func(other *parse.Directive) string {
+				pos := info.DirectivePosition(other)
+				return fmt.Sprintf("%s:%d", pos.Filename, pos.Line)
+			}
+
+			for _, name := range namer.GeneratedNames(info, directive) {
+				if name.Ident != "" {
+					key := [2]string{pkg, name.Ident}
+					if first, ok := idents[key]; ok && first.directive != directive {
+						report("generated identifier %q is already declared "+
+							"for the directive at %s", name.Ident, at(first.directive))
+					} else if !ok {
+						idents[key] = use{directive, name}
+					}
+				}
+				if name.Metric != "" {
+					key := [2]string{goMod, name.Metric}
+					first, ok := metrics[key]
+					if !ok {
+						metrics[key] = use{directive, name}
+						continue
+					}
+					if first.name.Kind != name.Kind ||
+						strings.Join(first.name.Labels, ",") !=
+							strings.Join(name.Labels, ",") {
+						report("metric %q is a %s but a %s for the directive at %s",
+							name.Metric, describeMetric(name),
+							describeMetric(first.name), at(first.directive))
+					}
+				}
+			}
+		}
+	}
+	sortDiagnostics(res)
+	return res
+}
+
+// HasLintErrors returns true if any diagnostic is an error
+func HasLintErrors(diags []Diagnostic) bool {
+	for _, diag := range diags {
+		if diag.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
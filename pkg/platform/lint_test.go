@@ -0,0 +1,160 @@
+package platform
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+)
+
+// collectFiles writes files to a temporary directory and adds them to a new
+// CollectInfo. It returns the directory.
+func collectFiles(t *testing.T, files map[string]string) (*parse.CollectInfo, string) {
+	t.Helper()
+	dir := t.TempDir()
+	filenames := []string{}
+	for name, src := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filename, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		filenames = append(filenames, filename)
+	}
+	info := parse.NewCollectInfo()
+	if err := info.AddTraceFiles(filenames); err != nil {
+		t.Fatal(err)
+	}
+	return info, dir
+}
+
+// checkDiagnostics compares diagnostics with the lines they print, the file
+// names relative to dir
+func checkDiagnostics(t *testing.T, dir string, diags []Diagnostic, want []string) {
+	t.Helper()
+	got := []string{}
+	for _, diag := range diags {
+		got = append(got, strings.TrimPrefix(diag.String(), dir+string(filepath.Separator)))
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got:\n%s\nwant:\n%s", strings.Join(got, "\n"),
+			strings.Join(want, "\n"))
+	}
+}
+
+var testSchema = Schema{
+	parse.FuncExecTime: {
+		Placement: FuncPlacement,
+		Params: map[string]ParamSchema{
+			"name":    {Type: NameParam},
+			"buckets": {Type: BucketsParam},
+			"old":     {Type: NameParam, Deprecated: "name"},
+		},
+	},
+	parse.InnerCounter: {
+		Placement: StmtPlacement,
+		Params: map[string]ParamSchema{
+			"name": {Type: NameParam, Required: true},
+		},
+	},
+	parse.RegionBegin: {
+		Placement: StmtPlacement,
+		Params: map[string]ParamSchema{
+			"name": {Type: NameParam, Required: true},
+		},
+	},
+}
+
+const lintSource = `package main
+
+// +trace:func-exec-time nmae=x
+func a() {}
+
+// +trace:func-exec-time buckets=1,0.5 old=x
+func b() {
+	// +trace:inner-counter
+	c()
+	// +trace:func-exec-time name=1x
+	c()
+	// +trace:region-begin name=r
+	c()
+}
+
+// +trace:no-such
+var x = 1
+
+// +trace:chan-depth
+var ch chan int
+
+func c() {}
+`
+
+func TestLintDirectives(t *testing.T) {
+	info, dir := collectFiles(t, map[string]string{"main.go": lintSource})
+	diags := LintDirectives(info, testSchema, "test", info.Files())
+	checkDiagnostics(t, dir, diags, []string{
+		`main.go:3:1: warning: unknown parameter "nmae" of func-exec-time, did you mean "name"?`,
+		`main.go:6:1: error: invalid buckets of func-exec-time: buckets must be in increasing order`,
+		`main.go:6:1: warning: parameter "old" of func-exec-time is deprecated, use "name"`,
+		`main.go:8:2: error: inner-counter requires parameter "name"`,
+		`main.go:10:2: error: func-exec-time must be placed before a function declaration`,
+		`main.go:10:2: error: invalid name of func-exec-time: "1x" is not a valid name, use letters, digits and underscores`,
+		`main.go:12:2: error: region-begin "r" without region-end`,
+		`main.go:16:1: error: unknown trace directive "no-such"`,
+		`main.go:19:1: error: chan-depth is not supported by the test provider`,
+	})
+}
+
+// testNamer generates the identifier, the metric, the kind and the label of
+// the parameters of a directive
+type testNamer struct{}
+
+func (testNamer) GeneratedNames(info *parse.CollectInfo,
+	directive *parse.Directive,
+) []GeneratedName {
+	name := GeneratedName{}
+	name.Ident, _ = directive.Param("ident")
+	name.Metric, _ = directive.Param("metric")
+	name.Kind, _ = directive.Param("kind")
+	if label, ok := directive.Param("label"); ok {
+		name.Labels = []string{label}
+	}
+	return []GeneratedName{name}
+}
+
+const namesSource = `package main
+
+// +trace:func-exec-time ident=x metric=m kind=counter
+func a() {}
+
+// +trace:func-exec-time ident=x
+func b() {}
+
+// +trace:func-exec-time metric=m kind=gauge
+func c() {}
+
+// +trace:func-exec-time metric=m kind=counter label=l
+func d() {}
+
+// +trace:func-exec-time metric=m kind=counter
+func e() {}
+`
+
+func TestLintGeneratedNames(t *testing.T) {
+	info, dir := collectFiles(t, map[string]string{
+		"main.go": namesSource,
+		// the same identifier in another package
+		"sub/sub.go": "package sub\n\n// +trace:func-exec-time ident=x\nfunc f() {}\n",
+	})
+	diags := LintGeneratedNames(info, testNamer{})
+	at := filepath.Join(dir, "main.go") + ":3"
+	checkDiagnostics(t, dir, diags, []string{
+		`main.go:6:1: error: generated identifier "x" is already declared for the directive at ` + at,
+		`main.go:9:1: error: metric "m" is a gauge without labels but a counter without labels for the directive at ` + at,
+		`main.go:12:1: error: metric "m" is a counter with labels l but a counter without labels for the directive at ` + at,
+	})
+}
@@ -0,0 +1,40 @@
+package platform
+
+import (
+	"fmt"
+
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/utils"
+)
+
+// FetchModulePackages adds the packages needed by the generated code to the
+// go.mod of every module with directives, together with the logger of the slow
+// calls selected by the definition directive of the module
+func FetchModulePackages(d *parse.CollectInfo, pkgs []string) error {
+	goMods := d.GoModPaths()
+	if len(goMods) == 0 {
+		return fmt.Errorf("go.mod does not exist")
+	}
+	for _, goMod := range goMods {
+		modulePkgs := append(append([]string{}, pkgs...),
+			SlowLogModules(d, goMod)...)
+		if err := utils.FetchPackages(goMod, modulePkgs); err != nil {
+			return fmt.Errorf("%s: %v", goMod, err)
+		}
+	}
+	return nil
+}
+
+// FetchOverlayPackages adds the packages needed by the generated code to the
+// go.mod copy in the overlay directory
+func FetchOverlayPackages(d *parse.CollectInfo, pkgs []string,
+	overlayDir string,
+) error {
+	goMod, err := OverlayGoModPath(d)
+	if err != nil {
+		return err
+	}
+	return utils.FetchPackages(goMod,
+		append(append([]string{}, pkgs...), SlowLogModules(d, goMod)...),
+		OverlayModFileFlag(overlayDir))
+}
@@ -0,0 +1,46 @@
+package platform
+
+import (
+	"path/filepath"
+	"regexp"
+
+	"github.com/dave/dst"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+)
+
+// characters that can not be used in generated identifiers
+var nonIdentRegexp = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// FileName returns the name of a file used in generated identifiers and
+// metric names, its base name without extension. If the definition directive
+// of its module has pkg-path=true, the import path of the package is prepended so that files
+// with the same name in different packages do not collide.
+func FileName(d *parse.CollectInfo, fullpath string) string {
+	base := filepath.Base(fullpath)
+	name := base[:len(base)-len(filepath.Ext(base))]
+	if def := d.DefinitionDirective(fullpath); def != nil {
+		if v, ok := def.Param("pkg-path"); ok && v == "true" {
+			pkg := d.PackagePath(fullpath)
+			if pkg == "" {
+				pkg = d.PackageName(fullpath)
+			}
+			name = pkg + "_" + name
+		}
+	}
+	return nonIdentRegexp.ReplaceAllString(name, "_")
+}
+
+// FuncName returns the name of the function of a directive used in generated
+// identifiers and metric names. Methods are prefixed with the name of their
+// receiver type, e.g. Server_Close, so that the methods of different types do
+// not collide. Type parameters of generic receivers are left out.
+func FuncName(d *parse.CollectInfo, directive *parse.Directive) string {
+	funcDecl, ok := directive.Declaration().(*dst.FuncDecl)
+	if !ok {
+		return ""
+	}
+	if recv := d.ReceiverTypeName(directive.Filename(), funcDecl); recv != "" {
+		return recv + "_" + funcDecl.Name.Name
+	}
+	return funcDecl.Name.Name
+}
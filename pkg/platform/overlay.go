@@ -0,0 +1,127 @@
+package platform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dave/dst/decorator"
+	log "github.com/sirupsen/logrus"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+)
+
+const (
+	// name of the overlay file for "go build -overlay"
+	OverlayFile = "overlay.json"
+	// name of the go.mod copy for "go build -modfile"
+	OverlayModFile = "go.mod"
+)
+
+// overlay file format of "go build -overlay"
+type overlayJSON struct {
+	Replace map[string]string
+}
+
+// StoreOverlay writes the modified files into the overlay directory instead of
+// the original location, together with an overlay file that maps the original
+// files to the patched ones. The go.mod and go.sum files are copied as well so
+// that the needed packages can be added without changing the original ones.
+func StoreOverlay(d *parse.CollectInfo, overlayDir string, dryRun bool) error {
+	overlay := overlayJSON{Replace: make(map[string]string)}
+	for _, filename := range d.Files() {
+		if !d.IsModified(filename) {
+			continue
+		}
+
+		absPath, err := filepath.Abs(filename)
+		if err != nil {
+			return err
+		}
+		newFilename := filepath.Join(overlayDir, "src", absPath)
+		overlay.Replace[absPath] = newFilename
+
+		// put new content into a buffer
+		var buf bytes.Buffer
+		if err := decorator.Fprint(&buf, d.FileDst(filename)); err != nil {
+			return err
+		}
+
+		log.Infof("writing to %s", newFilename)
+		if dryRun {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(newFilename), 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(newFilename, buf.Bytes(), 0o644); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(overlay, "", "\t")
+	if err != nil {
+		return err
+	}
+	log.Infof("writing overlay to %s", filepath.Join(overlayDir, OverlayFile))
+	if dryRun {
+		return nil
+	}
+	if err := os.WriteFile(filepath.Join(overlayDir, OverlayFile), data,
+		0o644); err != nil {
+		return err
+	}
+
+	// copy go.mod and go.sum
+	goMod, err := OverlayGoModPath(d)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"go.mod", "go.sum"} {
+		src := filepath.Join(filepath.Dir(goMod), name)
+		data, err := os.ReadFile(src)
+		if os.IsNotExist(err) && name == "go.sum" {
+			continue
+		} else if err != nil {
+			return err
+		}
+		// go.sum has to be next to the go.mod copy
+		if err := os.WriteFile(filepath.Join(overlayDir, name), data,
+			0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OverlayGoModPath returns the go.mod that is copied into the overlay
+// directory. "go build -modfile" replaces a single go.mod so all the patched
+// files have to be in the same module.
+func OverlayGoModPath(d *parse.CollectInfo) (string, error) {
+	goMods := d.GoModPaths()
+	switch len(goMods) {
+	case 0:
+		return "", fmt.Errorf("go.mod is required for overlay")
+	case 1:
+		return goMods[0], nil
+	}
+	return "", fmt.Errorf("overlay supports a single module, found %s",
+		strings.Join(goMods, ", "))
+}
+
+// OverlayModFileFlag returns the go command flag to use the go.mod copy in the
+// overlay directory
+func OverlayModFileFlag(overlayDir string) string {
+	return fmt.Sprintf("-modfile=%s", filepath.Join(overlayDir, OverlayModFile))
+}
+
+// OverlayGoFlags returns the go command flags to build with the overlay
+// directory
+func OverlayGoFlags(overlayDir string) []string {
+	return []string{
+		fmt.Sprintf("-overlay=%s", filepath.Join(overlayDir, OverlayFile)),
+		OverlayModFileFlag(overlayDir),
+	}
+}
@@ -0,0 +1,89 @@
+package platform
+
+import (
+	"fmt"
+	"go/token"
+	"strconv"
+
+	"github.com/dave/dst"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+)
+
+// LogStack checks if the stack of a recovered panic has to be logged
+func LogStack(directive *parse.Directive) bool {
+	v, ok := directive.Param("log-stack")
+	return ok && v == "true"
+}
+
+// RecoverStmt returns the statement of a deferred function that recovers a
+// panic, runs record, optionally logs the stack and panics again with the same
+// value. The returned idents have to be added to the patch table.
+//
+//	if r := recover(); r != nil {
+//		record...
+//		log.Printf("panic in funcname: %v\n%s", r, debug.Stack())
+//		panic(r)
+//	}
+func RecoverStmt(funcName string, record []dst.Stmt,
+	logStack bool,
+) (dst.Stmt, []*dst.Ident) {
+	patchTable := []*dst.Ident{}
+	body := append([]dst.Stmt{}, record...)
+	if logStack {
+		logPkg := dst.NewIdent("log")
+		debugPkg := dst.NewIdent("debug")
+		patchTable = append(patchTable, logPkg, debugPkg)
+		body = append(body, &dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{X: logPkg, Sel: dst.NewIdent("Printf")},
+				Args: []dst.Expr{
+					&dst.BasicLit{
+						Kind:  token.STRING,
+						Value: strconv.Quote(fmt.Sprintf("panic in %s: %%v\n%%s", funcName)),
+					},
+					dst.NewIdent("r"),
+					&dst.CallExpr{
+						Fun: &dst.SelectorExpr{X: debugPkg, Sel: dst.NewIdent("Stack")},
+					},
+				},
+			},
+		})
+	}
+	body = append(body, &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun:  dst.NewIdent("panic"),
+			Args: []dst.Expr{dst.NewIdent("r")},
+		},
+	})
+	return &dst.IfStmt{
+		Init: &dst.AssignStmt{
+			Lhs: []dst.Expr{dst.NewIdent("r")},
+			Tok: token.DEFINE,
+			Rhs: []dst.Expr{&dst.CallExpr{Fun: dst.NewIdent("recover")}},
+		},
+		Cond: &dst.BinaryExpr{
+			X:  dst.NewIdent("r"),
+			Op: token.NEQ,
+			Y:  dst.NewIdent("nil"),
+		},
+		Body: &dst.BlockStmt{List: body},
+	}, patchTable
+}
+
+// PkgsWithStackLog returns pkgs with the packages needed to log the stack of
+// a recovered panic added
+func PkgsWithStackLog(pkgs map[string]*parse.PackageInfo,
+	directive *parse.Directive,
+) map[string]*parse.PackageInfo {
+	if !LogStack(directive) {
+		return pkgs
+	}
+	res := map[string]*parse.PackageInfo{
+		"log":   {Name: "log", Path: "log"},
+		"debug": {Name: "debug", Path: "runtime/debug"},
+	}
+	for k, v := range pkgs {
+		res[k] = v
+	}
+	return res
+}
@@ -0,0 +1,149 @@
+package prometheus
+
+import (
+	"fmt"
+
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/platform"
+)
+
+// funcVarName returns the variable of the metric of a function directive, it
+// is also the name of the metric. The name parameter is used if given,
+// otherwise the file, the function and the suffix.
+func funcVarName(directive *parse.Directive, filename string, funcname string,
+	suffix string,
+) string {
+	if val, ok := directive.Param("name"); ok {
+		if val == funcname {
+			return fmt.Sprintf("fn_%s", funcname)
+		}
+		return val
+	}
+	return fmt.Sprintf("%s_%s_%s", filename, funcname, suffix)
+}
+
+// inFlightVarName returns the variable of the in-flight gauge of a function.
+// The directives with the same name parameter share the gauge through the
+// registry, so their variables contain the directive id.
+func inFlightVarName(directive *parse.Directive, filename string,
+	funcname string, id string,
+) string {
+	if _, ok := directive.Param("name"); ok {
+		return fmt.Sprintf("%s_%s_%s_in_flight", filename, funcname, id)
+	}
+	return funcVarName(directive, filename, funcname, "in_flight")
+}
+
+// innerBaseName returns the name of the metric of an inner directive, the
+// directives with the same name in a function share it
+func innerBaseName(filename string, funcname string, name string) string {
+	return fmt.Sprintf("%s_%s_%s", filename, funcname, name)
+}
+
+// chanDepthName returns the name the metrics of a chan-depth directive start
+// with
+func chanDepthName(filename string, varName string,
+	directive *parse.Directive,
+) string {
+	if v, ok := directive.Param("name"); ok && v != "" {
+		return v
+	}
+	return fmt.Sprintf("%s_%s", filename, varName)
+}
+
+// GeneratedNames implements platform.Namer. Only the variables named after the
+// name parameter can collide, the other ones contain the directive id.
+func (p *prometheusProvider) GeneratedNames(d *parse.CollectInfo,
+	directive *parse.Directive,
+) []platform.GeneratedName {
+	p.setDefaults(d, directive.Filename())
+	filename := platform.FileName(d, directive.Filename())
+	funcname := platform.FuncName(d, directive)
+	name, _ := directive.Param("name")
+	// invalid labels are reported with the directive
+	labels, _ := directive.Labels()
+
+	funcMetric := func(suffix string, kind string, extra ...string) []platform.GeneratedName {
+		varName := funcVarName(directive, filename, funcname, suffix)
+		return []platform.GeneratedName{{
+			Ident:  varName,
+			Metric: p.metricsName(varName),
+			Kind:   kind,
+			Labels: labelNames(labels, extra...),
+		}}
+	}
+	metric := func(metricsName string, kind string, labels ...string) platform.GeneratedName {
+		return platform.GeneratedName{
+			Metric: p.metricsName(metricsName),
+			Kind:   kind,
+			Labels: labels,
+		}
+	}
+
+	switch directive.TraceType() {
+	case parse.FuncExecTime:
+		return funcMetric("duration", p.observerType(directive))
+	case parse.InnerExecTime:
+		if name == "" {
+			return nil
+		}
+		return funcMetric(fmt.Sprintf("%s_duration", name),
+			p.observerType(directive))
+	case parse.FuncErrorCount:
+		return funcMetric("errors", "counter", "result")
+	case parse.FuncInFlight:
+		return []platform.GeneratedName{
+			metric(funcVarName(directive, filename, funcname, "in_flight"),
+				"gauge", labelNames(labels)...),
+		}
+	case parse.FuncPanicCount:
+		return funcMetric("panics", "counter")
+	case parse.InnerCounter, parse.InnerGauge, parse.InnerObserve:
+		if name == "" {
+			return nil
+		}
+		kind := map[parse.TraceType]string{
+			parse.InnerCounter: "counter",
+			parse.InnerGauge:   "gauge",
+			parse.InnerObserve: "histogram",
+		}[directive.TraceType()]
+		return []platform.GeneratedName{
+			metric(innerBaseName(filename, funcname, name), kind,
+				labelNames(labels)...),
+		}
+	case parse.RegionBegin:
+		if name == "" {
+			return nil
+		}
+		return []platform.GeneratedName{
+			metric(name, p.observerType(directive), labelNames(labels)...),
+		}
+	case parse.GoSpawn:
+		if name == "" {
+			return nil
+		}
+		return []platform.GeneratedName{
+			metric(fmt.Sprintf("%s_spawns", name), "counter"),
+			metric(fmt.Sprintf("%s_goroutines", name), "gauge"),
+		}
+	case parse.LockWait:
+		if name == "" {
+			return nil
+		}
+		return []platform.GeneratedName{
+			metric(fmt.Sprintf("%s_wait", name), "histogram"),
+			metric(fmt.Sprintf("%s_hold", name), "histogram"),
+		}
+	case parse.ChanDepth:
+		varName, err := d.ChanVarName(*directive)
+		if err != nil {
+			return nil
+		}
+		name := chanDepthName(filename, varName, directive)
+		return []platform.GeneratedName{
+			metric(fmt.Sprintf("%s_len", name), "gauge"),
+			metric(fmt.Sprintf("%s_cap", name), "gauge"),
+		}
+	}
+	return nil
+}
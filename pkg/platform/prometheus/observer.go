@@ -0,0 +1,210 @@
+package prometheus
+
+import (
+	"fmt"
+	"go/token"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dave/dst"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/platform"
+)
+
+// objectives of the generated summaries if none are given
+var defaultObjectives = []platform.Objective{
+	{Quantile: 0.5, Error: 0.05},
+	{Quantile: 0.9, Error: 0.01},
+	{Quantile: 0.99, Error: 0.001},
+}
+
+// setDefaults selects the parameters of the definition directive of the
+// module of a file as defaults, every module has its own
+func (p *prometheusProvider) setDefaults(d *parse.CollectInfo, filename string) {
+	p.defaults = nil
+	if def := d.DefinitionDirective(filename); def != nil {
+		p.defaults = def.Params()
+	}
+}
+
+// observerParam returns a parameter of a directive, or its default from the
+// definition directive
+func (p *prometheusProvider) observerParam(directive *parse.Directive,
+	name string,
+) (string, bool) {
+	if v, ok := directive.Param(name); ok {
+		return v, true
+	}
+	v, ok := p.defaults[name]
+	return v, ok
+}
+
+// observerType returns the prom-type of a directive. Buckets written on the
+// directive imply a histogram and objectives imply a summary, otherwise the
+// type defaults to the one of the definition directive.
+func (p *prometheusProvider) observerType(directive *parse.Directive) string {
+	if v, ok := directive.Param("prom-type"); ok {
+		return v
+	}
+	if _, ok := directive.Param("prom-buckets"); ok {
+		return "histogram"
+	}
+	for _, name := range []string{"prom-objectives", "prom-max-age"} {
+		if _, ok := directive.Param(name); ok {
+			return "summary"
+		}
+	}
+	if v, ok := p.defaults["prom-type"]; ok {
+		return v
+	}
+	return "summary"
+}
+
+// observerOpts returns the kind of the metric that observes the durations of
+// a directive, "Summary" or "Histogram", and the options of its declaration.
+// The prom-type, prom-buckets, prom-objectives and prom-max-age parameters of
+// the directive override the ones of the definition directive.
+func (p *prometheusProvider) observerOpts(directive *parse.Directive,
+) (string, []dst.Expr, []*dst.Ident, error) {
+	var kind string
+	switch v := p.observerType(directive); v {
+	case "histogram":
+		kind = "Histogram"
+	case "summary":
+		kind = "Summary"
+	default:
+		return "", nil, nil, fmt.Errorf("unknown prom-type %q, use histogram "+
+			"or summary", v)
+	}
+
+	// options of the other kind are only allowed as defaults
+	mismatched := []string{"prom-buckets"}
+	if kind == "Histogram" {
+		mismatched = []string{"prom-objectives", "prom-max-age"}
+	}
+	for _, name := range mismatched {
+		if _, ok := directive.Param(name); ok {
+			return "", nil, nil, fmt.Errorf("%s is not supported by a %s",
+				name, strings.ToLower(kind))
+		}
+	}
+
+	if kind == "Histogram" {
+		opts, patchTable, err := p.histogramOpts(directive)
+		return kind, opts, patchTable, err
+	}
+
+	opts := []dst.Expr{}
+	patchTable := []*dst.Ident{}
+	objectives := defaultObjectives
+	if v, ok := p.observerParam(directive, "prom-objectives"); ok {
+		var err error
+		if objectives, err = platform.ParseObjectives(v); err != nil {
+			return "", nil, nil, err
+		}
+	}
+	opts = append(opts, objectivesExpr(objectives))
+	if v, ok := p.observerParam(directive, "prom-max-age"); ok {
+		maxAge, err := time.ParseDuration(v)
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("%q is not a duration", v)
+		}
+		expr, ident := platform.DurationExpr(maxAge)
+		patchTable = append(patchTable, ident)
+		opts = append(opts, &dst.KeyValueExpr{
+			Key:   dst.NewIdent("MaxAge"),
+			Value: expr,
+		})
+	}
+	return kind, opts, patchTable, nil
+}
+
+// histogramOpts returns the options of a histogram declaration, the buckets of
+// the directive or the default buckets of the definition directive
+func (p *prometheusProvider) histogramOpts(directive *parse.Directive,
+) ([]dst.Expr, []*dst.Ident, error) {
+	opts := []dst.Expr{}
+	patchTable := []*dst.Ident{}
+	if v, ok := p.observerParam(directive, "prom-buckets"); ok {
+		buckets, err := platform.ParseBuckets(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		expr, ident := bucketsExpr(buckets)
+		if ident != nil {
+			patchTable = append(patchTable, ident)
+		}
+		opts = append(opts, &dst.KeyValueExpr{
+			Key:   dst.NewIdent("Buckets"),
+			Value: expr,
+		})
+	}
+	return opts, patchTable, nil
+}
+
+// floatLit returns a float64 literal
+func floatLit(v float64) dst.Expr {
+	return &dst.BasicLit{
+		Kind:  token.FLOAT,
+		Value: strconv.FormatFloat(v, 'g', -1, 64),
+	}
+}
+
+// bucketsExpr returns the buckets of a histogram, the returned ident has to be
+// added to the patch table if not nil
+//
+//	[]float64{0.005, 0.01, 0.1}
+//	prometheus.ExponentialBuckets(0.001, 2, 16)
+func bucketsExpr(buckets *platform.Buckets) (dst.Expr, *dst.Ident) {
+	if buckets.Func == "" {
+		elts := []dst.Expr{}
+		for _, v := range buckets.Values {
+			elts = append(elts, floatLit(v))
+		}
+		return &dst.CompositeLit{
+			Type: &dst.ArrayType{Elt: dst.NewIdent("float64")},
+			Elts: elts,
+		}, nil
+	}
+
+	fun := "ExponentialBuckets"
+	if buckets.Func == "lin" {
+		fun = "LinearBuckets"
+	}
+	pkg := dst.NewIdent("prometheus")
+	return &dst.CallExpr{
+		Fun: &dst.SelectorExpr{X: pkg, Sel: dst.NewIdent(fun)},
+		Args: []dst.Expr{
+			floatLit(buckets.Values[0]),
+			floatLit(buckets.Values[1]),
+			&dst.BasicLit{
+				Kind:  token.INT,
+				Value: strconv.Itoa(int(buckets.Values[2])),
+			},
+		},
+	}, pkg
+}
+
+// objectivesExpr returns the objectives option of a summary
+//
+//	Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
+func objectivesExpr(objectives []platform.Objective) dst.Expr {
+	elts := []dst.Expr{}
+	for _, o := range objectives {
+		elts = append(elts, &dst.KeyValueExpr{
+			Key:   floatLit(o.Quantile),
+			Value: floatLit(o.Error),
+		})
+	}
+	return &dst.KeyValueExpr{
+		Key: dst.NewIdent("Objectives"),
+		Value: &dst.CompositeLit{
+			Type: &dst.MapType{
+				Key:   dst.NewIdent("float64"),
+				Value: dst.NewIdent("float64"),
+			},
+			Elts: elts,
+		},
+	}
+}
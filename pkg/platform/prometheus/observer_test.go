@@ -0,0 +1,66 @@
+package prometheus
+
+import (
+	"bytes"
+	"go/token"
+	"strings"
+	"testing"
+
+	"github.com/dave/dst"
+	"github.com/dave/dst/decorator"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/platform"
+)
+
+// exprString prints a generated expression
+func exprString(t *testing.T, expr dst.Expr) string {
+	t.Helper()
+	file := &dst.File{
+		Name: dst.NewIdent("p"),
+		Decls: []dst.Decl{&dst.GenDecl{
+			Tok: token.VAR,
+			Specs: []dst.Spec{&dst.ValueSpec{
+				Names:  []*dst.Ident{dst.NewIdent("_")},
+				Values: []dst.Expr{&dst.CompositeLit{Elts: []dst.Expr{expr}}},
+			}},
+		}},
+	}
+	var buf bytes.Buffer
+	if err := decorator.Fprint(&buf, file); err != nil {
+		t.Fatal(err)
+	}
+	_, res, _ := strings.Cut(buf.String(), "var _ = {")
+	return strings.TrimSuffix(strings.TrimSpace(res), "}")
+}
+
+func TestBucketsExpr(t *testing.T) {
+	tests := map[string]string{
+		"0.005, 0.01,0.1": "[]float64{0.005, 0.01, 0.1}",
+		"exp:0.001,2,10":  "prometheus.ExponentialBuckets(0.001, 2, 10)",
+		"lin:0,0.5,4":     "prometheus.LinearBuckets(0, 0.5, 4)",
+	}
+	for text, want := range tests {
+		buckets, err := platform.ParseBuckets(text)
+		if err != nil {
+			t.Fatalf("%q: %v", text, err)
+		}
+		expr, ident := bucketsExpr(buckets)
+		if got := exprString(t, expr); got != want {
+			t.Errorf("%q: got %s, want %s", text, got, want)
+		}
+		// only the bucket functions refer to the prometheus package
+		if (ident != nil) != strings.HasPrefix(want, "prometheus.") {
+			t.Errorf("%q: got patched ident %v", text, ident)
+		}
+	}
+}
+
+func TestObjectivesExpr(t *testing.T) {
+	objectives, err := platform.ParseObjectives("0.5:0.05, 0.99:0.001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Objectives: map[float64]float64{0.5: 0.05, 0.99: 0.001}"
+	if got := exprString(t, objectivesExpr(objectives)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
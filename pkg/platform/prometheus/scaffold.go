@@ -0,0 +1,544 @@
+package prometheus
+
+import (
+	"fmt"
+	"go/token"
+	"strconv"
+
+	"github.com/dave/dst"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/platform"
+)
+
+// metricsName returns the prometheus name of a metric
+func (p *prometheusProvider) metricsName(baseName string) string {
+	if p.metricsPrefix != "" {
+		return fmt.Sprintf("%s_%s", p.metricsPrefix, baseName)
+	}
+	return baseName
+}
+
+// lazyRegisterDecls returns the variables used to register a metric the first
+// time it is used
+//
+//	var name_initialized bool = false
+//	var name_mutex sync.Mutex
+func lazyRegisterDecls(varName string) ([]dst.Decl, []*dst.Ident) {
+	g := []dst.Decl{
+		&dst.GenDecl{
+			Tok: token.VAR,
+			Specs: []dst.Spec{
+				&dst.ValueSpec{
+					Names: []*dst.Ident{
+						{Name: fmt.Sprintf("%s_initialized", varName)},
+					},
+					Type: &dst.Ident{Name: "bool"},
+					Values: []dst.Expr{
+						&dst.Ident{Name: "false"},
+					},
+				},
+			},
+		},
+		&dst.GenDecl{
+			Tok: token.VAR,
+			Specs: []dst.Spec{
+				&dst.ValueSpec{
+					Names: []*dst.Ident{
+						{Name: fmt.Sprintf("%s_mutex", varName)},
+					},
+					Type: &dst.SelectorExpr{
+						X:   dst.NewIdent("sync"),
+						Sel: dst.NewIdent("Mutex"),
+					},
+				},
+			},
+		},
+	}
+	// add sync
+	patchTable := []*dst.Ident{
+		g[1].(*dst.GenDecl).Specs[0].(*dst.ValueSpec).
+			Type.(*dst.SelectorExpr).X.(*dst.Ident),
+	}
+	return g, patchTable
+}
+
+// metricDecl returns the declaration of a metric variable, kind is the name of
+// the prometheus metric type such as "Gauge". A metric vector is declared if
+// label names are given, opts are added to the options of the metric.
+//
+//	var name prometheus.Gauge = prometheus.NewGauge(prometheus.GaugeOpts{
+//		Name: "metrics_name",
+//		Help: "metrics_name",
+//	})
+//
+//	var name *prometheus.GaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+//		Name: "metrics_name",
+//		Help: "metrics_name",
+//	}, []string{"label"})
+func metricDecl(varName string, metricsName string, kind string,
+	labels []string, opts ...dst.Expr,
+) (dst.Decl, []*dst.Ident) {
+	typeIdent := &dst.Ident{Name: fmt.Sprintf("prometheus.%s", kind)}
+	var typeExpr dst.Expr = typeIdent
+	newFunc := fmt.Sprintf("New%s", kind)
+	args := []dst.Expr{
+		&dst.CompositeLit{
+			Type: &dst.SelectorExpr{
+				X:   dst.NewIdent("prometheus"),
+				Sel: dst.NewIdent(fmt.Sprintf("%sOpts", kind)),
+			},
+			Elts: append([]dst.Expr{
+				&dst.KeyValueExpr{
+					Key: dst.NewIdent("Name"),
+					Value: &dst.BasicLit{
+						Kind:  token.STRING,
+						Value: fmt.Sprintf("\"%s\"", metricsName),
+					},
+				},
+				&dst.KeyValueExpr{
+					Key: dst.NewIdent("Help"),
+					Value: &dst.BasicLit{
+						Kind:  token.STRING,
+						Value: fmt.Sprintf("\"%s\"", metricsName),
+					},
+				},
+			}, opts...),
+		},
+	}
+	if len(labels) != 0 {
+		typeIdent.Name = fmt.Sprintf("prometheus.%sVec", kind)
+		typeExpr = &dst.StarExpr{X: typeIdent}
+		newFunc = fmt.Sprintf("New%sVec", kind)
+		args = append(args, stringSliceLit(labels...))
+	}
+
+	decl := &dst.GenDecl{
+		Tok: token.VAR,
+		Specs: []dst.Spec{
+			&dst.ValueSpec{
+				Names: []*dst.Ident{
+					{Name: varName},
+				},
+				Type: typeExpr,
+				Values: []dst.Expr{
+					&dst.CallExpr{
+						Fun: &dst.SelectorExpr{
+							X:   dst.NewIdent("prometheus"),
+							Sel: dst.NewIdent(newFunc),
+						},
+						Args: args,
+					},
+				},
+			},
+		},
+	}
+
+	call := decl.Specs[0].(*dst.ValueSpec).Values[0].(*dst.CallExpr)
+	patchTable := []*dst.Ident{
+		// add prometheus.Kind
+		typeIdent,
+		// add 1st prometheus
+		call.Fun.(*dst.SelectorExpr).X.(*dst.Ident),
+		// add 2nd prometheus
+		call.Args[0].(*dst.CompositeLit).Type.(*dst.SelectorExpr).X.(*dst.Ident),
+	}
+	return decl, patchTable
+}
+
+// metricType returns a copy of the type of a metric variable declared by
+// metricDecl, the returned ident has to be added to the patch table
+func metricType(decl dst.Decl) (dst.Expr, *dst.Ident) {
+	typeExpr := dst.Clone(decl.(*dst.GenDecl).Specs[0].(*dst.ValueSpec).Type).(dst.Expr)
+	if star, ok := typeExpr.(*dst.StarExpr); ok {
+		return typeExpr, star.X.(*dst.Ident)
+	}
+	return typeExpr, typeExpr.(*dst.Ident)
+}
+
+// lazyRegisterStmt returns the statement that registers a metric to the
+// metrics_gen registry the first time it is used. Directives with the same
+// metric name share the metric that is registered first, decl is the
+// declaration of the metric variable.
+//
+//	if !name_initialized {
+//		name_mutex.Lock()
+//		if !name_initialized {
+//			reg, err := globalvar.Get("metrics_gen")
+//			if err == nil {
+//				if err := reg.(*prometheus.Registry).Register(name); err != nil {
+//					name = err.(prometheus.AlreadyRegisteredError).ExistingCollector.(prometheus.Gauge)
+//				}
+//				name_initialized = true
+//			}
+//		}
+//		name_mutex.Unlock()
+//	}
+func lazyRegisterStmt(varName string, decl dst.Decl) (dst.Stmt, []*dst.Ident) {
+	initialized := fmt.Sprintf("%s_initialized", varName)
+	mutex := fmt.Sprintf("%s_mutex", varName)
+	getReg := &dst.AssignStmt{
+		Lhs: []dst.Expr{
+			dst.NewIdent("reg"),
+			dst.NewIdent("err"),
+		},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   dst.NewIdent("globalvar"),
+					Sel: dst.NewIdent("Get"),
+				},
+				Args: []dst.Expr{
+					&dst.BasicLit{
+						Kind:  token.STRING,
+						Value: "\"metrics_gen\"",
+					},
+				},
+			},
+		},
+	}
+	registerCall := &dst.CallExpr{
+		Fun: &dst.SelectorExpr{
+			X:   dst.NewIdent("reg"),
+			Sel: dst.NewIdent("(*prometheus.Registry).Register"),
+		},
+		Args: []dst.Expr{
+			dst.NewIdent(varName),
+		},
+	}
+	typeExpr, typeIdent := metricType(decl)
+	alreadyRegistered := dst.NewIdent("prometheus.AlreadyRegisteredError")
+	// a panic is raised if the metric can not be shared like MustRegister does
+	register := &dst.IfStmt{
+		Init: &dst.AssignStmt{
+			Lhs: []dst.Expr{dst.NewIdent("err")},
+			Tok: token.DEFINE,
+			Rhs: []dst.Expr{registerCall},
+		},
+		Cond: &dst.BinaryExpr{
+			X:  dst.NewIdent("err"),
+			Op: token.NEQ,
+			Y:  dst.NewIdent("nil"),
+		},
+		Body: &dst.BlockStmt{
+			List: []dst.Stmt{
+				&dst.AssignStmt{
+					Lhs: []dst.Expr{dst.NewIdent(varName)},
+					Tok: token.ASSIGN,
+					Rhs: []dst.Expr{
+						&dst.TypeAssertExpr{
+							X: &dst.SelectorExpr{
+								X: &dst.TypeAssertExpr{
+									X:    dst.NewIdent("err"),
+									Type: alreadyRegistered,
+								},
+								Sel: dst.NewIdent("ExistingCollector"),
+							},
+							Type: typeExpr,
+						},
+					},
+				},
+			},
+		},
+	}
+	stmt := &dst.IfStmt{
+		Cond: &dst.UnaryExpr{
+			Op: token.NOT,
+			X:  dst.NewIdent(initialized),
+		},
+		Body: &dst.BlockStmt{
+			List: []dst.Stmt{
+				&dst.ExprStmt{
+					X: &dst.CallExpr{
+						Fun: &dst.SelectorExpr{
+							X:   dst.NewIdent(mutex),
+							Sel: dst.NewIdent("Lock"),
+						},
+					},
+				},
+				&dst.IfStmt{
+					Cond: &dst.UnaryExpr{
+						Op: token.NOT,
+						X:  dst.NewIdent(initialized),
+					},
+					Body: &dst.BlockStmt{
+						List: []dst.Stmt{
+							getReg,
+							&dst.IfStmt{
+								Cond: &dst.BinaryExpr{
+									X:  dst.NewIdent("err"),
+									Op: token.EQL,
+									Y:  dst.NewIdent("nil"),
+								},
+								Body: &dst.BlockStmt{
+									List: []dst.Stmt{
+										register,
+										&dst.AssignStmt{
+											Lhs: []dst.Expr{
+												dst.NewIdent(initialized),
+											},
+											Tok: token.ASSIGN,
+											Rhs: []dst.Expr{
+												dst.NewIdent("true"),
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+				&dst.ExprStmt{
+					X: &dst.CallExpr{
+						Fun: &dst.SelectorExpr{
+							X:   dst.NewIdent(mutex),
+							Sel: dst.NewIdent("Unlock"),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	patchTable := []*dst.Ident{
+		// add globalvar
+		getReg.Rhs[0].(*dst.CallExpr).Fun.(*dst.SelectorExpr).X.(*dst.Ident),
+		// add (*prometheus.Registry).Register
+		registerCall.Fun.(*dst.SelectorExpr).Sel,
+		// add prometheus.AlreadyRegisteredError
+		alreadyRegistered,
+		// add prometheus.Kind
+		typeIdent,
+	}
+	return stmt, patchTable
+}
+
+// name of the global variable keeping the functions that register the
+// collectors of the package initializations run before the metrics_gen registry
+// is published
+const pendingRegistersName = "metrics_gen_pending"
+
+// globalvarCall returns a call of a function of globalvar and the ident to
+// add to the patch table
+func globalvarCall(fn string, args ...dst.Expr) (*dst.CallExpr, *dst.Ident) {
+	pkg := dst.NewIdent("globalvar")
+	return &dst.CallExpr{
+		Fun:  &dst.SelectorExpr{X: pkg, Sel: dst.NewIdent(fn)},
+		Args: args,
+	}, pkg
+}
+
+// registerCollectorsStmt returns the statement that registers collectors to
+// the registry reg. A collector already registered with the same name is kept
+// like lazyRegisterStmt does, other errors raise a panic like MustRegister.
+//
+//	for _, c := range []prometheus.Collector{...} {
+//		if err := reg.(*prometheus.Registry).Register(c); err != nil {
+//			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+//				panic(err)
+//			}
+//		}
+//	}
+func registerCollectorsStmt(collectors []dst.Expr) (dst.Stmt, []*dst.Ident) {
+	collectorsType := dst.NewIdent("prometheus.Collector")
+	registerFun := dst.NewIdent("(*prometheus.Registry).Register")
+	alreadyRegistered := dst.NewIdent("prometheus.AlreadyRegisteredError")
+	stmt := &dst.RangeStmt{
+		Key:   dst.NewIdent("_"),
+		Value: dst.NewIdent("c"),
+		Tok:   token.DEFINE,
+		X: &dst.CompositeLit{
+			Type: &dst.ArrayType{Elt: collectorsType},
+			Elts: collectors,
+		},
+		Body: &dst.BlockStmt{
+			List: []dst.Stmt{
+				&dst.IfStmt{
+					Init: &dst.AssignStmt{
+						Lhs: []dst.Expr{dst.NewIdent("err")},
+						Tok: token.DEFINE,
+						Rhs: []dst.Expr{
+							&dst.CallExpr{
+								Fun: &dst.SelectorExpr{
+									X:   dst.NewIdent("reg"),
+									Sel: registerFun,
+								},
+								Args: []dst.Expr{dst.NewIdent("c")},
+							},
+						},
+					},
+					Cond: &dst.BinaryExpr{
+						X:  dst.NewIdent("err"),
+						Op: token.NEQ,
+						Y:  dst.NewIdent("nil"),
+					},
+					Body: &dst.BlockStmt{
+						List: []dst.Stmt{
+							&dst.IfStmt{
+								Init: &dst.AssignStmt{
+									Lhs: []dst.Expr{
+										dst.NewIdent("_"),
+										dst.NewIdent("ok"),
+									},
+									Tok: token.DEFINE,
+									Rhs: []dst.Expr{
+										&dst.TypeAssertExpr{
+											X:    dst.NewIdent("err"),
+											Type: alreadyRegistered,
+										},
+									},
+								},
+								Cond: &dst.UnaryExpr{
+									Op: token.NOT,
+									X:  dst.NewIdent("ok"),
+								},
+								Body: &dst.BlockStmt{
+									List: []dst.Stmt{
+										&dst.ExprStmt{
+											X: &dst.CallExpr{
+												Fun:  dst.NewIdent("panic"),
+												Args: []dst.Expr{dst.NewIdent("err")},
+											},
+										},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	return stmt, []*dst.Ident{collectorsType, registerFun, alreadyRegistered}
+}
+
+// pendingRegistersType is the type of the functions kept in the
+// metrics_gen_pending global variable
+func pendingRegistersType() dst.Expr {
+	return &dst.ArrayType{
+		Elt: &dst.FuncType{
+			Params: &dst.FieldList{
+				List: []*dst.Field{{Type: dst.NewIdent("interface{}")}},
+			},
+		},
+	}
+}
+
+// publishRegistryStmts returns the statements that publish the registry regName
+// as the metrics_gen registry and run the registrations that waited for it
+//
+//	globalvar.Set("metrics_gen", reg)
+//	if pending, err := globalvar.Get("metrics_gen_pending"); err == nil {
+//		for _, register := range pending.([]func(interface{})) {
+//			register(reg)
+//		}
+//	}
+func publishRegistryStmts(regName string) ([]dst.Stmt, []*dst.Ident) {
+	set, setPkg := globalvarCall("Set",
+		&dst.BasicLit{Kind: token.STRING, Value: "\"metrics_gen\""},
+		dst.NewIdent(regName))
+	get, getPkg := globalvarCall("Get",
+		&dst.BasicLit{Kind: token.STRING, Value: strconv.Quote(pendingRegistersName)})
+	stmts := []dst.Stmt{
+		&dst.ExprStmt{X: set},
+		&dst.IfStmt{
+			Init: &dst.AssignStmt{
+				Lhs: []dst.Expr{dst.NewIdent("pending"), dst.NewIdent("err")},
+				Tok: token.DEFINE,
+				Rhs: []dst.Expr{get},
+			},
+			Cond: &dst.BinaryExpr{
+				X:  dst.NewIdent("err"),
+				Op: token.EQL,
+				Y:  dst.NewIdent("nil"),
+			},
+			Body: &dst.BlockStmt{
+				List: []dst.Stmt{
+					&dst.RangeStmt{
+						Key:   dst.NewIdent("_"),
+						Value: dst.NewIdent("register"),
+						Tok:   token.DEFINE,
+						X: &dst.TypeAssertExpr{
+							X:    dst.NewIdent("pending"),
+							Type: pendingRegistersType(),
+						},
+						Body: &dst.BlockStmt{
+							List: []dst.Stmt{
+								&dst.ExprStmt{
+									X: &dst.CallExpr{
+										Fun:  dst.NewIdent("register"),
+										Args: []dst.Expr{dst.NewIdent(regName)},
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	return stmts, []*dst.Ident{setPkg, getPkg}
+}
+
+// floatExpr converts a Go expression to float64
+func floatExpr(expr dst.Expr) dst.Expr {
+	return &dst.CallExpr{
+		Fun:  dst.NewIdent("float64"),
+		Args: []dst.Expr{expr},
+	}
+}
+
+// stringSliceLit returns a []string literal
+func stringSliceLit(values ...string) dst.Expr {
+	elts := []dst.Expr{}
+	for _, v := range values {
+		elts = append(elts, &dst.BasicLit{
+			Kind:  token.STRING,
+			Value: strconv.Quote(v),
+		})
+	}
+	return &dst.CompositeLit{
+		Type: &dst.ArrayType{Elt: dst.NewIdent("string")},
+		Elts: elts,
+	}
+}
+
+// labelNames returns the names of labels followed by extra label names
+func labelNames(labels []parse.Label, extra ...string) []string {
+	res := []string{}
+	for _, label := range labels {
+		res = append(res, label.Name)
+	}
+	return append(res, extra...)
+}
+
+// labelValues returns the values of labels converted to strings
+func labelValues(labels []parse.Label) ([]dst.Expr, []*dst.Ident) {
+	values := []dst.Expr{}
+	patchTable := []*dst.Ident{}
+	for _, label := range labels {
+		value, ident := platform.LabelValue(label)
+		values = append(values, value)
+		// add fmt
+		patchTable = append(patchTable, ident)
+	}
+	return values, patchTable
+}
+
+// metricExpr returns the expression of a metric. The metric of a vector is
+// selected by label values if any.
+//
+//	name.WithLabelValues(values...)
+func metricExpr(varName string, values []dst.Expr, ellipsis bool) dst.Expr {
+	if len(values) == 0 {
+		return dst.NewIdent(varName)
+	}
+	return &dst.CallExpr{
+		Fun: &dst.SelectorExpr{
+			X:   dst.NewIdent(varName),
+			Sel: dst.NewIdent("WithLabelValues"),
+		},
+		Args:     values,
+		Ellipsis: ellipsis,
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"fmt"
 	"go/token"
 	"os"
-	"path/filepath"
+	"strconv"
 
 	log "github.com/sirupsen/logrus"
 
@@ -21,6 +21,8 @@ type prometheusProvider struct {
 	suffix        string
 	dryRun        bool
 	metricsPrefix string
+	overlayDir    string
+	defaults      map[string]string // parameters of the definition directive of the patched module
 }
 
 const (
@@ -68,25 +70,200 @@ var (
 		},
 	}
 
+	pkgsChanDepthRequired = map[string]*parse.PackageInfo{
+		"prometheus": {
+			Name: "prometheus",
+			Path: "github.com/prometheus/client_golang/prometheus",
+		},
+		"globalvar": {Name: "globalvar", Path: "github.com/wilsonwang371/globalvar/pkg"},
+	}
+
 	pkgsNeedDownload = []string{
 		"github.com/prometheus/client_golang/prometheus",
 		"github.com/wilsonwang371/globalvar",
 		// "github.com/prometheus/client_golang/prometheus/promauto",
 		// "github.com/prometheus/client_golang/prometheus/promhttp",
 	}
+
+	funcExecTimeSchema = &platform.DirectiveSchema{
+		Placement: platform.FuncPlacement,
+		Params: map[string]platform.ParamSchema{
+			"name":   {Type: platform.NameParam},
+			"labels": {Type: platform.LabelsParam},
+			"prom-type": {
+				Type:   platform.StringParam,
+				Values: []string{"histogram", "summary"},
+			},
+			"prom-buckets":    {Type: platform.BucketsParam},
+			"prom-objectives": {Type: platform.ObjectivesParam},
+			"prom-max-age":    {Type: platform.DurationParam},
+			"cooldown":        {Type: platform.DurationParam},
+			"sample-rate":     {Type: platform.RateParam},
+			"slow-threshold":  {Type: platform.DurationParam},
+			"slow-stack":      {Type: platform.IntParam},
+			"gm-cooldown-time": {
+				Type:       platform.DurationParam,
+				Deprecated: "cooldown",
+			},
+		},
+	}
+
+	directiveSchema = platform.Schema{
+		parse.Define: {
+			Placement: platform.DeclPlacement,
+			Params: map[string]platform.ParamSchema{
+				"prom-port":     {Type: platform.PortParam},
+				"prom-route":    {Type: platform.StringParam},
+				"prom-registry": {Type: platform.StringParam},
+				"empty":         {Type: platform.BoolParam},
+				"pkg-path":      {Type: platform.BoolParam},
+				"prom-type": {
+					Type:   platform.StringParam,
+					Values: []string{"histogram", "summary"},
+				},
+				"prom-buckets":    {Type: platform.BucketsParam},
+				"prom-objectives": {Type: platform.ObjectivesParam},
+				"prom-max-age":    {Type: platform.DurationParam},
+				"slow-logger": {
+					Type:   platform.StringParam,
+					Values: platform.SlowLoggerNames,
+				},
+				"slow-log-interval": {Type: platform.DurationParam},
+			},
+		},
+		parse.FuncExecTime:    funcExecTimeSchema,
+		parse.PackageExecTime: platform.PackageSchema(funcExecTimeSchema),
+		parse.FuncErrorCount: {
+			Placement: platform.FuncPlacement,
+			Params: map[string]platform.ParamSchema{
+				"name":   {Type: platform.NameParam},
+				"labels": {Type: platform.LabelsParam},
+			},
+		},
+		parse.FuncInFlight: {
+			Placement: platform.FuncPlacement,
+			Params: map[string]platform.ParamSchema{
+				"name":   {Type: platform.NameParam},
+				"labels": {Type: platform.LabelsParam},
+			},
+		},
+		parse.FuncPanicCount: {
+			Placement: platform.FuncPlacement,
+			Params: map[string]platform.ParamSchema{
+				"name":      {Type: platform.NameParam},
+				"labels":    {Type: platform.LabelsParam},
+				"log-stack": {Type: platform.BoolParam},
+			},
+		},
+		parse.InnerExecTime: {
+			Placement: platform.StmtPlacement,
+			Params: map[string]platform.ParamSchema{
+				"name":   {Type: platform.NameParam, Required: true},
+				"labels": {Type: platform.LabelsParam},
+				"prom-type": {
+					Type:   platform.StringParam,
+					Values: []string{"histogram", "summary"},
+				},
+				"prom-buckets":    {Type: platform.BucketsParam},
+				"prom-objectives": {Type: platform.ObjectivesParam},
+				"prom-max-age":    {Type: platform.DurationParam},
+				"cooldown":        {Type: platform.DurationParam},
+				"sample-rate":     {Type: platform.RateParam},
+			},
+		},
+		parse.RegionBegin: {
+			Placement: platform.StmtPlacement,
+			Params: map[string]platform.ParamSchema{
+				"name":   {Type: platform.NameParam, Required: true},
+				"labels": {Type: platform.LabelsParam},
+				"prom-type": {
+					Type:   platform.StringParam,
+					Values: []string{"histogram", "summary"},
+				},
+				"prom-buckets":    {Type: platform.BucketsParam},
+				"prom-objectives": {Type: platform.ObjectivesParam},
+				"prom-max-age":    {Type: platform.DurationParam},
+			},
+		},
+		parse.RegionEnd: {
+			Placement: platform.StmtPlacement,
+			Params: map[string]platform.ParamSchema{
+				"name": {Type: platform.NameParam, Required: true},
+			},
+		},
+		parse.GoSpawn: {
+			Placement: platform.GoPlacement,
+			Params: map[string]platform.ParamSchema{
+				"name": {Type: platform.NameParam, Required: true},
+			},
+		},
+		parse.ChanDepth: {
+			Placement: platform.VarPlacement,
+			Params: map[string]platform.ParamSchema{
+				"name":     {Type: platform.NameParam},
+				"interval": {Type: platform.DurationParam},
+			},
+		},
+		parse.LockWait: {
+			Placement: platform.LockPlacement,
+			Params: map[string]platform.ParamSchema{
+				"name":         {Type: platform.NameParam, Required: true},
+				"prom-buckets": {Type: platform.BucketsParam},
+			},
+		},
+		parse.InnerCounter: {
+			Placement: platform.StmtPlacement,
+			Params: map[string]platform.ParamSchema{
+				"name":   {Type: platform.NameParam, Required: true},
+				"labels": {Type: platform.LabelsParam},
+			},
+		},
+		parse.InnerGauge: {
+			Placement: platform.StmtPlacement,
+			Params: map[string]platform.ParamSchema{
+				"name":   {Type: platform.NameParam, Required: true},
+				"labels": {Type: platform.LabelsParam},
+				"value":  {Type: platform.ExprParam, Required: true},
+				"op": {
+					Type:   platform.StringParam,
+					Values: []string{"set", "add", "sub"},
+				},
+			},
+		},
+		parse.InnerObserve: {
+			Placement: platform.StmtPlacement,
+			Params: map[string]platform.ParamSchema{
+				"name":    {Type: platform.NameParam, Required: true},
+				"labels":  {Type: platform.LabelsParam},
+				"value":   {Type: platform.ExprParam, Required: true},
+				"buckets": {Type: platform.BucketsParam},
+			},
+		},
+		parse.Set: {
+			Placement: platform.StmtPlacement,
+			Params: map[string]platform.ParamSchema{
+				"prom-registry": {Type: platform.StringParam, Required: true},
+			},
+		},
+	}
 )
 
 func NewPrometheusProvider(inplace bool, suffix string,
-	dryRun bool, metricsPrefix string,
+	dryRun bool, metricsPrefix string, overlayDir string,
 ) platform.MetricsProvider {
 	return &prometheusProvider{
 		inplace:       inplace,
 		suffix:        suffix,
 		dryRun:        dryRun,
 		metricsPrefix: metricsPrefix,
+		overlayDir:    overlayDir,
 	}
 }
 
+func (p *prometheusProvider) Schema() platform.Schema {
+	return directiveSchema
+}
+
 func (p *prometheusProvider) PrePatch(d *parse.CollectInfo) error {
 	if !d.HasDefinitionDirective() {
 		return fmt.Errorf("no definition directive found")
@@ -96,15 +273,20 @@ func (p *prometheusProvider) PrePatch(d *parse.CollectInfo) error {
 
 func (p *prometheusProvider) Patch(d *parse.CollectInfo) error {
 	for _, fullpath := range d.Files() {
+		if d.IsUpToDate(fullpath) {
+			continue
+		}
 		directives, err := d.FileDirectives(fullpath)
 		if err != nil {
 			return err
 		}
+		p.setDefaults(d, fullpath)
+		regions, err := platform.RegionsByBegin(d, fullpath)
+		if err != nil {
+			return err
+		}
 		for _, directive := range directives {
-			base := filepath.Base(
-				fullpath,
-			) // Get the base (filename) from the full path
-			filename := base[:len(base)-len(filepath.Ext(base))] // Remove the extension
+			filename := platform.FileName(d, fullpath)
 			if directive.TraceType() == parse.Define {
 				initDst, patchTable, _ := globalInitFuncDst(d, directive)
 				if v, ok := directive.Param("empty"); ok {
@@ -123,15 +305,90 @@ func (p *prometheusProvider) Patch(d *parse.CollectInfo) error {
 					if f == nil {
 						return fmt.Errorf("func declaration is nil")
 					}
-					globalDecl, inFuncStmts, patchTable, _ := p.funcTraceStmtsDst(filename,
-						f.Name.Name, "", directive)
+					slowDecl, slowStmts, slowPatchTable, err := platform.SlowCallStmts(d,
+						directive, "d")
+					if err != nil {
+						return err
+					}
+					globalDecl, inFuncStmts, patchTable, err := p.funcTraceStmtsDst(filename,
+						platform.FuncName(d, directive), "", directive, slowStmts)
+					if err != nil {
+						return err
+					}
+					globalDecl = append(globalDecl, slowDecl...)
+					patchTable = append(patchTable, slowPatchTable...)
+					globalDecl, inFuncStmts, patchTable, err = platform.Cooldown(d,
+						directive, globalDecl, inFuncStmts, patchTable)
+					if err != nil {
+						return err
+					}
+					globalDecl, inFuncStmts, patchTable, err = platform.Sampled(d,
+						directive, globalDecl, inFuncStmts, patchTable)
+					if err != nil {
+						return err
+					}
+					pkgs := platform.PkgsWithLabels(pkgsTraceRequired, directive)
+					pkgs = platform.PkgsWithSlowLog(d, pkgs, directive)
+					pkgs = platform.PkgsWithCooldown(pkgs, directive)
 					if err := d.SetFunctionTimeTracing(*directive, globalDecl,
-						inFuncStmts, pkgsTraceRequired, patchTable); err != nil {
+						inFuncStmts, platform.PkgsWithSampling(pkgs, directive),
+						patchTable); err != nil {
 						return err
 					}
 				} else {
 					return fmt.Errorf("not a func declaration")
 				}
+			} else if directive.TraceType() == parse.FuncErrorCount {
+				// add function error counter
+				if _, ok := directive.Declaration().(*dst.FuncDecl); !ok {
+					return fmt.Errorf("not a func declaration")
+				}
+				errName, err := d.ErrorResultName(*directive)
+				if err != nil {
+					return err
+				}
+				globalDecl, inFuncStmts, patchTable, err := p.funcErrorCountStmtsDst(
+					filename, platform.FuncName(d, directive), errName, directive)
+				if err != nil {
+					return err
+				}
+				if err := d.SetFunctionTimeTracing(*directive, globalDecl,
+					inFuncStmts, platform.PkgsWithLabels(pkgsTraceInlineCounterRequired,
+						directive), patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.FuncInFlight {
+				// add function in-flight gauge
+				if _, ok := directive.Declaration().(*dst.FuncDecl); !ok {
+					return fmt.Errorf("not a func declaration")
+				}
+				globalDecl, inFuncStmts, patchTable, err := p.funcInFlightStmtsDst(
+					filename, platform.FuncName(d, directive),
+					d.DirectiveID(directive), directive)
+				if err != nil {
+					return err
+				}
+				if err := d.SetFunctionTimeTracing(*directive, globalDecl,
+					inFuncStmts, platform.PkgsWithLabels(pkgsTraceInlineCounterRequired,
+						directive), patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.FuncPanicCount {
+				// add function panic counter
+				if _, ok := directive.Declaration().(*dst.FuncDecl); !ok {
+					return fmt.Errorf("not a func declaration")
+				}
+				globalDecl, inFuncStmts, patchTable, err := p.funcPanicCountStmtsDst(
+					filename, platform.FuncName(d, directive), directive)
+				if err != nil {
+					return err
+				}
+				pkgs := platform.PkgsWithLabels(pkgsTraceInlineCounterRequired, directive)
+				if err := d.SetFunctionTimeTracing(*directive, globalDecl,
+					inFuncStmts, platform.PkgsWithStackLog(pkgs, directive),
+					patchTable); err != nil {
+					return err
+				}
 			} else if directive.TraceType() == parse.InnerExecTime {
 				// add inner execution time metric
 				name := ""
@@ -144,16 +401,29 @@ func (p *prometheusProvider) Patch(d *parse.CollectInfo) error {
 					return fmt.Errorf("name is required for inner time tracing")
 				}
 				globalDecl, inFuncStmts, patchTable, err := p.funcTraceStmtsDst(
-					filename, directive.Declaration().(*dst.FuncDecl).Name.Name,
-					name, directive)
+					filename, platform.FuncName(d, directive),
+					name, directive, nil)
+				if err != nil {
+					return err
+				}
+				globalDecl, inFuncStmts, patchTable, err = platform.Cooldown(d,
+					directive, globalDecl, inFuncStmts, patchTable)
+				if err != nil {
+					return err
+				}
+				globalDecl, inFuncStmts, patchTable, err = platform.Sampled(d,
+					directive, globalDecl, inFuncStmts, patchTable)
 				if err != nil {
 					return err
 				}
 				// prepend an empty statement to the inFuncStmts
 				inFuncStmts = append([]dst.Stmt{&dst.EmptyStmt{}}, inFuncStmts...)
+				pkgs := platform.PkgsWithLabels(pkgsTraceInlineCounterRequired, directive)
+				pkgs = platform.PkgsWithCooldown(pkgs, directive)
 				if err := d.SetFunctionInnerTracing(
 					*directive, globalDecl, inFuncStmts,
-					pkgsTraceInlineCounterRequired, patchTable); err != nil {
+					platform.PkgsWithSampling(pkgs, directive),
+					patchTable); err != nil {
 					return err
 				}
 			} else if directive.TraceType() == parse.InnerCounter {
@@ -168,8 +438,48 @@ func (p *prometheusProvider) Patch(d *parse.CollectInfo) error {
 					return fmt.Errorf("name is required for inner counter")
 				}
 				globalDecl, inFuncStmts, patchTable, err := p.funcTraceInlineCounterStmtsDst(
-					filename, directive.Declaration().(*dst.FuncDecl).Name.Name,
-					name, directive)
+					filename, platform.FuncName(d, directive),
+					name, d.DirectiveID(directive), directive)
+				if err != nil {
+					return err
+				}
+				// prepend an empty statement to the inFuncStmts
+				inFuncStmts = append([]dst.Stmt{&dst.EmptyStmt{}}, inFuncStmts...)
+				if err := d.SetFunctionInnerTracing(
+					*directive, globalDecl, inFuncStmts,
+					platform.PkgsWithLabels(pkgsTraceInlineCounterRequired, directive),
+					patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.InnerGauge {
+				// add inner gauge
+				name, ok := directive.Param("name")
+				if !ok || name == "" {
+					return fmt.Errorf("name is required for inner gauge")
+				}
+				globalDecl, inFuncStmts, patchTable, err := p.funcTraceInlineGaugeStmtsDst(
+					filename, platform.FuncName(d, directive),
+					name, d.DirectiveID(directive), directive)
+				if err != nil {
+					return err
+				}
+				// prepend an empty statement to the inFuncStmts
+				inFuncStmts = append([]dst.Stmt{&dst.EmptyStmt{}}, inFuncStmts...)
+				if err := d.SetFunctionInnerTracing(
+					*directive, globalDecl, inFuncStmts,
+					platform.PkgsWithLabels(pkgsTraceInlineCounterRequired, directive),
+					patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.InnerObserve {
+				// add inner histogram observation
+				name, ok := directive.Param("name")
+				if !ok || name == "" {
+					return fmt.Errorf("name is required for inner observe")
+				}
+				globalDecl, inFuncStmts, patchTable, err := p.funcTraceInlineObserveStmtsDst(
+					filename, platform.FuncName(d, directive),
+					name, d.DirectiveID(directive), directive)
 				if err != nil {
 					return err
 				}
@@ -177,17 +487,87 @@ func (p *prometheusProvider) Patch(d *parse.CollectInfo) error {
 				inFuncStmts = append([]dst.Stmt{&dst.EmptyStmt{}}, inFuncStmts...)
 				if err := d.SetFunctionInnerTracing(
 					*directive, globalDecl, inFuncStmts,
-					pkgsTraceInlineCounterRequired, patchTable); err != nil {
+					platform.PkgsWithLabels(pkgsTraceInlineCounterRequired, directive),
+					patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.RegionBegin {
+				// add region duration metric
+				region, ok := regions[directive]
+				if !ok {
+					return fmt.Errorf("region of %s not found", directive.Text())
+				}
+				globalDecl, beginStmts, endStmts, patchTable, err := p.regionStmtsDst(
+					filename, platform.FuncName(d, directive),
+					d.DirectiveID(directive), region)
+				if err != nil {
+					return err
+				}
+				if err := d.SetRegionTracing(region, globalDecl, beginStmts,
+					endStmts, platform.PkgsWithLabels(pkgsTraceRequired, directive),
+					patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.RegionEnd {
+				// the end of a region is added with its beginning
+				continue
+			} else if directive.TraceType() == parse.GoSpawn {
+				// count the spawned goroutines and the running ones
+				name, ok := directive.Param("name")
+				if !ok || name == "" {
+					return fmt.Errorf("name is required for go-spawn")
+				}
+				globalDecl, spawnStmts, goroutineStmts, patchTable := p.goSpawnStmtsDst(
+					filename, platform.FuncName(d, directive),
+					d.DirectiveID(directive), name)
+				if err := d.SetGoSpawnTracing(*directive, globalDecl, spawnStmts,
+					goroutineStmts, pkgsTraceInlineCounterRequired,
+					patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.ChanDepth {
+				// report the length and the capacity of the channel
+				varName, err := d.ChanVarName(*directive)
+				if err != nil {
+					return err
+				}
+				globalDecl, patchTable := p.chanDepthDeclsDst(filename, varName,
+					directive)
+				if err := d.SetChanDepthTracing(*directive, globalDecl,
+					pkgsChanDepthRequired, patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.LockWait {
+				// observe the time the mutex is waited for and held
+				lock, err := d.MatchUnlocks(*directive)
+				if err != nil {
+					return err
+				}
+				globalDecl, beforeStmts, afterStmts, holdStmts, patchTable,
+					err := p.lockWaitStmtsDst(filename, platform.FuncName(d, directive),
+					d.DirectiveID(directive), lock)
+				if err != nil {
 					return err
 				}
+				if err := d.SetLockWaitTracing(lock, globalDecl, beforeStmts,
+					afterStmts, holdStmts, pkgsTraceRequired,
+					patchTable); err != nil {
+					return err
+				}
+			} else if directive.TraceType() == parse.PackageExecTime {
+				// the functions of the package are traced by the func-exec-time
+				// directives synthesized from it
+				continue
 			} else if directive.TraceType() == parse.GenBegine ||
 				directive.TraceType() == parse.GenEnd {
-				return fmt.Errorf("metrics code already generated")
+				// stale generated code is removed before patching
+				continue
 			} else if directive.TraceType() == parse.Set {
 				// set
 				globalDecl, inFuncStmts, patchTable,
 					err := p.funcTraceInlineSetStmtsDst(filename,
-					directive.Declaration().(*dst.FuncDecl).Name.Name, directive)
+					platform.FuncName(d, directive),
+					d.DirectiveID(directive), directive)
 				if err != nil {
 					return err
 				}
@@ -207,6 +587,13 @@ func (p *prometheusProvider) Patch(d *parse.CollectInfo) error {
 }
 
 func (p *prometheusProvider) PostPatch(d *parse.CollectInfo) error {
+	if p.overlayDir != "" {
+		if err := platform.StoreOverlay(d, p.overlayDir, p.dryRun); err != nil {
+			return err
+		}
+		return p.dowloadNeededPackages(d)
+	}
+
 	for _, filename := range d.Files() {
 		if !d.IsModified(filename) {
 			continue
@@ -251,11 +638,15 @@ func (p *prometheusProvider) dowloadNeededPackages(d *parse.CollectInfo) error {
 	if p.dryRun {
 		return nil
 	}
-	return utils.FetchPackages(d.GoModPath(), pkgsNeedDownload)
+	if p.overlayDir != "" {
+		// only update the go.mod copy in the overlay directory
+		return platform.FetchOverlayPackages(d, pkgsNeedDownload, p.overlayDir)
+	}
+	return platform.FetchModulePackages(d, pkgsNeedDownload)
 }
 
 func (p *prometheusProvider) funcTraceInlineSetStmtsDst(filename string, funcname string,
-	directive *parse.Directive) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt,
+	id string, directive *parse.Directive) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt,
 	pkgsPatchTable []*dst.Ident, err error,
 ) {
 	g := []dst.Decl{}
@@ -271,9 +662,8 @@ func (p *prometheusProvider) funcTraceInlineSetStmtsDst(filename string, funcnam
 			fmt.Errorf("prom-registry is required for Set directive")
 	}
 
-	// entry name is a combine of filename, funcname and a random number
-	entryName := fmt.Sprintf("%s_%s_%s", filename, funcname,
-		utils.GenerateRandNumString(8))
+	// entry name is a combine of filename, funcname and the directive id
+	entryName := fmt.Sprintf("%s_%s_%s", filename, funcname, id)
 
 	// var funcname_initialized = false
 	// var funcname_mutex sync.Mutex
@@ -318,10 +708,13 @@ func (p *prometheusProvider) funcTraceInlineSetStmtsDst(filename string, funcnam
 	// 	funcname_mutex.Lock()
 	// 	if !funcname_initialized {
 	// 		globalvar.Set("metrics_gen", reg)
+	// 		...
 	// 		funcname_initialized = true
 	// 	}
 	// 	funcname_mutex.Unlock()
 	// }
+	publish, publishPatchTable := publishRegistryStmts(regName)
+	pkgsPatchTable = append(pkgsPatchTable, publishPatchTable...)
 	l = append(l, &dst.IfStmt{
 		Cond: &dst.UnaryExpr{
 			Op: token.NOT,
@@ -347,22 +740,7 @@ func (p *prometheusProvider) funcTraceInlineSetStmtsDst(filename string, funcnam
 						},
 					},
 					Body: &dst.BlockStmt{
-						List: []dst.Stmt{
-							&dst.ExprStmt{
-								X: &dst.CallExpr{
-									Fun: &dst.SelectorExpr{
-										X:   dst.NewIdent("globalvar"),
-										Sel: dst.NewIdent("Set"),
-									},
-									Args: []dst.Expr{
-										&dst.BasicLit{
-											Kind:  token.STRING,
-											Value: "\"metrics_gen\"",
-										},
-										dst.NewIdent(regName),
-									},
-								},
-							},
+						List: append(publish,
 							&dst.AssignStmt{
 								Lhs: []dst.Expr{
 									dst.NewIdent(
@@ -374,7 +752,7 @@ func (p *prometheusProvider) funcTraceInlineSetStmtsDst(filename string, funcnam
 									dst.NewIdent("true"),
 								},
 							},
-						},
+						),
 					},
 				},
 				&dst.ExprStmt{
@@ -388,14 +766,6 @@ func (p *prometheusProvider) funcTraceInlineSetStmtsDst(filename string, funcnam
 			},
 		},
 	})
-	// add globalvar
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		l[len(l)-1].(*dst.IfStmt).Body.List[1].(*dst.IfStmt).
-			Body.List[0].(*dst.ExprStmt).X.(*dst.CallExpr).
-			Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-	)
-
 	return g, l, pkgsPatchTable, nil
 }
 
@@ -403,25 +773,20 @@ func (p *prometheusProvider) funcTraceInlineCounterStmtsDst(
 	filename string,
 	funcname string,
 	identname string,
+	id string,
 	directive *parse.Directive,
 ) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt,
 	pkgsPatchTable []*dst.Ident, err error,
 ) {
-	g := []dst.Decl{}
-	l := []dst.Stmt{}
-	pkgsPatchTable = []*dst.Ident{}
-
-	// entry name is a combine of filename, funcname and a random number
-	baseName := fmt.Sprintf("%s_%s_%s", filename, funcname, identname)
-	varName := fmt.Sprintf("%s_%s", baseName, utils.GenerateRandNumString(8))
-
-	var metricsName string
-	if p.metricsPrefix != "" {
-		metricsName = fmt.Sprintf("%s_%s", p.metricsPrefix, baseName)
-	} else {
-		metricsName = baseName
+	labels, err := directive.Labels()
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
+	// entry name is a combine of filename, funcname and the directive id
+	baseName := innerBaseName(filename, funcname, identname)
+	varName := fmt.Sprintf("%s_%s", baseName, id)
+
 	// var countername_initialized = false
 	// var countername_mutex sync.Mutex
 	// var countername = prometheus.NewCounter(
@@ -429,859 +794,1223 @@ func (p *prometheusProvider) funcTraceInlineCounterStmtsDst(
 	// 		Name: "my_counter",
 	// 		Help: "This is my counter",
 	// 	})
-	g = []dst.Decl{
-		&dst.GenDecl{
-			Tok: token.VAR,
-			Specs: []dst.Spec{
-				&dst.ValueSpec{
-					Names: []*dst.Ident{
-						{Name: fmt.Sprintf("%s_initialized", varName)},
-					},
-					Type: &dst.Ident{Name: "bool"},
-					Values: []dst.Expr{
-						&dst.Ident{Name: "false"},
-					},
+	g, pkgsPatchTable := lazyRegisterDecls(varName)
+	decl, patchTable := metricDecl(varName, p.metricsName(baseName), "Counter",
+		labelNames(labels))
+	g = append(g, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+
+	// if !countername_initialized {
+	// 	countername_mutex.Lock()
+	// 	if !countername_initialized {
+	// 		reg, err := globalvar.Get("metrics_gen")
+	// 		if err == nil {
+	// 			register countername, or share the counter registered
+	// 			with the same name
+	// 			countername_initialized = true
+	// 		}
+	// 	}
+	// 	countername_mutex.Unlock()
+	// }
+	// countername.Inc()
+	register, patchTable := lazyRegisterStmt(varName, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	values, patchTable := labelValues(labels)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	l := []dst.Stmt{
+		register,
+		&dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   metricExpr(varName, values, false),
+					Sel: dst.NewIdent("Inc"),
 				},
 			},
 		},
-		&dst.GenDecl{
-			Tok: token.VAR,
-			Specs: []dst.Spec{
-				&dst.ValueSpec{
-					Names: []*dst.Ident{
-						{Name: fmt.Sprintf("%s_mutex", varName)},
+	}
+	return g, l, pkgsPatchTable, nil
+}
+
+// get traced function execution duration declaration and statements,
+// onReturn statements run in the deferred function after the duration d is
+// observed
+func (p *prometheusProvider) funcTraceStmtsDst(filename string, funcname string,
+	identname string, directive *parse.Directive, onReturn []dst.Stmt,
+) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt, pkgsPatchTable []*dst.Ident,
+	err error,
+) {
+	suffix := "duration"
+	if identname != "" {
+		suffix = fmt.Sprintf("%s_%s", identname, suffix)
+	}
+	varName := funcVarName(directive, filename, funcname, suffix)
+	labels, err := directive.Labels()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	kind, opts, optsPatchTable, err := p.observerOpts(directive)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// var summary_initialized = false
+	// var summary_mutex sync.Mutex
+	// var summary = prometheus.NewSummary(
+	// 	prometheus.SummaryOpts{
+	// 		Name: "my_summary",
+	// 		Help: "This is my summary",
+	//		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+	// 	})
+	//
+	// or a prometheus.Histogram with prom-type=histogram
+	g, pkgsPatchTable := lazyRegisterDecls(varName)
+	decl, patchTable := metricDecl(varName, p.metricsName(varName), kind,
+		labelNames(labels), opts...)
+	g = append(g, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	pkgsPatchTable = append(pkgsPatchTable, optsPatchTable...)
+
+	// defer func(t time.Time) {
+	// 	if !summary_initialized {
+	// 		summary_mutex.Lock()
+	// 		if !summary_initialized {
+	// 			reg, err := globalvar.Get("metrics_gen")
+	// 			if err == nil {
+	// 				register summary, or share the summary registered
+	// 				with the same name
+	// 				summary_initialized = true
+	// 			}
+	// 		}
+	// 		summary_mutex.Unlock()
+	// 	}
+	// 	d := time.Since(t)
+	// 	summary.Observe(d.Milliseconds())
+	// }(time.Now())
+	//
+	// label values are evaluated when the function is entered and passed as
+	// "labels []string" to the deferred function
+	register, patchTable := lazyRegisterStmt(varName, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	timeType := &dst.Ident{Name: "time.Time"}
+	timeNow := &dst.SelectorExpr{
+		X:   dst.NewIdent("time"),
+		Sel: dst.NewIdent("Now"),
+	}
+	timeSince := &dst.SelectorExpr{
+		X:   dst.NewIdent("time"),
+		Sel: dst.NewIdent("Since"),
+	}
+	params := []*dst.Field{
+		{
+			Names: []*dst.Ident{dst.NewIdent("t")},
+			Type:  timeType,
+		},
+	}
+	args := []dst.Expr{
+		&dst.CallExpr{Fun: timeNow},
+	}
+	var observer dst.Expr = dst.NewIdent(varName)
+	if len(labels) != 0 {
+		values, patchTable := labelValues(labels)
+		pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+		params = append(params, &dst.Field{
+			Names: []*dst.Ident{dst.NewIdent("labels")},
+			Type:  &dst.ArrayType{Elt: dst.NewIdent("string")},
+		})
+		args = append(args, &dst.CompositeLit{
+			Type: &dst.ArrayType{Elt: dst.NewIdent("string")},
+			Elts: values,
+		})
+		observer = metricExpr(varName, []dst.Expr{dst.NewIdent("labels")}, true)
+	}
+	l := []dst.Stmt{
+		&dst.DeferStmt{
+			Call: &dst.CallExpr{
+				Args: args,
+				Fun: &dst.FuncLit{
+					Type: &dst.FuncType{
+						Params: &dst.FieldList{List: params},
 					},
-					Type: &dst.SelectorExpr{
-						X:   dst.NewIdent("sync"),
-						Sel: dst.NewIdent("Mutex"),
+					Body: &dst.BlockStmt{
+						List: []dst.Stmt{
+							register,
+							&dst.AssignStmt{
+								Lhs: []dst.Expr{dst.NewIdent("d")},
+								Tok: token.DEFINE,
+								Rhs: []dst.Expr{
+									&dst.CallExpr{
+										Fun:  timeSince,
+										Args: []dst.Expr{dst.NewIdent("t")},
+									},
+								},
+							},
+							&dst.ExprStmt{
+								X: &dst.CallExpr{
+									Fun: &dst.SelectorExpr{
+										X:   observer,
+										Sel: dst.NewIdent("Observe"),
+									},
+									Args: []dst.Expr{
+										&dst.CallExpr{
+											Fun: &dst.SelectorExpr{
+												X:   dst.NewIdent("d"),
+												Sel: dst.NewIdent("Seconds"),
+											},
+										},
+									},
+								},
+							},
+						},
 					},
 				},
 			},
 		},
-		&dst.GenDecl{
-			Tok: token.VAR,
-			Specs: []dst.Spec{
-				&dst.ValueSpec{
-					Names: []*dst.Ident{
-						{Name: fmt.Sprintf("%s", varName)},
-					},
-					Type: &dst.Ident{Name: "prometheus.Counter"},
-					Values: []dst.Expr{
-						&dst.CallExpr{
-							Fun: &dst.SelectorExpr{
-								X:   dst.NewIdent("prometheus"),
-								Sel: dst.NewIdent("NewCounter"),
-							},
-							Args: []dst.Expr{
-								// construct a counter options
-								&dst.CompositeLit{
-									Type: &dst.SelectorExpr{
-										X:   dst.NewIdent("prometheus"),
-										Sel: dst.NewIdent("CounterOpts"),
-									},
-									Elts: []dst.Expr{
-										&dst.KeyValueExpr{
-											Key: dst.NewIdent("Name"),
-											Value: &dst.BasicLit{
-												Kind:  token.STRING,
-												Value: fmt.Sprintf("\"%s\"", metricsName),
-											},
-										},
-										&dst.KeyValueExpr{
-											Key: dst.NewIdent("Help"),
-											Value: &dst.BasicLit{
-												Kind:  token.STRING,
-												Value: fmt.Sprintf("\"%s\"", metricsName),
-											},
-										},
-									},
-								},
-							},
-						},
+	}
+	body := l[0].(*dst.DeferStmt).Call.Fun.(*dst.FuncLit).Body
+	body.List = append(body.List, onReturn...)
+	pkgsPatchTable = append(pkgsPatchTable,
+		// add arg time.Now
+		timeNow.X.(*dst.Ident),
+		// add time.Time
+		timeType,
+		// add time.Since
+		timeSince.X.(*dst.Ident),
+	)
+	return g, l, pkgsPatchTable, nil
+}
+
+func globalInitFuncDst(
+	d *parse.CollectInfo,
+	directive *parse.Directive,
+) (*dst.FuncDecl, []*dst.Ident, error) {
+	portNum := defaultPromPort
+	if val, ok := directive.Param("prom-port"); ok {
+		portNum = val
+	}
+
+	metricsRoute := fmt.Sprintf("\"%s\"", defaultPromPath)
+	if val, ok := directive.Param("prom-route"); ok {
+		metricsRoute = fmt.Sprintf("\"%s\"", val)
+	}
+
+	patchTable := []*dst.Ident{}
+	stmts1 := []dst.Stmt{}
+
+	regName := "reg"
+	useExistingReg := false
+	if val, ok := directive.Param("prom-registry"); ok {
+		// use existing registry
+
+		regName = val
+		useExistingReg = true
+	} else {
+		// create new registry
+
+		// reg := prometheus.NewRegistry()
+		stmts1 = append(stmts1, &dst.AssignStmt{
+			Lhs: []dst.Expr{dst.NewIdent(regName)},
+			Tok: token.DEFINE,
+			Rhs: []dst.Expr{
+				&dst.CallExpr{
+					Fun: &dst.SelectorExpr{
+						X:   dst.NewIdent("prometheus"),
+						Sel: dst.NewIdent("NewRegistry"),
 					},
 				},
 			},
-		},
+		})
+		// add prometheus
+		patchTable = append(
+			patchTable,
+			stmts1[len(stmts1)-1].(*dst.AssignStmt).Rhs[0].(*dst.CallExpr).
+				Fun.(*dst.SelectorExpr).X.(*dst.Ident),
+		)
 	}
-	// add sync
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		g[len(g)-2].(*dst.GenDecl).Specs[0].(*dst.ValueSpec).
-			Type.(*dst.SelectorExpr).X.(*dst.Ident),
-	)
-	// add prometheus.Counter
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		g[len(g)-1].(*dst.GenDecl).Specs[0].(*dst.ValueSpec).
-			Type.(*dst.Ident),
-	)
-	// add 1st prometheus
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		g[len(g)-1].(*dst.GenDecl).Specs[0].(*dst.ValueSpec).
-			Values[0].(*dst.CallExpr).Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-	)
-	// add 2nd prometheus
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		g[len(g)-1].(*dst.GenDecl).Specs[0].(*dst.ValueSpec).
-			Values[0].(*dst.CallExpr).Args[0].(*dst.CompositeLit).
-			Type.(*dst.SelectorExpr).X.(*dst.Ident),
-	)
 
-	// func countername_inc() {
-	// 	if !countername_initialized {
-	// 		countername_mutex.Lock()
-	// 		if !countername_initialized {
-	// 			reg, err := globalvar.Get("metrics_gen")
-	// 			if err == nil {
-	// 				countername_initialized = true
-	// 				reg.(*prometheus.Registry).MustRegister(countername)
-	// 			}
-	// 		}
-	// 		countername_mutex.Unlock()
-	// 	}
-	// 	countername.Inc()
-	// }()
-	l = append(l, &dst.IfStmt{
-		Cond: &dst.UnaryExpr{
-			Op: token.NOT,
-			X: &dst.Ident{
-				Name: fmt.Sprintf("%s_initialized", varName),
-			},
-		},
-		Body: &dst.BlockStmt{
-			List: []dst.Stmt{
-				&dst.ExprStmt{
-					X: &dst.CallExpr{
-						Fun: &dst.SelectorExpr{
-							X: dst.NewIdent(
-								fmt.Sprintf("%s_mutex", varName),
-							),
-							Sel: dst.NewIdent("Lock"),
-						},
-					},
+	// globalvar.Set("metrics_gen", reg) and the pending registrations
+	publish, publishPatchTable := publishRegistryStmts(regName)
+	stmts1 = append(stmts1, publish...)
+	patchTable = append(patchTable, publishPatchTable...)
+
+	stmts2 := []dst.Stmt{}
+
+	if !useExistingReg {
+		// http.Handle("<route>", promhttp.HandlerFor(prometheus.Gatherers{
+		// 	reg,
+		// 	prometheus.DefaultGatherer,
+		// }, promhttp.HandlerOpts{}))
+		stmts2 = append(stmts2, &dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   dst.NewIdent("http"),
+					Sel: dst.NewIdent("Handle"),
 				},
-				&dst.IfStmt{
-					Cond: &dst.UnaryExpr{
-						Op: token.NOT,
-						X: &dst.Ident{
-							Name: fmt.Sprintf(
-								"%s_initialized",
-								varName,
-							),
-						},
+				Args: []dst.Expr{
+					&dst.BasicLit{
+						Kind:  token.STRING,
+						Value: metricsRoute,
 					},
-					Body: &dst.BlockStmt{
-						List: []dst.Stmt{
-							&dst.AssignStmt{
-								Lhs: []dst.Expr{
-									dst.NewIdent("reg"),
-									dst.NewIdent("err"),
+					&dst.CallExpr{
+						Fun: &dst.SelectorExpr{
+							X:   dst.NewIdent("promhttp"),
+							Sel: dst.NewIdent("HandlerFor"),
+						},
+						Args: []dst.Expr{
+							&dst.CompositeLit{
+								Type: &dst.SelectorExpr{
+									X:   dst.NewIdent("prometheus"),
+									Sel: dst.NewIdent("Gatherers"),
 								},
-								Tok: token.DEFINE,
-								Rhs: []dst.Expr{
-									&dst.CallExpr{
-										Fun: &dst.SelectorExpr{
-											X: dst.NewIdent(
-												"globalvar",
-											),
-											Sel: dst.NewIdent(
-												"Get",
-											),
-										},
-										Args: []dst.Expr{
-											&dst.BasicLit{
-												Kind:  token.STRING,
-												Value: "\"metrics_gen\"",
-											},
-										},
+								Elts: []dst.Expr{
+									dst.NewIdent(regName),
+									&dst.SelectorExpr{
+										X:   dst.NewIdent("prometheus"),
+										Sel: dst.NewIdent("DefaultGatherer"),
 									},
 								},
 							},
-							&dst.IfStmt{
-								Cond: &dst.BinaryExpr{
-									X:  dst.NewIdent("err"),
-									Op: token.EQL,
-									Y:  dst.NewIdent("nil"),
-								},
-								Body: &dst.BlockStmt{
-									List: []dst.Stmt{
-										&dst.AssignStmt{
-											Lhs: []dst.Expr{
-												dst.NewIdent(
-													fmt.Sprintf(
-														"%s_initialized",
-														varName,
-													),
-												),
-											},
-											Tok: token.ASSIGN,
-											Rhs: []dst.Expr{
-												dst.NewIdent("true"),
-											},
-										},
-										&dst.ExprStmt{
-											X: &dst.CallExpr{
-												Fun: &dst.SelectorExpr{
-													X: dst.NewIdent(
-														"reg",
-													),
-													Sel: dst.NewIdent(
-														"(*prometheus.Registry).MustRegister",
-													),
-												},
-												Args: []dst.Expr{
-													dst.NewIdent(
-														varName,
-													),
-												},
-											},
-										},
-									},
+							&dst.CompositeLit{
+								Type: &dst.SelectorExpr{
+									X:   dst.NewIdent("promhttp"),
+									Sel: dst.NewIdent("HandlerOpts"),
 								},
 							},
 						},
 					},
 				},
-				&dst.ExprStmt{
-					X: &dst.CallExpr{
-						Fun: &dst.SelectorExpr{
-							X: dst.NewIdent(
-								fmt.Sprintf("%s_mutex", varName),
-							),
-							Sel: dst.NewIdent("Unlock"),
-						},
+			},
+		})
+		// add http
+		patchTable = append(
+			patchTable,
+			stmts2[len(stmts2)-1].(*dst.ExprStmt).X.(*dst.CallExpr).
+				Fun.(*dst.SelectorExpr).X.(*dst.Ident),
+		)
+		// add promhttp
+		patchTable = append(
+			patchTable,
+			stmts2[len(stmts2)-1].(*dst.ExprStmt).X.(*dst.CallExpr).Args[1].(*dst.CallExpr).
+				Fun.(*dst.SelectorExpr).X.(*dst.Ident),
+		)
+		// add 1st prometheus
+		patchTable = append(
+			patchTable,
+			stmts2[len(stmts2)-1].(*dst.ExprStmt).X.(*dst.CallExpr).Args[1].(*dst.CallExpr).
+				Args[0].(*dst.CompositeLit).Type.(*dst.SelectorExpr).X.(*dst.Ident),
+		)
+		// add 2nd prometheus
+		patchTable = append(
+			patchTable,
+			stmts2[len(stmts2)-1].(*dst.ExprStmt).X.(*dst.CallExpr).Args[1].(*dst.CallExpr).
+				Args[0].(*dst.CompositeLit).Elts[1].(*dst.SelectorExpr).X.(*dst.Ident),
+		)
+		// add promhttp
+		patchTable = append(
+			patchTable,
+			stmts2[len(stmts2)-1].(*dst.ExprStmt).X.(*dst.CallExpr).Args[1].(*dst.CallExpr).
+				Args[1].(*dst.CompositeLit).Type.(*dst.SelectorExpr).X.(*dst.Ident),
+		)
+
+		// http.ListenAndServe(":<port>", nil)
+		stmts2 = append(stmts2, &dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   dst.NewIdent("http"),
+					Sel: dst.NewIdent("ListenAndServe"),
+				},
+				Args: []dst.Expr{
+					&dst.BasicLit{
+						Kind:  token.STRING,
+						Value: fmt.Sprintf("\":%s\"", portNum),
+					},
+					dst.NewIdent("nil"),
+				},
+			},
+		})
+		// add http
+		patchTable = append(
+			patchTable,
+			stmts2[len(stmts2)-1].(*dst.ExprStmt).X.(*dst.CallExpr).
+				Fun.(*dst.SelectorExpr).X.(*dst.Ident),
+		)
+	}
+
+	// put statements into a function that will be executed in a goroutine
+	stmts2 = []dst.Stmt{
+		&dst.GoStmt{
+			Call: &dst.CallExpr{
+				Fun: &dst.FuncLit{
+					Type: &dst.FuncType{},
+					Body: &dst.BlockStmt{
+						List: stmts2,
 					},
 				},
 			},
 		},
-	})
-	l = append(l, &dst.ExprStmt{
-		X: &dst.CallExpr{
-			Fun: &dst.SelectorExpr{
-				X:   dst.NewIdent(varName),
-				Sel: dst.NewIdent("Inc"),
+	}
+	// combine stmts1 and stmts2 into a function
+	stmts2 = append(stmts1, stmts2...)
+	return platform.DSTInitFunc(stmts2), patchTable, nil
+}
+
+// get inner gauge declaration and statements, the gauge is set to, increased
+// or decreased by the value expression of the directive
+func (p *prometheusProvider) funcTraceInlineGaugeStmtsDst(
+	filename string,
+	funcname string,
+	identname string,
+	id string,
+	directive *parse.Directive,
+) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt,
+	pkgsPatchTable []*dst.Ident, err error,
+) {
+	value, ok := directive.Param("value")
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("value is required for inner gauge")
+	}
+	valueExpr, err := parse.ParseExpr(value)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var method string
+	switch op, _ := directive.Param("op"); op {
+	case "", "set":
+		method = "Set"
+	case "add":
+		method = "Add"
+	case "sub":
+		method = "Sub"
+	default:
+		return nil, nil, nil, fmt.Errorf("invalid op %s for inner gauge", op)
+	}
+	labels, err := directive.Labels()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// entry name is a combine of filename, funcname and the directive id
+	baseName := innerBaseName(filename, funcname, identname)
+	varName := fmt.Sprintf("%s_%s", baseName, id)
+
+	// var gaugename_initialized = false
+	// var gaugename_mutex sync.Mutex
+	// var gaugename = prometheus.NewGauge(...)
+	g, pkgsPatchTable := lazyRegisterDecls(varName)
+	decl, patchTable := metricDecl(varName, p.metricsName(baseName), "Gauge",
+		labelNames(labels))
+	g = append(g, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+
+	// register the gauge on first use, then
+	// gaugename.Set(float64(value))
+	stmt, patchTable := lazyRegisterStmt(varName, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	values, patchTable := labelValues(labels)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	l := []dst.Stmt{
+		stmt,
+		&dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   metricExpr(varName, values, false),
+					Sel: dst.NewIdent(method),
+				},
+				Args: []dst.Expr{floatExpr(valueExpr)},
 			},
 		},
-	})
+	}
+	return g, l, pkgsPatchTable, nil
+}
 
-	// add globalvar
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		l[len(l)-2].(*dst.IfStmt).Body.List[1].(*dst.IfStmt).
-			Body.List[0].(*dst.AssignStmt).Rhs[0].(*dst.CallExpr).
-			Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-	)
+// get inner observe declaration and statements, the value expression of the
+// directive is observed by a histogram with the buckets of the directive
+func (p *prometheusProvider) funcTraceInlineObserveStmtsDst(
+	filename string,
+	funcname string,
+	identname string,
+	id string,
+	directive *parse.Directive,
+) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt,
+	pkgsPatchTable []*dst.Ident, err error,
+) {
+	value, ok := directive.Param("value")
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("value is required for inner observe")
+	}
+	valueExpr, err := parse.ParseExpr(value)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	labels, err := directive.Labels()
+	if err != nil {
+		return nil, nil, nil, err
+	}
 
-	// add (*prometheus.Registry).MustRegister
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		l[len(l)-2].(*dst.IfStmt).Body.List[1].(*dst.IfStmt).
-			Body.List[1].(*dst.IfStmt).Body.List[1].(*dst.ExprStmt).
-			X.(*dst.CallExpr).Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-	)
+	// the buckets of the durations in the definition directive do not apply
+	opts := []dst.Expr{}
+	optsPatchTable := []*dst.Ident{}
+	if v, ok := directive.Param("buckets"); ok {
+		buckets, err := platform.ParseBuckets(v)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		expr, ident := bucketsExpr(buckets)
+		if ident != nil {
+			optsPatchTable = append(optsPatchTable, ident)
+		}
+		opts = append(opts, &dst.KeyValueExpr{
+			Key:   dst.NewIdent("Buckets"),
+			Value: expr,
+		})
+	}
+
+	// entry name is a combine of filename, funcname and the directive id
+	baseName := innerBaseName(filename, funcname, identname)
+	varName := fmt.Sprintf("%s_%s", baseName, id)
+
+	// var histname_initialized = false
+	// var histname_mutex sync.Mutex
+	// var histname = prometheus.NewHistogram(...)
+	g, pkgsPatchTable := lazyRegisterDecls(varName)
+	decl, patchTable := metricDecl(varName, p.metricsName(baseName), "Histogram",
+		labelNames(labels), opts...)
+	g = append(g, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	pkgsPatchTable = append(pkgsPatchTable, optsPatchTable...)
 
+	// register the histogram on first use, then
+	// histname.Observe(float64(value))
+	stmt, patchTable := lazyRegisterStmt(varName, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	values, patchTable := labelValues(labels)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	l := []dst.Stmt{
+		stmt,
+		&dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   metricExpr(varName, values, false),
+					Sel: dst.NewIdent("Observe"),
+				},
+				Args: []dst.Expr{floatExpr(valueExpr)},
+			},
+		},
+	}
 	return g, l, pkgsPatchTable, nil
 }
 
-// get traced function execution duration declaration and statements
-func (p *prometheusProvider) funcTraceStmtsDst(filename string, funcname string,
-	identname string, directive *parse.Directive,
+// get function error counter declaration and statements, calls are counted
+// with a result label set to "error" if the returned error is not nil
+func (p *prometheusProvider) funcErrorCountStmtsDst(filename string,
+	funcname string, errName string, directive *parse.Directive,
 ) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt, pkgsPatchTable []*dst.Ident,
 	err error,
 ) {
-	g := []dst.Decl{}
-	l := []dst.Stmt{}
-	pkgsPatchTable = []*dst.Ident{}
+	varName := funcVarName(directive, filename, funcname, "errors")
 
-	var varName string
-	if val, ok := directive.Param("name"); ok {
-		varName = val
-		if varName == funcname {
-			varName = fmt.Sprintf("fn_%s", funcname)
-		}
-	} else {
-		if identname == "" {
-			varName = fmt.Sprintf("%s_%s_%s", filename, funcname, "duration")
-		} else {
-			varName = fmt.Sprintf("%s_%s_%s_%s", filename, funcname, identname, "duration")
+	labels, err := directive.Labels()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for _, label := range labels {
+		if label.Name == "result" {
+			return nil, nil, nil, fmt.Errorf("label name \"result\" is " +
+				"reserved by func-error-count")
 		}
 	}
 
-	var metricsName string
-	if p.metricsPrefix != "" {
-		metricsName = fmt.Sprintf("%s_%s", p.metricsPrefix, varName)
-	} else {
-		metricsName = varName
-	}
+	// var countername_initialized = false
+	// var countername_mutex sync.Mutex
+	// var countername = prometheus.NewCounterVec(..., []string{"result"})
+	g, pkgsPatchTable := lazyRegisterDecls(varName)
+	decl, patchTable := metricDecl(varName, p.metricsName(varName), "Counter",
+		labelNames(labels, "result"))
+	g = append(g, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
 
-	// var summary_initialized = false
-	// var summary_mutex sync.Mutex
-	// var summary = prometheus.NewSummary(
-	// 	prometheus.SummaryOpts{
-	// 		Name: "my_summary",
-	// 		Help: "This is my summary",
-	//		Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
-	// 	})
-	g = []dst.Decl{
-		&dst.GenDecl{
-			Tok: token.VAR,
-			Specs: []dst.Spec{
-				&dst.ValueSpec{
-					Names: []*dst.Ident{
-						{Name: fmt.Sprintf("%s_initialized", varName)},
-					},
-					Type: &dst.Ident{Name: "bool"},
-					Values: []dst.Expr{
-						&dst.Ident{Name: "false"},
-					},
+	// label values are evaluated when the function is entered and passed as
+	// "labels []string" to the deferred function
+	funcType := &dst.FuncType{}
+	args := []dst.Expr{}
+	if len(labels) != 0 {
+		values, patchTable := labelValues(labels)
+		pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+		funcType.Params = &dst.FieldList{
+			List: []*dst.Field{
+				{
+					Names: []*dst.Ident{dst.NewIdent("labels")},
+					Type:  &dst.ArrayType{Elt: dst.NewIdent("string")},
 				},
 			},
-		},
-		&dst.GenDecl{
-			Tok: token.VAR,
-			Specs: []dst.Spec{
-				&dst.ValueSpec{
-					Names: []*dst.Ident{
-						{Name: fmt.Sprintf("%s_mutex", varName)},
-					},
-					Type: &dst.SelectorExpr{
-						X:   dst.NewIdent("sync"),
-						Sel: dst.NewIdent("Mutex"),
-					},
+		}
+		args = append(args, &dst.CompositeLit{
+			Type: &dst.ArrayType{Elt: dst.NewIdent("string")},
+			Elts: values,
+		})
+	}
+	inc := func(result string) dst.Stmt {
+		var value dst.Expr = &dst.BasicLit{
+			Kind:  token.STRING,
+			Value: fmt.Sprintf("\"%s\"", result),
+		}
+		ellipsis := false
+		if len(labels) != 0 {
+			// append(labels, "result")
+			value = &dst.CallExpr{
+				Fun:  dst.NewIdent("append"),
+				Args: []dst.Expr{dst.NewIdent("labels"), value},
+			}
+			ellipsis = true
+		}
+		return &dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   metricExpr(varName, []dst.Expr{value}, ellipsis),
+					Sel: dst.NewIdent("Inc"),
 				},
 			},
-		},
-		&dst.GenDecl{
-			Tok: token.VAR,
-			Specs: []dst.Spec{
-				&dst.ValueSpec{
-					Names: []*dst.Ident{
-						{Name: fmt.Sprintf("%s", varName)},
-					},
-					Type: &dst.Ident{Name: "prometheus.Summary"},
-					Values: []dst.Expr{
-						&dst.CallExpr{
-							Fun: &dst.SelectorExpr{
-								X:   dst.NewIdent("prometheus"),
-								Sel: dst.NewIdent("NewSummary"),
-							},
-							Args: []dst.Expr{
-								// construct a summary options
-								&dst.CompositeLit{
-									Type: &dst.SelectorExpr{
-										X:   dst.NewIdent("prometheus"),
-										Sel: dst.NewIdent("SummaryOpts"),
-									},
-									Elts: []dst.Expr{
-										&dst.KeyValueExpr{
-											Key: dst.NewIdent("Name"),
-											Value: &dst.BasicLit{
-												Kind:  token.STRING,
-												Value: fmt.Sprintf("\"%s\"", metricsName),
-											},
-										},
-										&dst.KeyValueExpr{
-											Key: dst.NewIdent("Help"),
-											Value: &dst.BasicLit{
-												Kind:  token.STRING,
-												Value: fmt.Sprintf("\"%s\"", metricsName),
-											},
-										},
-										&dst.KeyValueExpr{
-											Key: dst.NewIdent("Objectives"),
-											Value: &dst.CompositeLit{
-												Type: &dst.MapType{
-													Key:   dst.NewIdent("float64"),
-													Value: dst.NewIdent("float64"),
-												},
-												Elts: []dst.Expr{
-													&dst.KeyValueExpr{
-														Key: &dst.BasicLit{
-															Kind:  token.FLOAT,
-															Value: "0.5",
-														},
-														Value: &dst.BasicLit{
-															Kind:  token.FLOAT,
-															Value: "0.05",
-														},
-													},
-													&dst.KeyValueExpr{
-														Key: &dst.BasicLit{
-															Kind:  token.FLOAT,
-															Value: "0.9",
-														},
-														Value: &dst.BasicLit{
-															Kind:  token.FLOAT,
-															Value: "0.01",
-														},
-													},
-													&dst.KeyValueExpr{
-														Key: &dst.BasicLit{
-															Kind:  token.FLOAT,
-															Value: "0.99",
-														},
-														Value: &dst.BasicLit{
-															Kind:  token.FLOAT,
-															Value: "0.001",
-														},
-													},
-												},
-											},
-										},
-									},
+		}
+	}
+
+	// defer func() {
+	// 	register the counter on first use
+	// 	if err != nil {
+	// 		countername.WithLabelValues("error").Inc()
+	// 	} else {
+	// 		countername.WithLabelValues("ok").Inc()
+	// 	}
+	// }()
+	stmt, patchTable := lazyRegisterStmt(varName, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	l := []dst.Stmt{
+		&dst.DeferStmt{
+			Call: &dst.CallExpr{
+				Fun: &dst.FuncLit{
+					Type: funcType,
+					Body: &dst.BlockStmt{
+						List: []dst.Stmt{
+							stmt,
+							&dst.IfStmt{
+								Cond: &dst.BinaryExpr{
+									X:  dst.NewIdent(errName),
+									Op: token.NEQ,
+									Y:  dst.NewIdent("nil"),
+								},
+								Body: &dst.BlockStmt{
+									List: []dst.Stmt{inc("error")},
+								},
+								Else: &dst.BlockStmt{
+									List: []dst.Stmt{inc("ok")},
 								},
 							},
 						},
 					},
 				},
+				Args: args,
 			},
 		},
 	}
-	// add sync
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		g[len(g)-2].(*dst.GenDecl).Specs[0].(*dst.ValueSpec).
-			Type.(*dst.SelectorExpr).X.(*dst.Ident),
-	)
-	// add prometheus.Summary
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		g[len(g)-1].(*dst.GenDecl).Specs[0].(*dst.ValueSpec).
-			Type.(*dst.Ident),
-	)
-	// add 1st prometheus
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		g[len(g)-1].(*dst.GenDecl).Specs[0].(*dst.ValueSpec).
-			Values[0].(*dst.CallExpr).Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-	)
-	// add 2nd prometheus
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		g[len(g)-1].(*dst.GenDecl).Specs[0].(*dst.ValueSpec).
-			Values[0].(*dst.CallExpr).Args[0].(*dst.CompositeLit).
-			Type.(*dst.SelectorExpr).X.(*dst.Ident),
-	)
+	return g, l, pkgsPatchTable, nil
+}
 
-	// defer func(t time.Time) {
-	// 	if !summary_initialized {
-	// 		summary_mutex.Lock()
-	// 		if !summary_initialized {
-	// 			reg, err := globalvar.Get("metrics_gen")
-	// 			if err == nil {
-	// 				summary_initialized = true
-	// 				reg.(*prometheus.Registry).MustRegister(summary)
-	// 			}
-	// 		}
-	// 		summary_mutex.Unlock()
-	// 	}
-	// 	d := time.Since(t)
-	// 	summary.Observe(d.Milliseconds())
-	// }(time.Now())
-	l = append(l, &dst.DeferStmt{
-		Call: &dst.CallExpr{
-			Args: []dst.Expr{
-				// time.Now()
-				&dst.CallExpr{
-					Fun: &dst.SelectorExpr{
-						X:   dst.NewIdent("time"),
-						Sel: dst.NewIdent("Now"),
-					},
+// get function in-flight gauge declaration and statements, the gauge is
+// increased when the function is entered and decreased when it returns. The
+// directives with the same name share the gauge.
+func (p *prometheusProvider) funcInFlightStmtsDst(filename string,
+	funcname string, id string, directive *parse.Directive,
+) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt, pkgsPatchTable []*dst.Ident,
+	err error,
+) {
+	varName := inFlightVarName(directive, filename, funcname, id)
+	metricsName := funcVarName(directive, filename, funcname, "in_flight")
+	// the label values are needed twice
+	incLabels, err := directive.Labels()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	decLabels, _ := directive.Labels()
+
+	// var gaugename_initialized = false
+	// var gaugename_mutex sync.Mutex
+	// var gaugename = prometheus.NewGauge(...)
+	g, pkgsPatchTable := lazyRegisterDecls(varName)
+	decl, patchTable := metricDecl(varName, p.metricsName(metricsName), "Gauge",
+		labelNames(incLabels))
+	g = append(g, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+
+	// register the gauge on first use, then
+	// gaugename.Inc()
+	// defer gaugename.Dec()
+	stmt, patchTable := lazyRegisterStmt(varName, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	incValues, patchTable := labelValues(incLabels)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	decValues, patchTable := labelValues(decLabels)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	l := []dst.Stmt{
+		stmt,
+		&dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   metricExpr(varName, incValues, false),
+					Sel: dst.NewIdent("Inc"),
 				},
 			},
-			Fun: &dst.FuncLit{
-				Type: &dst.FuncType{
-					Params: &dst.FieldList{
-						List: []*dst.Field{
-							{
-								Names: []*dst.Ident{
-									dst.NewIdent("t"),
-								},
-								Type: &dst.Ident{Name: "time.Time"},
-							},
-						},
-					},
-				},
-				Body: &dst.BlockStmt{
-					List: []dst.Stmt{
-						&dst.IfStmt{
-							Cond: &dst.UnaryExpr{
-								Op: token.NOT,
-								X: &dst.Ident{
-									Name: fmt.Sprintf("%s_initialized", varName),
-								},
-							},
-							Body: &dst.BlockStmt{
-								List: []dst.Stmt{
-									&dst.ExprStmt{
-										X: &dst.CallExpr{
-											Fun: &dst.SelectorExpr{
-												X: dst.NewIdent(
-													fmt.Sprintf("%s_mutex", varName),
-												),
-												Sel: dst.NewIdent("Lock"),
-											},
-										},
-									},
-									&dst.IfStmt{
-										Cond: &dst.UnaryExpr{
-											Op: token.NOT,
-											X: &dst.Ident{
-												Name: fmt.Sprintf(
-													"%s_initialized",
-													varName,
-												),
-											},
-										},
-										Body: &dst.BlockStmt{
-											List: []dst.Stmt{
-												&dst.AssignStmt{
-													Lhs: []dst.Expr{
-														dst.NewIdent("reg"),
-														dst.NewIdent("err"),
-													},
-													Tok: token.DEFINE,
-													Rhs: []dst.Expr{
-														&dst.CallExpr{
-															Fun: &dst.SelectorExpr{
-																X: dst.NewIdent(
-																	"globalvar",
-																),
-																Sel: dst.NewIdent("Get"),
-															},
-															Args: []dst.Expr{
-																&dst.BasicLit{
-																	Kind:  token.STRING,
-																	Value: "\"metrics_gen\"",
-																},
-															},
-														},
-													},
-												},
-												&dst.IfStmt{
-													Cond: &dst.BinaryExpr{
-														X:  dst.NewIdent("err"),
-														Op: token.EQL,
-														Y:  dst.NewIdent("nil"),
-													},
-													Body: &dst.BlockStmt{
-														List: []dst.Stmt{
-															&dst.AssignStmt{
-																Lhs: []dst.Expr{
-																	dst.NewIdent(
-																		fmt.Sprintf(
-																			"%s_initialized",
-																			varName,
-																		),
-																	),
-																},
-																Tok: token.ASSIGN,
-																Rhs: []dst.Expr{
-																	dst.NewIdent("true"),
-																},
-															},
-															&dst.ExprStmt{
-																X: &dst.CallExpr{
-																	Fun: &dst.SelectorExpr{
-																		X: dst.NewIdent(
-																			"reg",
-																		),
-																		Sel: dst.NewIdent(
-																			"(*prometheus.Registry).MustRegister",
-																		),
-																	},
-																	Args: []dst.Expr{
-																		dst.NewIdent(
-																			varName,
-																		),
-																	},
-																},
-															},
-														},
-													},
-												},
-											},
-										},
-									},
-									&dst.ExprStmt{
-										X: &dst.CallExpr{
-											Fun: &dst.SelectorExpr{
-												X: dst.NewIdent(
-													fmt.Sprintf("%s_mutex", varName),
-												),
-												Sel: dst.NewIdent("Unlock"),
-											},
-										},
-									},
-								},
-							},
-						},
-						&dst.AssignStmt{
-							Lhs: []dst.Expr{dst.NewIdent("d")},
-							Tok: token.DEFINE,
-							Rhs: []dst.Expr{
-								&dst.CallExpr{
-									Fun: &dst.SelectorExpr{
-										X:   dst.NewIdent("time"),
-										Sel: dst.NewIdent("Since"),
-									},
-									Args: []dst.Expr{
-										dst.NewIdent("t"),
-									},
-								},
-							},
-						},
-						&dst.ExprStmt{
-							X: &dst.CallExpr{
-								Fun: &dst.SelectorExpr{
-									X:   dst.NewIdent(varName),
-									Sel: dst.NewIdent("Observe"),
-								},
-								Args: []dst.Expr{
-									&dst.CallExpr{
-										Fun: &dst.SelectorExpr{
-											X:   dst.NewIdent("d"),
-											Sel: dst.NewIdent("Seconds"),
-										},
-									},
-								},
-							},
-						},
-					},
+		},
+		&dst.DeferStmt{
+			Call: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   metricExpr(varName, decValues, false),
+					Sel: dst.NewIdent("Dec"),
 				},
 			},
 		},
-	})
-	// add arg time.Now
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		l[len(l)-1].(*dst.DeferStmt).Call.Args[0].(*dst.CallExpr).
-			Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-	)
-	// add time.Time
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		l[len(l)-1].(*dst.DeferStmt).Call.Fun.(*dst.FuncLit).
-			Type.Params.List[0].Type.(*dst.Ident),
-	)
-	// add time.Since
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		l[len(l)-1].(*dst.DeferStmt).Call.Fun.(*dst.FuncLit).
-			Body.List[1].(*dst.AssignStmt).Rhs[0].(*dst.CallExpr).
-			Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-	)
-	// add 1st globalvar
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		l[len(l)-1].(*dst.DeferStmt).Call.
-			Fun.(*dst.FuncLit).Body.List[0].(*dst.IfStmt).
-			Body.List[1].(*dst.IfStmt).
-			Body.List[0].(*dst.AssignStmt).
-			Rhs[0].(*dst.CallExpr).Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-	)
-	// add (*prometheus.Registry).MustRegister
-	pkgsPatchTable = append(
-		pkgsPatchTable,
-		l[len(l)-1].(*dst.DeferStmt).Call.Fun.(*dst.FuncLit).
-			Body.List[0].(*dst.IfStmt).Body.List[1].(*dst.IfStmt).
-			Body.List[1].(*dst.IfStmt).Body.List[1].(*dst.ExprStmt).X.(*dst.CallExpr).
-			Fun.(*dst.SelectorExpr).Sel,
-	)
+	}
+	return g, l, pkgsPatchTable, nil
+}
 
+// get function panic counter declaration and statements, a panic is recovered,
+// counted and raised again
+func (p *prometheusProvider) funcPanicCountStmtsDst(filename string,
+	funcname string, directive *parse.Directive,
+) (globalDecl []dst.Decl, inFuncStmts []dst.Stmt, pkgsPatchTable []*dst.Ident,
+	err error,
+) {
+	varName := funcVarName(directive, filename, funcname, "panics")
+	labels, err := directive.Labels()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// var countername_initialized = false
+	// var countername_mutex sync.Mutex
+	// var countername = prometheus.NewCounter(...)
+	g, pkgsPatchTable := lazyRegisterDecls(varName)
+	decl, patchTable := metricDecl(varName, p.metricsName(varName), "Counter",
+		labelNames(labels))
+	g = append(g, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+
+	// label values are evaluated when the function is entered and passed as
+	// "labels []string" to the deferred function
+	funcType := &dst.FuncType{}
+	args := []dst.Expr{}
+	values := []dst.Expr{}
+	if len(labels) != 0 {
+		labelExprs, patchTable := labelValues(labels)
+		pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+		funcType.Params = &dst.FieldList{
+			List: []*dst.Field{
+				{
+					Names: []*dst.Ident{dst.NewIdent("labels")},
+					Type:  &dst.ArrayType{Elt: dst.NewIdent("string")},
+				},
+			},
+		}
+		args = append(args, &dst.CompositeLit{
+			Type: &dst.ArrayType{Elt: dst.NewIdent("string")},
+			Elts: labelExprs,
+		})
+		values = append(values, dst.NewIdent("labels"))
+	}
+
+	// defer func() {
+	// 	register the counter on first use
+	// 	if r := recover(); r != nil {
+	// 		countername.Inc()
+	// 		panic(r)
+	// 	}
+	// }()
+	stmt, patchTable := lazyRegisterStmt(varName, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	recoverStmt, patchTable := platform.RecoverStmt(funcname, []dst.Stmt{
+		&dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   metricExpr(varName, values, len(values) != 0),
+					Sel: dst.NewIdent("Inc"),
+				},
+			},
+		},
+	}, platform.LogStack(directive))
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	l := []dst.Stmt{
+		&dst.DeferStmt{
+			Call: &dst.CallExpr{
+				Fun: &dst.FuncLit{
+					Type: funcType,
+					Body: &dst.BlockStmt{List: []dst.Stmt{stmt, recoverStmt}},
+				},
+				Args: args,
+			},
+		},
+	}
 	return g, l, pkgsPatchTable, nil
 }
 
-func globalInitFuncDst(
-	d *parse.CollectInfo,
-	directive *parse.Directive,
-) (*dst.FuncDecl, []*dst.Ident, error) {
-	portNum := defaultPromPort
-	if val, ok := directive.Param("prom-port"); ok {
-		portNum = val
+// get region duration declaration and statements, the start time of the
+// region is stored in a local variable and the duration is observed when the
+// region ends. The end statements are returned by a function since they are
+// inserted at the end of the region and before every return inside it.
+func (p *prometheusProvider) regionStmtsDst(filename string, funcname string,
+	id string, region *parse.Region,
+) (globalDecl []dst.Decl, beginStmts []dst.Stmt,
+	endStmts func() ([]dst.Stmt, []*dst.Ident), pkgsPatchTable []*dst.Ident,
+	err error,
+) {
+	// the name of the region is only used for the metric, regions with the
+	// same name share the metric
+	varName := fmt.Sprintf("%s_%s_%s", filename, funcname, id)
+	startName := fmt.Sprintf("%s_start", varName)
+	labels, err := region.Begin.Labels()
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
-
-	metricsRoute := fmt.Sprintf("\"%s\"", defaultPromPath)
-	if val, ok := directive.Param("prom-route"); ok {
-		metricsRoute = fmt.Sprintf("\"%s\"", val)
+	kind, opts, optsPatchTable, err := p.observerOpts(region.Begin)
+	if err != nil {
+		return nil, nil, nil, nil, err
 	}
 
-	patchTable := []*dst.Ident{}
-	stmts1 := []dst.Stmt{}
-
-	regName := "reg"
-	useExistingReg := false
-	if val, ok := directive.Param("prom-registry"); ok {
-		// use existing registry
-
-		regName = val
-		useExistingReg = true
-	} else {
-		// create new registry
+	// var region_initialized = false
+	// var region_mutex sync.Mutex
+	// var region = prometheus.NewSummary(...)
+	g, pkgsPatchTable := lazyRegisterDecls(varName)
+	decl, patchTable := metricDecl(varName, p.metricsName(region.Name), kind,
+		labelNames(labels), opts...)
+	g = append(g, decl)
+	pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	pkgsPatchTable = append(pkgsPatchTable, optsPatchTable...)
 
-		// reg := prometheus.NewRegistry()
-		stmts1 = append(stmts1, &dst.AssignStmt{
-			Lhs: []dst.Expr{dst.NewIdent(regName)},
+	// region_start := time.Now()
+	timeNow := &dst.SelectorExpr{
+		X:   dst.NewIdent("time"),
+		Sel: dst.NewIdent("Now"),
+	}
+	pkgsPatchTable = append(pkgsPatchTable, timeNow.X.(*dst.Ident))
+	b := []dst.Stmt{
+		&dst.EmptyStmt{},
+		&dst.AssignStmt{
+			Lhs: []dst.Expr{dst.NewIdent(startName)},
 			Tok: token.DEFINE,
-			Rhs: []dst.Expr{
-				&dst.CallExpr{
+			Rhs: []dst.Expr{&dst.CallExpr{Fun: timeNow}},
+		},
+	}
+
+	// register the metric on first use, then
+	// region.Observe(time.Since(region_start).Seconds())
+	//
+	// label values are evaluated when the region ends
+	endStmts = func() ([]dst.Stmt, []*dst.Ident) {
+		stmt, patchTable := lazyRegisterStmt(varName, decl)
+		labels, _ := region.Begin.Labels()
+		values, valuesPatchTable := labelValues(labels)
+		patchTable = append(patchTable, valuesPatchTable...)
+		timeSince := &dst.SelectorExpr{
+			X:   dst.NewIdent("time"),
+			Sel: dst.NewIdent("Since"),
+		}
+		patchTable = append(patchTable, timeSince.X.(*dst.Ident))
+		return []dst.Stmt{
+			&dst.EmptyStmt{},
+			stmt,
+			&dst.ExprStmt{
+				X: &dst.CallExpr{
 					Fun: &dst.SelectorExpr{
-						X:   dst.NewIdent("prometheus"),
-						Sel: dst.NewIdent("NewRegistry"),
+						X:   metricExpr(varName, values, false),
+						Sel: dst.NewIdent("Observe"),
+					},
+					Args: []dst.Expr{
+						&dst.CallExpr{
+							Fun: &dst.SelectorExpr{
+								X: &dst.CallExpr{
+									Fun:  timeSince,
+									Args: []dst.Expr{dst.NewIdent(startName)},
+								},
+								Sel: dst.NewIdent("Seconds"),
+							},
+						},
 					},
 				},
 			},
-		})
-		// add prometheus
-		patchTable = append(
-			patchTable,
-			stmts1[len(stmts1)-1].(*dst.AssignStmt).Rhs[0].(*dst.CallExpr).
-				Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-		)
+		}, patchTable
 	}
+	return g, b, endStmts, pkgsPatchTable, nil
+}
 
-	// globalvar.Set("metrics_gen", reg)
-	stmts1 = append(stmts1, &dst.ExprStmt{
-		X: &dst.CallExpr{
-			Fun: &dst.SelectorExpr{
-				X:   dst.NewIdent("globalvar"),
-				Sel: dst.NewIdent("Set"),
-			},
-			Args: []dst.Expr{
-				&dst.BasicLit{
-					Kind:  token.STRING,
-					Value: "\"metrics_gen\"",
+// get the go-spawn counter and gauge declarations, the statements counting a
+// spawned goroutine and the statements of the goroutine that keep the gauge
+// of running goroutines up to date. The directives with the same name share
+// the metrics.
+func (p *prometheusProvider) goSpawnStmtsDst(filename string, funcname string,
+	id string, name string,
+) (globalDecl []dst.Decl, spawnStmts []dst.Stmt, goroutineStmts []dst.Stmt,
+	pkgsPatchTable []*dst.Ident,
+) {
+	spawnsName := fmt.Sprintf("%s_%s_%s_spawns", filename, funcname, id)
+	liveName := fmt.Sprintf("%s_%s_%s_goroutines", filename, funcname, id)
+
+	// var filename_funcname_id_spawns = prometheus.NewCounter(...)
+	// var filename_funcname_id_goroutines = prometheus.NewGauge(...)
+	// with the variables to register them on first use
+	g := []dst.Decl{}
+	pkgsPatchTable = []*dst.Ident{}
+	// register the metrics on first use
+	s := []dst.Stmt{&dst.EmptyStmt{}}
+	for _, metric := range []struct{ varName, metricsName, kind string }{
+		{spawnsName, fmt.Sprintf("%s_spawns", name), "Counter"},
+		{liveName, fmt.Sprintf("%s_goroutines", name), "Gauge"},
+	} {
+		decls, patchTable := lazyRegisterDecls(metric.varName)
+		g = append(g, decls...)
+		pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+		decl, patchTable := metricDecl(metric.varName,
+			p.metricsName(metric.metricsName), metric.kind, nil)
+		g = append(g, decl)
+		pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+		register, patchTable := lazyRegisterStmt(metric.varName, decl)
+		s = append(s, register)
+		pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	}
+
+	// filename_funcname_id_spawns.Inc()
+	s = append(s,
+		&dst.ExprStmt{
+			X: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   dst.NewIdent(spawnsName),
+					Sel: dst.NewIdent("Inc"),
 				},
-				dst.NewIdent(regName),
 			},
 		},
-	})
-	// add globalvar
-	patchTable = append(
-		patchTable,
-		stmts1[len(stmts1)-1].(*dst.ExprStmt).X.(*dst.CallExpr).
-			Fun.(*dst.SelectorExpr).X.(*dst.Ident),
 	)
 
-	stmts2 := []dst.Stmt{}
-
-	if !useExistingReg {
-		// http.Handle("<route>", promhttp.HandlerFor(prometheus.Gatherers{
-		// 	reg,
-		// 	prometheus.DefaultGatherer,
-		// }, promhttp.HandlerOpts{}))
-		stmts2 = append(stmts2, &dst.ExprStmt{
+	// in the goroutine
+	// filename_funcname_id_goroutines.Inc()
+	// defer filename_funcname_id_goroutines.Dec()
+	l := []dst.Stmt{
+		&dst.ExprStmt{
 			X: &dst.CallExpr{
 				Fun: &dst.SelectorExpr{
-					X:   dst.NewIdent("http"),
-					Sel: dst.NewIdent("Handle"),
+					X:   dst.NewIdent(liveName),
+					Sel: dst.NewIdent("Inc"),
 				},
-				Args: []dst.Expr{
-					&dst.BasicLit{
-						Kind:  token.STRING,
-						Value: metricsRoute,
+			},
+		},
+		&dst.DeferStmt{
+			Call: &dst.CallExpr{
+				Fun: &dst.SelectorExpr{
+					X:   dst.NewIdent(liveName),
+					Sel: dst.NewIdent("Dec"),
+				},
+			},
+		},
+	}
+	return g, s, l, pkgsPatchTable
+}
+
+// get the init function of a chan-depth directive. The gauges of the length
+// and the capacity of the channel read it when the metrics are collected. They
+// are registered at once if the metrics_gen registry is published, otherwise
+// when it is.
+//
+//	func init() {
+//		register := func(reg interface{}) {
+//			for _, c := range []prometheus.Collector{
+//				prometheus.NewGaugeFunc(prometheus.GaugeOpts{...},
+//					func() float64 { return float64(len(ch)) }),
+//				prometheus.NewGaugeFunc(prometheus.GaugeOpts{...},
+//					func() float64 { return float64(cap(ch)) }),
+//			} {
+//				...
+//			}
+//		}
+//		if reg, err := globalvar.Get("metrics_gen"); err == nil {
+//			register(reg)
+//		} else {
+//			pending, _ := globalvar.Get("metrics_gen_pending")
+//			registers, _ := pending.([]func(interface{}))
+//			globalvar.Set("metrics_gen_pending", append(registers, register))
+//		}
+//	}
+func (p *prometheusProvider) chanDepthDeclsDst(filename string, varName string,
+	directive *parse.Directive,
+) (globalDecl []dst.Decl, pkgsPatchTable []*dst.Ident) {
+	name := chanDepthName(filename, varName, directive)
+
+	gauges := []dst.Expr{}
+	for _, builtin := range []string{"len", "cap"} {
+		metricsName := p.metricsName(fmt.Sprintf("%s_%s", name, builtin))
+		gauge := &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X:   dst.NewIdent("prometheus"),
+				Sel: dst.NewIdent("NewGaugeFunc"),
+			},
+			Args: []dst.Expr{
+				&dst.CompositeLit{
+					Type: &dst.SelectorExpr{
+						X:   dst.NewIdent("prometheus"),
+						Sel: dst.NewIdent("GaugeOpts"),
 					},
-					&dst.CallExpr{
-						Fun: &dst.SelectorExpr{
-							X:   dst.NewIdent("promhttp"),
-							Sel: dst.NewIdent("HandlerFor"),
+					Elts: []dst.Expr{
+						&dst.KeyValueExpr{
+							Key: dst.NewIdent("Name"),
+							Value: &dst.BasicLit{
+								Kind:  token.STRING,
+								Value: fmt.Sprintf("\"%s\"", metricsName),
+							},
 						},
-						Args: []dst.Expr{
-							&dst.CompositeLit{
-								Type: &dst.SelectorExpr{
-									X:   dst.NewIdent("prometheus"),
-									Sel: dst.NewIdent("Gatherers"),
-								},
-								Elts: []dst.Expr{
-									dst.NewIdent(regName),
-									&dst.SelectorExpr{
-										X:   dst.NewIdent("prometheus"),
-										Sel: dst.NewIdent("DefaultGatherer"),
-									},
-								},
+						&dst.KeyValueExpr{
+							Key: dst.NewIdent("Help"),
+							Value: &dst.BasicLit{
+								Kind:  token.STRING,
+								Value: fmt.Sprintf("\"%s\"", metricsName),
 							},
-							&dst.CompositeLit{
-								Type: &dst.SelectorExpr{
-									X:   dst.NewIdent("promhttp"),
-									Sel: dst.NewIdent("HandlerOpts"),
+						},
+					},
+				},
+				&dst.FuncLit{
+					Type: &dst.FuncType{
+						Results: &dst.FieldList{
+							List: []*dst.Field{
+								{Type: dst.NewIdent("float64")},
+							},
+						},
+					},
+					Body: &dst.BlockStmt{
+						List: []dst.Stmt{
+							&dst.ReturnStmt{
+								Results: []dst.Expr{
+									floatExpr(&dst.CallExpr{
+										Fun:  dst.NewIdent(builtin),
+										Args: []dst.Expr{dst.NewIdent(varName)},
+									}),
 								},
 							},
 						},
 					},
 				},
 			},
-		})
-		// add http
-		patchTable = append(
-			patchTable,
-			stmts2[len(stmts2)-1].(*dst.ExprStmt).X.(*dst.CallExpr).
-				Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-		)
-		// add promhttp
-		patchTable = append(
-			patchTable,
-			stmts2[len(stmts2)-1].(*dst.ExprStmt).X.(*dst.CallExpr).Args[1].(*dst.CallExpr).
-				Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-		)
-		// add 1st prometheus
-		patchTable = append(
-			patchTable,
-			stmts2[len(stmts2)-1].(*dst.ExprStmt).X.(*dst.CallExpr).Args[1].(*dst.CallExpr).
-				Args[0].(*dst.CompositeLit).Type.(*dst.SelectorExpr).X.(*dst.Ident),
-		)
-		// add 2nd prometheus
-		patchTable = append(
-			patchTable,
-			stmts2[len(stmts2)-1].(*dst.ExprStmt).X.(*dst.CallExpr).Args[1].(*dst.CallExpr).
-				Args[0].(*dst.CompositeLit).Elts[1].(*dst.SelectorExpr).X.(*dst.Ident),
-		)
-		// add promhttp
-		patchTable = append(
-			patchTable,
-			stmts2[len(stmts2)-1].(*dst.ExprStmt).X.(*dst.CallExpr).Args[1].(*dst.CallExpr).
-				Args[1].(*dst.CompositeLit).Type.(*dst.SelectorExpr).X.(*dst.Ident),
+		}
+		pkgsPatchTable = append(pkgsPatchTable,
+			// add 1st prometheus
+			gauge.Fun.(*dst.SelectorExpr).X.(*dst.Ident),
+			// add 2nd prometheus
+			gauge.Args[0].(*dst.CompositeLit).Type.(*dst.SelectorExpr).X.(*dst.Ident),
 		)
+		gauge.Decorations().Before = dst.NewLine
+		gauge.Decorations().After = dst.NewLine
+		gauges = append(gauges, gauge)
+	}
+	registerStmt, registerPatchTable := registerCollectorsStmt(gauges)
+	pkgsPatchTable = append(pkgsPatchTable, registerPatchTable...)
 
-		// http.ListenAndServe(":<port>", nil)
-		stmts2 = append(stmts2, &dst.ExprStmt{
-			X: &dst.CallExpr{
-				Fun: &dst.SelectorExpr{
-					X:   dst.NewIdent("http"),
-					Sel: dst.NewIdent("ListenAndServe"),
+	// register := func(reg interface{}) { ... }
+	registerFunc := &dst.AssignStmt{
+		Lhs: []dst.Expr{dst.NewIdent("register")},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{
+			&dst.FuncLit{
+				Type: &dst.FuncType{
+					Params: &dst.FieldList{
+						List: []*dst.Field{
+							{
+								Names: []*dst.Ident{dst.NewIdent("reg")},
+								Type:  dst.NewIdent("interface{}"),
+							},
+						},
+					},
 				},
-				Args: []dst.Expr{
-					&dst.BasicLit{
-						Kind:  token.STRING,
-						Value: fmt.Sprintf("\":%s\"", portNum),
+				Body: &dst.BlockStmt{List: []dst.Stmt{registerStmt}},
+			},
+		},
+	}
+
+	getReg, getRegPkg := globalvarCall("Get",
+		&dst.BasicLit{Kind: token.STRING, Value: "\"metrics_gen\""})
+	getPending, getPendingPkg := globalvarCall("Get",
+		&dst.BasicLit{Kind: token.STRING, Value: strconv.Quote(pendingRegistersName)})
+	setPending, setPendingPkg := globalvarCall("Set",
+		&dst.BasicLit{Kind: token.STRING, Value: strconv.Quote(pendingRegistersName)},
+		&dst.CallExpr{
+			Fun:  dst.NewIdent("append"),
+			Args: []dst.Expr{dst.NewIdent("registers"), dst.NewIdent("register")},
+		})
+	pkgsPatchTable = append(pkgsPatchTable, getRegPkg, getPendingPkg, setPendingPkg)
+
+	initDecl := platform.DSTInitFunc([]dst.Stmt{
+		registerFunc,
+		&dst.IfStmt{
+			Init: &dst.AssignStmt{
+				Lhs: []dst.Expr{dst.NewIdent("reg"), dst.NewIdent("err")},
+				Tok: token.DEFINE,
+				Rhs: []dst.Expr{getReg},
+			},
+			Cond: &dst.BinaryExpr{
+				X:  dst.NewIdent("err"),
+				Op: token.EQL,
+				Y:  dst.NewIdent("nil"),
+			},
+			Body: &dst.BlockStmt{
+				List: []dst.Stmt{
+					&dst.ExprStmt{
+						X: &dst.CallExpr{
+							Fun:  dst.NewIdent("register"),
+							Args: []dst.Expr{dst.NewIdent("reg")},
+						},
 					},
-					dst.NewIdent("nil"),
 				},
 			},
+			Else: &dst.BlockStmt{
+				List: []dst.Stmt{
+					&dst.AssignStmt{
+						Lhs: []dst.Expr{dst.NewIdent("pending"), dst.NewIdent("_")},
+						Tok: token.DEFINE,
+						Rhs: []dst.Expr{getPending},
+					},
+					&dst.AssignStmt{
+						Lhs: []dst.Expr{dst.NewIdent("registers"), dst.NewIdent("_")},
+						Tok: token.DEFINE,
+						Rhs: []dst.Expr{
+							&dst.TypeAssertExpr{
+								X:    dst.NewIdent("pending"),
+								Type: pendingRegistersType(),
+							},
+						},
+					},
+					&dst.ExprStmt{X: setPending},
+				},
+			},
+		},
+	})
+	return []dst.Decl{initDecl}, pkgsPatchTable
+}
+
+// get the lock-wait histograms of the time a lock call blocks and of the time
+// the mutex is held, the statements that observe the wait time around the lock
+// call and the statements that observe the hold time when the mutex is
+// released. The hold time is only measured if the unlock is found.
+func (p *prometheusProvider) lockWaitStmtsDst(filename string, funcname string,
+	id string, lock *parse.Lock,
+) (globalDecl []dst.Decl, beforeStmts []dst.Stmt, afterStmts []dst.Stmt,
+	holdStmts func() ([]dst.Stmt, []*dst.Ident), pkgsPatchTable []*dst.Ident,
+	err error,
+) {
+	name, ok := lock.Directive.Param("name")
+	if !ok || name == "" {
+		return nil, nil, nil, nil, nil, fmt.Errorf("name is required for lock-wait")
+	}
+	// the name is only used for the metrics, the locks with the same name
+	// share them
+	waitName := fmt.Sprintf("%s_%s_%s_wait", filename, funcname, id)
+	holdName := fmt.Sprintf("%s_%s_%s_hold", filename, funcname, id)
+	metrics := []struct{ varName, metricsName string }{
+		{waitName, fmt.Sprintf("%s_wait", name)},
+	}
+	if lock.Holds() {
+		metrics = append(metrics, struct{ varName, metricsName string }{
+			holdName, fmt.Sprintf("%s_hold", name),
 		})
-		// add http
-		patchTable = append(
-			patchTable,
-			stmts2[len(stmts2)-1].(*dst.ExprStmt).X.(*dst.CallExpr).
-				Fun.(*dst.SelectorExpr).X.(*dst.Ident),
-		)
 	}
 
-	// put statements into a function that will be executed in a goroutine
-	stmts2 = []dst.Stmt{
-		&dst.GoStmt{
-			Call: &dst.CallExpr{
-				Fun: &dst.FuncLit{
-					Type: &dst.FuncType{},
-					Body: &dst.BlockStmt{
-						List: stmts2,
+	// var filename_funcname_id_wait = prometheus.NewHistogram(...)
+	// var filename_funcname_id_hold = prometheus.NewHistogram(...)
+	// with the variables to register them on first use
+	g := []dst.Decl{}
+	pkgsPatchTable = []*dst.Ident{}
+	b := []dst.Stmt{&dst.EmptyStmt{}}
+	for _, metric := range metrics {
+		varName := metric.varName
+		opts, optsPatchTable, err := p.histogramOpts(lock.Directive)
+		if err != nil {
+			return nil, nil, nil, nil, nil, err
+		}
+		decls, patchTable := lazyRegisterDecls(varName)
+		g = append(g, decls...)
+		pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+		decl, patchTable := metricDecl(varName, p.metricsName(metric.metricsName),
+			"Histogram", nil, opts...)
+		g = append(g, decl)
+		pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+		pkgsPatchTable = append(pkgsPatchTable, optsPatchTable...)
+
+		// the metrics are registered before the lock so that the first
+		// registration is not measured
+		register, patchTable := lazyRegisterStmt(varName, decl)
+		b = append(b, register)
+		pkgsPatchTable = append(pkgsPatchTable, patchTable...)
+	}
+
+	// filename_funcname_id_wait_start := time.Now()
+	startStmt, ident := timeNowStmt(fmt.Sprintf("%s_start", waitName))
+	pkgsPatchTable = append(pkgsPatchTable, ident)
+	b = append(b, startStmt)
+
+	// filename_funcname_id_wait.Observe(time.Since(filename_funcname_id_wait_start).Seconds())
+	// filename_funcname_id_hold_start := time.Now()
+	observe, ident := observeSinceStmt(waitName)
+	pkgsPatchTable = append(pkgsPatchTable, ident)
+	a := []dst.Stmt{observe}
+	if lock.Holds() {
+		startStmt, ident := timeNowStmt(fmt.Sprintf("%s_start", holdName))
+		pkgsPatchTable = append(pkgsPatchTable, ident)
+		a = append(a, startStmt)
+	}
+
+	// filename_funcname_id_hold.Observe(time.Since(filename_funcname_id_hold_start).Seconds())
+	holdStmts = func() ([]dst.Stmt, []*dst.Ident) {
+		observe, ident := observeSinceStmt(holdName)
+		return []dst.Stmt{observe}, []*dst.Ident{ident}
+	}
+	return g, b, a, holdStmts, pkgsPatchTable, nil
+}
+
+// timeNowStmt returns the statement that keeps the current time in a variable,
+// the returned ident has to be added to the patch table
+//
+//	name := time.Now()
+func timeNowStmt(varName string) (dst.Stmt, *dst.Ident) {
+	pkg := dst.NewIdent("time")
+	return &dst.AssignStmt{
+		Lhs: []dst.Expr{dst.NewIdent(varName)},
+		Tok: token.DEFINE,
+		Rhs: []dst.Expr{
+			&dst.CallExpr{
+				Fun: &dst.SelectorExpr{X: pkg, Sel: dst.NewIdent("Now")},
+			},
+		},
+	}, pkg
+}
+
+// observeSinceStmt returns the statement that observes the seconds elapsed
+// since the time kept in the start variable of a metric, the returned ident
+// has to be added to the patch table
+//
+//	name.Observe(time.Since(name_start).Seconds())
+func observeSinceStmt(varName string) (dst.Stmt, *dst.Ident) {
+	pkg := dst.NewIdent("time")
+	return &dst.ExprStmt{
+		X: &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X:   dst.NewIdent(varName),
+				Sel: dst.NewIdent("Observe"),
+			},
+			Args: []dst.Expr{
+				&dst.CallExpr{
+					Fun: &dst.SelectorExpr{
+						X: &dst.CallExpr{
+							Fun: &dst.SelectorExpr{
+								X:   pkg,
+								Sel: dst.NewIdent("Since"),
+							},
+							Args: []dst.Expr{
+								dst.NewIdent(fmt.Sprintf("%s_start", varName)),
+							},
+						},
+						Sel: dst.NewIdent("Seconds"),
 					},
 				},
 			},
 		},
-	}
-	// combine stmts1 and stmts2 into a function
-	stmts2 = append(stmts1, stmts2...)
-	return platform.DSTInitFunc(stmts2), patchTable, nil
+	}, pkg
 }
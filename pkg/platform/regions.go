@@ -0,0 +1,26 @@
+package platform
+
+import (
+	"fmt"
+
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+)
+
+// RegionsByBegin returns the regions of a file by their region-begin directive
+func RegionsByBegin(d *parse.CollectInfo,
+	filename string,
+) (map[*parse.Directive]*parse.Region, error) {
+	regions, err := d.Regions(filename)
+	if err != nil {
+		if regionErr, ok := err.(*parse.RegionError); ok {
+			pos := d.DirectivePosition(regionErr.Directive)
+			return nil, fmt.Errorf("%s: %v", pos, err)
+		}
+		return nil, err
+	}
+	res := make(map[*parse.Directive]*parse.Region)
+	for _, region := range regions {
+		res[region.Begin] = region
+	}
+	return res, nil
+}
@@ -0,0 +1,107 @@
+package platform
+
+import (
+	"fmt"
+	"go/token"
+	"math"
+	"strconv"
+
+	"github.com/dave/dst"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+)
+
+// parseRate parses a fraction in (0, 1]
+func parseRate(value string) (float64, error) {
+	rate, err := strconv.ParseFloat(value, 64)
+	if err != nil || !(rate > 0 && rate <= 1) {
+		return 0, fmt.Errorf("%q is not a rate, use a number greater than 0 "+
+			"and at most 1", value)
+	}
+	return rate, nil
+}
+
+// SamplePeriod returns the number of calls per observation of a directive with
+// a sample-rate parameter, every round(1/rate)-th call is observed. It is 1 if
+// the directive has no sample rate.
+func SamplePeriod(directive *parse.Directive) (uint64, error) {
+	v, ok := directive.Param("sample-rate")
+	if !ok {
+		return 1, nil
+	}
+	rate, err := parseRate(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sample-rate: %v", err)
+	}
+	return uint64(math.Round(1 / rate)), nil
+}
+
+// Sampled makes the statements of a directive with a sample-rate parameter run
+// for one call out of the sample period. The calls are counted by an atomic
+// counter, which is declared with the global declarations.
+//
+//	var filename_id_calls uint64
+//
+//	if atomic.AddUint64(&filename_id_calls, 1)%100 == 0 {
+//		stmts...
+//	}
+func Sampled(d *parse.CollectInfo, directive *parse.Directive,
+	globalDecl []dst.Decl, stmts []dst.Stmt, patchTable []*dst.Ident,
+) ([]dst.Decl, []dst.Stmt, []*dst.Ident, error) {
+	period, err := SamplePeriod(directive)
+	if err != nil || period == 1 {
+		return globalDecl, stmts, patchTable, err
+	}
+
+	counter := fmt.Sprintf("%s_%s_calls",
+		FileName(d, directive.Filename()), d.DirectiveID(directive))
+	decl := &dst.GenDecl{
+		Tok: token.VAR,
+		Specs: []dst.Spec{
+			&dst.ValueSpec{
+				Names: []*dst.Ident{dst.NewIdent(counter)},
+				Type:  dst.NewIdent("uint64"),
+			},
+		},
+	}
+	pkg := dst.NewIdent("atomic")
+	stmt := &dst.IfStmt{
+		Cond: &dst.BinaryExpr{
+			X: &dst.BinaryExpr{
+				X: &dst.CallExpr{
+					Fun: &dst.SelectorExpr{X: pkg, Sel: dst.NewIdent("AddUint64")},
+					Args: []dst.Expr{
+						&dst.UnaryExpr{Op: token.AND, X: dst.NewIdent(counter)},
+						&dst.BasicLit{Kind: token.INT, Value: "1"},
+					},
+				},
+				Op: token.REM,
+				Y: &dst.BasicLit{
+					Kind:  token.INT,
+					Value: strconv.FormatUint(period, 10),
+				},
+			},
+			Op: token.EQL,
+			Y:  &dst.BasicLit{Kind: token.INT, Value: "0"},
+		},
+		Body: &dst.BlockStmt{List: stmts},
+	}
+	return append(globalDecl, decl), []dst.Stmt{stmt},
+		append(patchTable, pkg), nil
+}
+
+// PkgsWithSampling returns pkgs with the packages needed to sample the calls
+// of a directive added
+func PkgsWithSampling(pkgs map[string]*parse.PackageInfo,
+	directive *parse.Directive,
+) map[string]*parse.PackageInfo {
+	if period, err := SamplePeriod(directive); err != nil || period == 1 {
+		return pkgs
+	}
+	res := map[string]*parse.PackageInfo{
+		"atomic": {Name: "atomic", Path: "sync/atomic"},
+	}
+	for k, v := range pkgs {
+		res[k] = v
+	}
+	return res
+}
@@ -0,0 +1,324 @@
+package platform
+
+import (
+	"fmt"
+	"go/token"
+	"strconv"
+	"time"
+
+	"github.com/dave/dst"
+	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
+)
+
+// loggers that can log the slow calls, the slow-logger parameter of the
+// definition directive selects one of them
+var slowLoggers = map[string]*parse.PackageInfo{
+	"log":    {Name: "log", Path: "log"},
+	"slog":   {Name: "slog", Path: "log/slog"},
+	"logrus": {Name: "logrus", Path: "github.com/sirupsen/logrus"},
+}
+
+// SlowLoggerNames are the values of the slow-logger parameter
+var SlowLoggerNames = []string{"log", "slog", "logrus"}
+
+// slow calls of a function are logged at most once per interval by default
+const defaultSlowLogInterval = time.Second
+
+// SlowThreshold returns the slow-threshold of a directive, or 0 if the slow
+// calls are not logged
+func SlowThreshold(directive *parse.Directive) (time.Duration, error) {
+	v, ok := directive.Param("slow-threshold")
+	if !ok {
+		return 0, nil
+	}
+	threshold, err := time.ParseDuration(v)
+	if err != nil || threshold <= 0 {
+		return 0, fmt.Errorf("invalid slow-threshold %q, use a positive "+
+			"duration like \"250ms\"", v)
+	}
+	return threshold, nil
+}
+
+// slowLogger returns the logger selected by the definition directive of a
+// module
+func slowLogger(d *parse.CollectInfo, goMod string) (string, error) {
+	name := "log"
+	if def := d.ModuleDefinitionDirective(goMod); def != nil {
+		if v, ok := def.Param("slow-logger"); ok {
+			name = v
+		}
+	}
+	if _, ok := slowLoggers[name]; !ok {
+		return "", fmt.Errorf("unknown slow-logger %q, use log, slog or logrus",
+			name)
+	}
+	return name, nil
+}
+
+// slowLogInterval returns the minimum interval between two logs of the slow
+// calls of a function in a file
+func slowLogInterval(d *parse.CollectInfo, filename string) (time.Duration, error) {
+	if def := d.DefinitionDirective(filename); def != nil {
+		if v, ok := def.Param("slow-log-interval"); ok {
+			interval, err := time.ParseDuration(v)
+			if err != nil {
+				return 0, fmt.Errorf("invalid slow-log-interval %q", v)
+			}
+			return interval, nil
+		}
+	}
+	return defaultSlowLogInterval, nil
+}
+
+// slowStackSize returns the number of bytes of the stack logged with a slow
+// call, 0 if the stack is not logged
+func slowStackSize(directive *parse.Directive) (int, error) {
+	v, ok := directive.Param("slow-stack")
+	if !ok {
+		return 0, nil
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid slow-stack %q, use a number of bytes", v)
+	}
+	return size, nil
+}
+
+// slowFuncName returns the name of the function of a directive as it is
+// logged, e.g. api.Server.Close
+func slowFuncName(d *parse.CollectInfo, directive *parse.Directive) string {
+	funcDecl, ok := directive.Declaration().(*dst.FuncDecl)
+	if !ok {
+		return ""
+	}
+	name := funcDecl.Name.Name
+	if recv := d.ReceiverTypeName(directive.Filename(), funcDecl); recv != "" {
+		name = recv + "." + name
+	}
+	return d.PackageName(directive.Filename()) + "." + name
+}
+
+// slowLogStmt returns the statement that logs a slow call with the selected
+// logger, the duration is read from durationName and the stack from stackName
+// if it is not empty
+//
+//	log.Printf("slow call of pkg.f: %v\n%s", d, stack)
+//	slog.Warn("slow call", "func", "pkg.f", "duration", d, "stack", string(stack))
+//	logrus.WithFields(logrus.Fields{"func": "pkg.f", ...}).Warn("slow call")
+func slowLogStmt(logger string, funcName string, durationName string,
+	stackName string,
+) (dst.Stmt, []*dst.Ident) {
+	str := func(s string) dst.Expr {
+		return &dst.BasicLit{Kind: token.STRING, Value: strconv.Quote(s)}
+	}
+	var stack dst.Expr
+	if stackName != "" {
+		stack = &dst.CallExpr{
+			Fun:  dst.NewIdent("string"),
+			Args: []dst.Expr{dst.NewIdent(stackName)},
+		}
+	}
+
+	pkg := dst.NewIdent(slowLoggers[logger].Name)
+	patchTable := []*dst.Ident{pkg}
+	var call *dst.CallExpr
+	switch logger {
+	case "slog":
+		args := []dst.Expr{
+			str("slow call"),
+			str("func"), str(funcName),
+			str("duration"), dst.NewIdent(durationName),
+		}
+		if stack != nil {
+			args = append(args, str("stack"), stack)
+		}
+		call = &dst.CallExpr{
+			Fun:  &dst.SelectorExpr{X: pkg, Sel: dst.NewIdent("Warn")},
+			Args: args,
+		}
+	case "logrus":
+		fieldsType := dst.NewIdent("logrus")
+		patchTable = append(patchTable, fieldsType)
+		fields := []dst.Expr{
+			&dst.KeyValueExpr{Key: str("func"), Value: str(funcName)},
+			&dst.KeyValueExpr{Key: str("duration"), Value: dst.NewIdent(durationName)},
+		}
+		if stack != nil {
+			fields = append(fields, &dst.KeyValueExpr{Key: str("stack"), Value: stack})
+		}
+		call = &dst.CallExpr{
+			Fun: &dst.SelectorExpr{
+				X: &dst.CallExpr{
+					Fun: &dst.SelectorExpr{X: pkg, Sel: dst.NewIdent("WithFields")},
+					Args: []dst.Expr{
+						&dst.CompositeLit{
+							Type: &dst.SelectorExpr{
+								X:   fieldsType,
+								Sel: dst.NewIdent("Fields"),
+							},
+							Elts: fields,
+						},
+					},
+				},
+				Sel: dst.NewIdent("Warn"),
+			},
+			Args: []dst.Expr{str("slow call")},
+		}
+	default:
+		format := fmt.Sprintf("slow call of %s: %%v", funcName)
+		args := []dst.Expr{nil, dst.NewIdent(durationName)}
+		if stack != nil {
+			format += "\n%s"
+			args = append(args, dst.NewIdent(stackName))
+		}
+		args[0] = str(format)
+		call = &dst.CallExpr{
+			Fun:  &dst.SelectorExpr{X: pkg, Sel: dst.NewIdent("Printf")},
+			Args: args,
+		}
+	}
+	return &dst.ExprStmt{X: call}, patchTable
+}
+
+// SlowCallStmts returns the declarations and the statements that log the calls
+// of a directive slower than its slow-threshold. The statements read the
+// duration of the call from the variable named durationName. The logs are
+// limited to one per slow-log-interval of the definition directive with an
+// atomic timestamp. No statements are returned without a threshold.
+//
+//	var filename_id_slow_logged int64
+//
+//	if d > 250 * time.Millisecond {
+//		if ...; ..._now-..._last >= int64(1 * time.Second) && ... {
+//			stack := debug.Stack()
+//			if len(stack) > 2048 {
+//				stack = stack[:2048]
+//			}
+//			log.Printf("slow call of pkg.f: %v\n%s", d, stack)
+//		}
+//	}
+func SlowCallStmts(d *parse.CollectInfo, directive *parse.Directive,
+	durationName string,
+) ([]dst.Decl, []dst.Stmt, []*dst.Ident, error) {
+	threshold, err := SlowThreshold(directive)
+	if err != nil || threshold == 0 {
+		return nil, nil, nil, err
+	}
+	logger, err := slowLogger(d, d.GoModPath(directive.Filename()))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	interval, err := slowLogInterval(d, directive.Filename())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stackSize, err := slowStackSize(directive)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	logged := fmt.Sprintf("%s_%s_slow_logged",
+		FileName(d, directive.Filename()), d.DirectiveID(directive))
+	patchTable := []*dst.Ident{}
+	thresholdExpr, thresholdPkg := DurationExpr(threshold)
+	patchTable = append(patchTable, thresholdPkg)
+
+	body := []dst.Stmt{}
+	stackName := ""
+	if stackSize != 0 {
+		// stack := debug.Stack()
+		// if len(stack) > size {
+		// 	stack = stack[:size]
+		// }
+		stackName = "stack"
+		debugPkg := dst.NewIdent("debug")
+		patchTable = append(patchTable, debugPkg)
+		size := &dst.BasicLit{Kind: token.INT, Value: strconv.Itoa(stackSize)}
+		body = append(body,
+			&dst.AssignStmt{
+				Lhs: []dst.Expr{dst.NewIdent(stackName)},
+				Tok: token.DEFINE,
+				Rhs: []dst.Expr{
+					&dst.CallExpr{
+						Fun: &dst.SelectorExpr{X: debugPkg, Sel: dst.NewIdent("Stack")},
+					},
+				},
+			},
+			&dst.IfStmt{
+				Cond: &dst.BinaryExpr{
+					X: &dst.CallExpr{
+						Fun:  dst.NewIdent("len"),
+						Args: []dst.Expr{dst.NewIdent(stackName)},
+					},
+					Op: token.GTR,
+					Y:  size,
+				},
+				Body: &dst.BlockStmt{
+					List: []dst.Stmt{
+						&dst.AssignStmt{
+							Lhs: []dst.Expr{dst.NewIdent(stackName)},
+							Tok: token.ASSIGN,
+							Rhs: []dst.Expr{
+								&dst.SliceExpr{
+									X:    dst.NewIdent(stackName),
+									High: dst.Clone(size).(dst.Expr),
+								},
+							},
+						},
+					},
+				},
+			},
+		)
+	}
+	logStmt, logPatchTable := slowLogStmt(logger, slowFuncName(d, directive),
+		durationName, stackName)
+	patchTable = append(patchTable, logPatchTable...)
+	body = append(body, logStmt)
+
+	limited, limitedPatchTable := onceEveryStmt(logged, interval, body)
+	patchTable = append(patchTable, limitedPatchTable...)
+	stmt := &dst.IfStmt{
+		Cond: &dst.BinaryExpr{
+			X:  dst.NewIdent(durationName),
+			Op: token.GTR,
+			Y:  thresholdExpr,
+		},
+		Body: &dst.BlockStmt{List: []dst.Stmt{limited}},
+	}
+	return []dst.Decl{timestampDecl(logged)}, []dst.Stmt{stmt}, patchTable, nil
+}
+
+// PkgsWithSlowLog returns pkgs with the packages needed to log the slow calls
+// of a directive added
+func PkgsWithSlowLog(d *parse.CollectInfo, pkgs map[string]*parse.PackageInfo,
+	directive *parse.Directive,
+) map[string]*parse.PackageInfo {
+	if threshold, err := SlowThreshold(directive); err != nil || threshold == 0 {
+		return pkgs
+	}
+	logger, err := slowLogger(d, d.GoModPath(directive.Filename()))
+	if err != nil {
+		return pkgs
+	}
+	res := map[string]*parse.PackageInfo{
+		"time":   {Name: "time", Path: "time"},
+		"atomic": {Name: "atomic", Path: "sync/atomic"},
+		logger:   slowLoggers[logger],
+	}
+	if size, err := slowStackSize(directive); err == nil && size != 0 {
+		res["debug"] = &parse.PackageInfo{Name: "debug", Path: "runtime/debug"}
+	}
+	for k, v := range pkgs {
+		res[k] = v
+	}
+	return res
+}
+
+// SlowLogModules returns the modules that have to be added to a go.mod for the
+// logger of the slow calls
+func SlowLogModules(d *parse.CollectInfo, goMod string) []string {
+	if logger, err := slowLogger(d, goMod); err == nil && logger == "logrus" {
+		return []string{slowLoggers[logger].Path}
+	}
+	return nil
+}
@@ -1,6 +1,10 @@
 package platform
 
 import (
+	"go/token"
+	"strconv"
+	"time"
+
 	"github.com/dave/dst"
 	"github.com/wilsonwang371/metrics-gen/metrics-gen/pkg/parse"
 )
@@ -15,6 +19,9 @@ type MetricsProvider interface {
 
 	// post patch
 	PostPatch(info *parse.CollectInfo) error
+
+	// directives and parameters supported by the provider
+	Schema() Schema
 }
 
 type MetricsProviderConfig struct {
@@ -23,6 +30,7 @@ type MetricsProviderConfig struct {
 	DryRun        bool
 	Inplace       bool
 	Suffix        string
+	OverlayDir    string // write patched files to an overlay directory
 }
 
 func DSTInitFunc(stmts []dst.Stmt) *dst.FuncDecl {
@@ -34,3 +42,38 @@ func DSTInitFunc(stmts []dst.Stmt) *dst.FuncDecl {
 		},
 	}
 }
+
+// DurationExpr returns a duration in the largest unit that divides it, the
+// returned ident has to be added to the patch table
+//
+//	10 * time.Minute
+func DurationExpr(d time.Duration) (dst.Expr, *dst.Ident) {
+	units := []struct {
+		name string
+		unit time.Duration
+	}{
+		{"Hour", time.Hour},
+		{"Minute", time.Minute},
+		{"Second", time.Second},
+		{"Millisecond", time.Millisecond},
+		{"Microsecond", time.Microsecond},
+		{"Nanosecond", time.Nanosecond},
+	}
+	// a nanosecond divides any duration
+	u := units[len(units)-1]
+	for _, unit := range units {
+		if d%unit.unit == 0 {
+			u = unit
+			break
+		}
+	}
+	pkg := dst.NewIdent("time")
+	return &dst.BinaryExpr{
+		X: &dst.BasicLit{
+			Kind:  token.INT,
+			Value: strconv.FormatInt(int64(d/u.unit), 10),
+		},
+		Op: token.MUL,
+		Y:  &dst.SelectorExpr{X: pkg, Sel: dst.NewIdent(u.name)},
+	}, pkg
+}
@@ -0,0 +1,172 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// number of unchanged lines around each change in a unified diff
+const diffContextLines = 3
+
+type diffOp struct {
+	kind byte // ' ' for equal lines, '-' for deleted lines, '+' for inserted lines
+	line string
+}
+
+// splitLines splits data into lines, each line keeps its trailing newline
+func splitLines(data string) []string {
+	lines := strings.SplitAfter(data, "\n")
+	if len(lines) != 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines computes the shortest edit script between a and b with the Myers
+// algorithm
+func diffLines(a, b []string) []diffOp {
+	n, m := len(a), len(b)
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	// trace[d] keeps v[-d-1 .. d+1] before the d-th round
+	trace := [][]int{}
+
+out:
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int{}, v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break out
+			}
+		}
+	}
+
+	// walk back the trace to find the edits
+	res := []diffOp{}
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		vd := func(k int) int { return trace[d][k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && vd(k-1) < vd(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := vd(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			res = append(res, diffOp{kind: ' ', line: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				res = append(res, diffOp{kind: '+', line: b[y-1]})
+			} else {
+				res = append(res, diffOp{kind: '-', line: a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	// reverse the edits
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return res
+}
+
+func hunkRange(start int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start-1)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// UnifiedDiff returns a git style unified diff between the old and the new
+// content of a file. It returns an empty string if the contents are the same.
+func UnifiedDiff(path string, oldData []byte, newData []byte) string {
+	ops := diffLines(splitLines(string(oldData)), splitLines(string(newData)))
+
+	changes := []int{}
+	for idx, op := range ops {
+		if op.kind != ' ' {
+			changes = append(changes, idx)
+		}
+	}
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "diff --git a/%s b/%s\n", path, path)
+	fmt.Fprintf(&sb, "--- a/%s\n", path)
+	fmt.Fprintf(&sb, "+++ b/%s\n", path)
+
+	// line numbers before each op
+	oldLine := make([]int, len(ops))
+	newLine := make([]int, len(ops))
+	for idx, a, b := 0, 1, 1; idx < len(ops); idx++ {
+		oldLine[idx], newLine[idx] = a, b
+		if ops[idx].kind != '+' {
+			a++
+		}
+		if ops[idx].kind != '-' {
+			b++
+		}
+	}
+
+	for i := 0; i < len(changes); {
+		// merge changes that are close to each other into one hunk
+		j := i
+		for j+1 < len(changes) && changes[j+1]-changes[j] <= 2*diffContextLines {
+			j++
+		}
+		start := changes[i] - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		end := changes[j] + diffContextLines + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		oldCount, newCount := 0, 0
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(oldLine[start], oldCount),
+			hunkRange(newLine[start], newCount))
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				sb.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		i = j + 1
+	}
+	return sb.String()
+}
@@ -0,0 +1,90 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// numbered returns the lines "01" to n, with "x" instead of the lines in
+// changed
+func numbered(n int, changed ...int) string {
+	lines := []string{}
+	for idx := 1; idx <= n; idx++ {
+		line := fmt.Sprintf("%02d", idx)
+		for _, c := range changed {
+			if c == idx {
+				line = "x"
+			}
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	const header = "diff --git a/f.go b/f.go\n--- a/f.go\n+++ b/f.go\n"
+	tests := []struct {
+		name    string
+		oldData string
+		newData string
+		want    string
+	}{
+		{
+			name:    "same content",
+			oldData: numbered(5),
+			newData: numbered(5),
+			want:    "",
+		},
+		{
+			name:    "changed line",
+			oldData: numbered(10),
+			newData: numbered(10, 5),
+			want: header + "@@ -2,7 +2,7 @@\n" +
+				" 02\n 03\n 04\n-05\n+x\n 06\n 07\n 08\n",
+		},
+		{
+			name:    "close changes in one hunk",
+			oldData: numbered(12),
+			newData: numbered(12, 3, 9),
+			want: header + "@@ -1,12 +1,12 @@\n" +
+				" 01\n 02\n-03\n+x\n 04\n 05\n 06\n 07\n 08\n-09\n+x\n 10\n 11\n 12\n",
+		},
+		{
+			name:    "distant changes in two hunks",
+			oldData: numbered(20),
+			newData: numbered(20, 2, 18),
+			want: header + "@@ -1,5 +1,5 @@\n" +
+				" 01\n-02\n+x\n 03\n 04\n 05\n" +
+				"@@ -15,6 +15,6 @@\n" +
+				" 15\n 16\n 17\n-18\n+x\n 19\n 20\n",
+		},
+		{
+			name:    "new file",
+			oldData: "",
+			newData: "a\nb\n",
+			want:    header + "@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			name:    "removed lines",
+			oldData: "a\nb\nc\n",
+			newData: "a\n",
+			want:    header + "@@ -1,3 +1 @@\n a\n-b\n-c\n",
+		},
+		{
+			name:    "no newline at end of file",
+			oldData: "a\nb",
+			newData: "a\nb\n",
+			want: header + "@@ -1,2 +1,2 @@\n a\n-b\n" +
+				"\\ No newline at end of file\n+b\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := UnifiedDiff("f.go", []byte(tt.oldData), []byte(tt.newData))
+			if got != tt.want {
+				t.Errorf("got:\n%s\nwant:\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,11 +1,13 @@
 package utils
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
-	"math/rand"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	log "github.com/sirupsen/logrus"
@@ -40,13 +42,14 @@ func DeduplicateStrings(input []string) []string {
 	return deduplicated
 }
 
-// GoGetPackage runs `go get` on the given import path
-func GoGetPackage(importPath string) error {
+// GoGetPackage runs `go get` on the given import path, goFlags are passed to
+// the go command
+func GoGetPackage(importPath string, goFlags ...string) error {
 	log.Infof("go get %s", importPath)
 	success := false
 	cmds := [][]string{
-		{"go", "get", "-d", importPath},
-		{"go", "install", importPath},
+		append(append([]string{"go", "get"}, goFlags...), "-d", importPath),
+		append(append([]string{"go", "install"}, goFlags...), importPath),
 	}
 	for _, cmd := range cmds {
 		c := exec.Command(cmd[0], cmd[1:]...)
@@ -65,8 +68,9 @@ func GoGetPackage(importPath string) error {
 	return nil
 } // ignore_security_alert RCE
 
-// GetPackages updates the packages in go.mod
-func FetchPackages(goModPath string, pkgs []string) error {
+// FetchPackages updates the packages in go.mod, goFlags are passed to the go
+// command
+func FetchPackages(goModPath string, pkgs []string, goFlags ...string) error {
 	// get current working directory
 	cwd, err := os.Getwd()
 	if err != nil {
@@ -91,7 +95,7 @@ func FetchPackages(goModPath string, pkgs []string) error {
 	}
 
 	for _, pkg := range pkgs {
-		if err := GoGetPackage(pkg); err != nil {
+		if err := GoGetPackage(pkg, goFlags...); err != nil {
 			return err
 		}
 	}
@@ -103,11 +107,37 @@ func FetchPackages(goModPath string, pkgs []string) error {
 	return nil
 }
 
+// ParseArguments parses "key=value" pairs separated by whitespace. A value can
+// be enclosed in double quotes to contain whitespace, e.g. value="len(q) + 1".
 func ParseArguments(input string) map[string]string {
 	args := make(map[string]string)
 
-	// Split the input string by whitespace
-	parts := strings.Fields(input)
+	// Split the input string by whitespace outside of double quotes
+	parts := []string{}
+	var part strings.Builder
+	quoted := false
+	for i := 0; i < len(input); i++ {
+		c := input[i]
+		switch {
+		case c == '\\' && quoted && i+1 < len(input):
+			part.WriteByte(c)
+			part.WriteByte(input[i+1])
+			i++
+		case c == '"':
+			quoted = !quoted
+			part.WriteByte(c)
+		case !quoted && (c == ' ' || c == '\t'):
+			if part.Len() != 0 {
+				parts = append(parts, part.String())
+				part.Reset()
+			}
+		default:
+			part.WriteByte(c)
+		}
+	}
+	if part.Len() != 0 {
+		parts = append(parts, part.String())
+	}
 
 	// Parse each part in the format "key=value"
 	for _, part := range parts {
@@ -115,6 +145,10 @@ func ParseArguments(input string) map[string]string {
 		if len(keyValue) == 2 {
 			key := keyValue[0]
 			value := keyValue[1]
+			if unquoted, err := strconv.Unquote(value); err == nil &&
+				strings.HasPrefix(value, `"`) {
+				value = unquoted
+			}
 			args[key] = value
 		}
 	}
@@ -122,14 +156,17 @@ func ParseArguments(input string) map[string]string {
 	return args
 }
 
-// Function to generate a random number string of a specified length
-func GenerateRandNumString(length int) string {
-	const charset = "0123456789" // You can add more characters if needed
-	result := make([]byte, length)
-
-	for i := 0; i < length; i++ {
-		result[i] = charset[rand.Intn(len(charset))]
+// StableHash returns the first length hex digits of the sha1 hash of parts.
+// The same parts always give the same string.
+func StableHash(length int, parts ...string) string {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
 	}
-
-	return string(result)
+	res := hex.EncodeToString(h.Sum(nil))
+	if length < len(res) {
+		res = res[:length]
+	}
+	return res
 }
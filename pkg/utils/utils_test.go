@@ -0,0 +1,23 @@
+package utils
+
+import "testing"
+
+func TestStableHash(t *testing.T) {
+	// the hash is part of the generated identifiers, changing it renames them
+	// in every patched file
+	if got := StableHash(8, "a", "b"); got != "5b408540" {
+		t.Errorf("got %s, want 5b408540", got)
+	}
+	if StableHash(8, "pkg", "f", "0") != StableHash(8, "pkg", "f", "0") {
+		t.Error("same parts give different hashes")
+	}
+	if StableHash(8, "ab", "c") == StableHash(8, "a", "bc") {
+		t.Error("parts are not separated in the hash")
+	}
+	if got := StableHash(4, "a", "b"); got != "5b40" {
+		t.Errorf("got %s, want 5b40", got)
+	}
+	if got := StableHash(100, "a", "b"); len(got) != 40 {
+		t.Errorf("got %d digits, want the 40 digits of the hash", len(got))
+	}
+}